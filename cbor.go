@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// cborMaxDepth limits nesting of CBOR data items, WebAuthn structures are at most a few levels deep.
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first CBOR data item (RFC 8949) of data, and returns it with the remaining bytes.
+// It supports the subset used by WebAuthn: integers (int64), byte strings ([]byte), text strings (string),
+// arrays ([]interface{}), maps (map[interface{}]interface{} with int64 or string keys) and the simple values
+// false, true and null, all of definite length. Tags, floats and indefinite lengths are rejected.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("CBOR data nested too deeply")
+	}
+
+	if len(data) == 0 {
+		return nil, nil, errors.New("unexpected end of CBOR data")
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(data) < n {
+			return nil, nil, errors.New("unexpected end of CBOR data")
+		}
+		for _, b := range data[:n] {
+			arg = arg<<8 | uint64(b)
+		}
+		data = data[n:]
+	default:
+		return nil, nil, fmt.Errorf("unsupported CBOR additional information %d", info)
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer out of range")
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer out of range")
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errors.New("unexpected end of CBOR data")
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return data[:arg:arg], data[arg:], nil
+	case 4:
+		// every item takes at least one byte, so the length can be checked before allocating
+		if arg > uint64(len(data)) {
+			return nil, nil, errors.New("unexpected end of CBOR data")
+		}
+		items := make([]interface{}, arg)
+		for i := range items {
+			var err error
+			items[i], data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, errors.New("unexpected end of CBOR data")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("unsupported CBOR map key type %T", key)
+			}
+
+			if _, ok := m[key]; ok {
+				return nil, nil, fmt.Errorf("duplicate CBOR map key %v", key)
+			}
+
+			m[key], data, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, data, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("unsupported CBOR major type %d with additional information %d", major, info)
+}
@@ -13,9 +13,10 @@ class AuthClient {
      * @param uri {string?}
      * @param username {string}
      * @param password {string}
+     * @param email {string?}
      * @returns {Promise<void>}
      */
-    async register(uri = '/register', username, password) {
+    async register(uri = '/register', username, password, email) {
         const response = await fetch(this.serverUrl + uri, {
             method: 'POST',
             headers: {
@@ -24,8 +25,13 @@ class AuthClient {
             body: JSON.stringify({
                 username,
                 password,
+                email,
             })
         });
+        if (response.status === 202) {
+            // registered, but the email address has to be verified before login
+            return;
+        }
         if (response.status === 200) {
             const data = await response.json();
 
@@ -70,6 +76,15 @@ class AuthClient {
             this.access_token = data.access_token;
 
         }
+        if (response.status === 202) {
+            // second factor required, complete the login with loginTOTP
+            const data = await response.json();
+
+            this.username = username;
+            this.challenge_token = data.challenge_token;
+
+            return;
+        }
 
         throw new Error('Login failed ' + response.status);
     }
@@ -120,6 +135,348 @@ class AuthClient {
         throw new Error('Refresh failed ' + response.status);
     }
 
+    /**
+     *
+     * @param uri {string?}
+     * @param oldPassword {string}
+     * @param newPassword {string}
+     * @returns {Promise<void>}
+     */
+    async changePassword(uri = '/change-password', oldPassword, newPassword) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                username: this.username,
+                old_password: oldPassword,
+                new_password: newPassword,
+            })
+        });
+        if (response.status === 200) {
+            const data = await response.json();
+
+            this.refresh_token = data.refresh_token;
+            this.access_token = data.access_token;
+            return;
+        }
+
+        throw new Error('Change password failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param username {string}
+     * @returns {Promise<void>}
+     */
+    async requestPasswordReset(uri = '/request-password-reset', username) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                username,
+            })
+        });
+        if (response.status === 202) {
+            return;
+        }
+
+        throw new Error('Password reset request failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param token {string}
+     * @param password {string}
+     * @returns {Promise<void>}
+     */
+    async completePasswordReset(uri = '/complete-password-reset', token, password) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                token,
+                password,
+            })
+        });
+        if (response.status === 200) {
+            return;
+        }
+
+        throw new Error('Password reset failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param token {string}
+     * @returns {Promise<void>}
+     */
+    async verifyEmail(uri = '/verify-email', token) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                token,
+            })
+        });
+        if (response.status === 200) {
+            return;
+        }
+
+        throw new Error('Email verification failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param code {string} code from the authenticator or a recovery code
+     * @returns {Promise<void>}
+     */
+    async loginTOTP(uri = '/login-totp', code) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                challenge_token: this.challenge_token,
+                code,
+            })
+        });
+        this.challenge_token = null;
+        if (response.status === 200) {
+            const data = await response.json();
+
+            this.authenticated = true;
+
+            this.refresh_token = data.refresh_token;
+            this.access_token = data.access_token;
+            return;
+        }
+
+        throw new Error('Login failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param password {string}
+     * @returns {Promise<{secret: string, uri: string}>}
+     */
+    async enrollTOTP(uri = '/enroll-totp', password) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                username: this.username,
+                password,
+            })
+        });
+        if (response.status === 200) {
+            return await response.json();
+        }
+
+        throw new Error('TOTP enrollment failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param code {string}
+     * @returns {Promise<string[]>} recovery codes
+     */
+    async confirmTOTP(uri = '/confirm-totp', code) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                username: this.username,
+                code,
+            })
+        });
+        if (response.status === 200) {
+            const data = await response.json();
+            return data.recovery_codes;
+        }
+
+        throw new Error('TOTP confirmation failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param password {string}
+     * @param code {string}
+     * @returns {Promise<void>}
+     */
+    async disableTOTP(uri = '/disable-totp', password, code) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                username: this.username,
+                password,
+                code,
+            })
+        });
+        if (response.status === 200) {
+            return;
+        }
+
+        throw new Error('Disabling TOTP failed ' + response.status);
+    }
+
+    /**
+     * Registers a passkey of the user, using the WebAuthn API of the browser.
+     *
+     * @param beginUri {string?}
+     * @param finishUri {string?}
+     * @param password {string}
+     * @returns {Promise<void>}
+     */
+    async registerPasskey(beginUri = '/begin-webauthn-registration', finishUri = '/finish-webauthn-registration', password) {
+        const response = await fetch(this.serverUrl + beginUri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                username: this.username,
+                password,
+            })
+        });
+        if (response.status !== 200) {
+            throw new Error('Passkey registration failed ' + response.status);
+        }
+
+        const options = PublicKeyCredential.parseCreationOptionsFromJSON(await response.json());
+        const credential = await navigator.credentials.create({publicKey: options});
+
+        const finish = await fetch(this.serverUrl + finishUri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(credential.toJSON())
+        });
+        if (finish.status === 200) {
+            return;
+        }
+
+        throw new Error('Passkey registration failed ' + finish.status);
+    }
+
+    /**
+     * Logs in with a passkey, using the WebAuthn API of the browser.
+     *
+     * @param beginUri {string?}
+     * @param finishUri {string?}
+     * @param username {string}
+     * @returns {Promise<void>}
+     */
+    async loginPasskey(beginUri = '/begin-webauthn-login', finishUri = '/finish-webauthn-login', username) {
+        const response = await fetch(this.serverUrl + beginUri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                username,
+            })
+        });
+        if (response.status !== 200) {
+            throw new Error('Login failed ' + response.status);
+        }
+
+        const options = PublicKeyCredential.parseRequestOptionsFromJSON(await response.json());
+        const assertion = await navigator.credentials.get({publicKey: options});
+
+        const finish = await fetch(this.serverUrl + finishUri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(assertion.toJSON())
+        });
+        if (finish.status === 200) {
+            const data = await finish.json();
+
+            this.username = username;
+            this.authenticated = true;
+
+            this.refresh_token = data.refresh_token;
+            this.access_token = data.access_token;
+            return;
+        }
+
+        throw new Error('Login failed ' + finish.status);
+    }
+
+    /**
+     * Lists the sessions of the user, the session of this client has current set.
+     * @param uri {string?}
+     * @returns {Promise<{id: string, created_at: string, last_used_at: string, expires_at: string?, ip: string, user_agent: string, current: boolean}[]>}
+     */
+    async listSessions(uri = '/list-sessions') {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                username: this.username,
+                refresh_token: this.refresh_token,
+            })
+        });
+        if (response.status === 200) {
+            const data = await response.json();
+            return data.sessions;
+        }
+
+        throw new Error('Listing sessions failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param sessionId {string}
+     * @returns {Promise<void>}
+     */
+    async revokeSession(uri = '/revoke-session', sessionId) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                username: this.username,
+                refresh_token: this.refresh_token,
+                session_id: sessionId,
+            })
+        });
+        if (response.status === 200) {
+            return;
+        }
+
+        throw new Error('Revoking session failed ' + response.status);
+    }
+
 
     // admin only - user management
 
@@ -191,4 +548,94 @@ class AuthClient {
         throw new Error('Unblacklist failed ' + response.status);
     }
 
-}
\ No newline at end of file
+    /**
+     *
+     * @param uri {string?}
+     * @param username {string}
+     * @returns {Promise<void>}
+     */
+    async logoutAll(uri = '/logout-all', username) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({
+                username,
+            })
+        });
+        if (response.status === 200) {
+            return;
+        }
+        throw new Error('Logout all failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param username {string}
+     * @param password {string}
+     * @returns {Promise<void>}
+     */
+    async resetPassword(uri = '/reset-password', username, password) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({
+                username,
+                password,
+            })
+        });
+        if (response.status === 200) {
+            return;
+        }
+        throw new Error('Reset password failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param username {string}
+     * @returns {Promise<void>}
+     */
+    async resetTOTP(uri = '/reset-totp', username) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({
+                username,
+            })
+        });
+        if (response.status === 200) {
+            return;
+        }
+        throw new Error('Reset TOTP failed ' + response.status);
+    }
+
+    /**
+     *
+     * @param uri {string?}
+     * @param username {string}
+     * @returns {Promise<void>}
+     */
+    async clearLockout(uri = '/clear-lockout', username) {
+        const response = await fetch(this.serverUrl + uri, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({
+                username,
+            })
+        });
+        if (response.status === 200) {
+            return;
+        }
+        throw new Error('Clear lockout failed ' + response.status);
+    }
+
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms (RFC 9053) supported for WebAuthn credentials.
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// COSE key types and labels (RFC 9052, RFC 9053, RFC 8230).
+const (
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+
+	coseLabelKty = 1
+	coseLabelAlg = 3
+	coseLabelCrv = -1 // n for RSA keys
+	coseLabelX   = -2 // e for RSA keys
+	coseLabelY   = -3
+)
+
+// coseKey is a public key of a WebAuthn credential with its signature algorithm.
+type coseKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// parseCOSEKey parses a COSE_Key of a supported algorithm, and returns the remaining bytes.
+func parseCOSEKey(data []byte) (*coseKey, []byte, error) {
+	v, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding COSE key: %w", err)
+	}
+
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errors.New("COSE key is not a map")
+	}
+
+	kty, _ := m[int64(coseLabelKty)].(int64)
+	alg, _ := m[int64(coseLabelAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == coseAlgES256:
+		crv, _ := m[int64(coseLabelCrv)].(int64)
+		x, _ := m[int64(coseLabelX)].([]byte)
+		y, _ := m[int64(coseLabelY)].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, nil, errors.New("invalid ES256 key")
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, nil, errors.New("invalid ES256 key: point not on curve")
+		}
+		return &coseKey{alg: alg, key: key}, rest, nil
+
+	case kty == coseKtyOKP && alg == coseAlgEdDSA:
+		crv, _ := m[int64(coseLabelCrv)].(int64)
+		x, _ := m[int64(coseLabelX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, nil, errors.New("invalid EdDSA key")
+		}
+		return &coseKey{alg: alg, key: ed25519.PublicKey(x)}, rest, nil
+
+	case kty == coseKtyRSA && alg == coseAlgRS256:
+		n, _ := m[int64(coseLabelCrv)].([]byte)
+		e, _ := m[int64(coseLabelX)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, nil, errors.New("invalid RS256 key")
+		}
+
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 || key.E < 3 {
+			return nil, nil, errors.New("invalid RS256 key: weak parameters")
+		}
+		return &coseKey{alg: alg, key: key}, rest, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported COSE key type %d with algorithm %d", kty, alg)
+}
+
+// verify verifies the signature of data.
+func (k *coseKey) verify(data []byte, signature []byte) error {
+	switch k.alg {
+	case coseAlgES256:
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(k.key.(*ecdsa.PublicKey), digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case coseAlgEdDSA:
+		if !ed25519.Verify(k.key.(ed25519.PublicKey), data, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case coseAlgRS256:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(k.key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature)
+	}
+	return fmt.Errorf("unsupported COSE algorithm %d", k.alg)
+}
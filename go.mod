@@ -5,4 +5,8 @@ go 1.18
 require (
 	github.com/golang-jwt/jwt/v5 v5.0.0
 	github.com/google/uuid v1.3.0
+	golang.org/x/crypto v0.33.0
+	golang.org/x/text v0.22.0
 )
+
+require golang.org/x/sys v0.30.0 // indirect
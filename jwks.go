@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+// Only signature verification keys are supported: RSA, EC (P-256, P-384, P-521) and OKP (Ed25519).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// JWK returns the key in JSON Web Key format.
+// Symmetric (HMAC) keys are secret and can not be exported.
+func (k *VerificationKey) JWK() (JWK, error) {
+	jwk := JWK{
+		KeyID:     k.id,
+		Use:       "sig",
+		Algorithm: k.method.Alg(),
+	}
+
+	switch pk := k.key.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = b64.EncodeToString(pk.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(pk.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pk.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = pk.Curve.Params().Name
+		jwk.X = b64.EncodeToString(pk.X.FillBytes(make([]byte, size)))
+		jwk.Y = b64.EncodeToString(pk.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = b64.EncodeToString(pk)
+	default:
+		return JWK{}, fmt.Errorf("key type %T can not be published", k.key)
+	}
+
+	return jwk, nil
+}
+
+// VerificationKey converts the JWK into a verification key.
+func (j JWK) VerificationKey() (*VerificationKey, error) {
+	var public interface{}
+
+	switch j.KeyType {
+	case "RSA":
+		n, err := b64.DecodeString(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := b64.DecodeString(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exp.IsInt64() || exp.Int64() < 2 || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", j.Curve)
+		}
+		x, err := b64.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := b64.DecodeString(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		pk := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pk.X, pk.Y) {
+			return nil, errors.New("invalid EC key: point is not on curve")
+		}
+		public = pk
+	case "OKP":
+		if j.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", j.Curve)
+		}
+		x, err := b64.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		public = ed25519.PublicKey(x)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", j.KeyType)
+	}
+
+	key, err := NewVerificationKey(public)
+	if err != nil {
+		return nil, err
+	}
+
+	if j.Algorithm != "" && j.Algorithm != key.method.Alg() {
+		return nil, fmt.Errorf("algorithm %s does not match key type %s", j.Algorithm, j.KeyType)
+	}
+
+	if j.KeyID != "" {
+		key.id = j.KeyID
+	}
+
+	return key, nil
+}
+
+// ParseJWKS parses a JSON Web Key Set. Keys not meant for signatures are skipped.
+func ParseJWKS(data []byte) ([]*VerificationKey, error) {
+	set := &JWKS{}
+	err := json.Unmarshal(data, set)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling key set: %w", err)
+	}
+
+	keys := make([]*VerificationKey, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.VerificationKey()
+		if err != nil {
+			return nil, fmt.Errorf("error loading key %q: %w", jwk.KeyID, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint of a public key.
+// It is used as the default key ID of asymmetric keys.
+func thumbprint(k *VerificationKey) string {
+	jwk, err := k.JWK()
+	if err != nil {
+		return ""
+	}
+
+	// members must be in lexicographic order, without whitespace
+	var data string
+	switch jwk.KeyType {
+	case "RSA":
+		data = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		data = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Curve, jwk.X, jwk.Y)
+	case "OKP":
+		data = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, jwk.Curve, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(data))
+	return b64.EncodeToString(sum[:])
+}
@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const JWKS_FILE = ".local/test_jwks.json"
+
+func TestJWK_RoundTrip(t *testing.T) {
+	for alg, private := range generateTestKeys(t) {
+		key, err := NewSigningKey(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jwk, err := key.VerificationKey().JWK()
+		if err != nil {
+			t.Fatalf("%s: error exporting key: %v", alg, err)
+		}
+
+		if jwk.KeyID != key.ID() || jwk.Algorithm != alg {
+			t.Errorf("%s: unexpected kid %q or alg %q", alg, jwk.KeyID, jwk.Algorithm)
+		}
+
+		public, err := jwk.VerificationKey()
+		if err != nil {
+			t.Fatalf("%s: error importing key: %v", alg, err)
+		}
+
+		if public.ID() != key.ID() {
+			t.Errorf("%s: key ID changed from %q to %q", alg, key.ID(), public.ID())
+		}
+	}
+}
+
+func TestJWK_Thumbprint(t *testing.T) {
+	// example from RFC 7638, section 3.1
+	jwk := JWK{
+		KeyType: "RSA",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMs" +
+			"tn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5ha" +
+			"jrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E: "AQAB",
+	}
+
+	key, err := jwk.VerificationKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.ID() != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("unexpected thumbprint %s", key.ID())
+	}
+}
+
+func TestJWKS_HMACNotPublished(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	if len(users.JWKS().Keys) != 0 {
+		t.Error("HMAC secret published")
+	}
+}
+
+func TestMiddleware_JWKSFromURL(t *testing.T) {
+	keys := generateTestKeys(t)
+
+	key, err := NewSigningKey(keys["ES256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewRegistryWithKey(newMockStorage(), key)
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(users.JWKS())
+	}))
+	defer srv.Close()
+
+	m, err := NewMiddlewareFromJWKS(srv.URL)
+	if err != nil {
+		t.Fatalf("error loading key set: %v", err)
+	}
+
+	token, _, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	if code := serveWithToken(m, token); code != http.StatusOK {
+		t.Errorf("token rejected, status %d", code)
+	}
+
+	// the authentication server switches to a new key, middleware picks it up by kid
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := NewSigningKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = users.keys.Rotate(next, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	m.keys.(*JWKSKeySource).MinRefreshInterval = 0
+
+	if code := serveWithToken(m, token); code != http.StatusOK {
+		t.Errorf("token signed with new key rejected, status %d", code)
+	}
+}
+
+func TestMiddleware_JWKSFromFile(t *testing.T) {
+	keys := generateTestKeys(t)
+
+	key, err := NewSigningKey(keys["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewRegistryWithKey(newMockStorage(), key)
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	data, err := json.Marshal(users.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(JWKS_FILE, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMiddlewareFromJWKS(JWKS_FILE)
+	if err != nil {
+		t.Fatalf("error loading key set: %v", err)
+	}
+
+	token, _, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	if code := serveWithToken(m, token); code != http.StatusOK {
+		t.Errorf("token rejected, status %d", code)
+	}
+
+	// unknown kid is rejected, and the key set is not reloaded too often
+	other, err := NewSigningKey(keys["RS256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = users.keys.Rotate(other, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	source := m.keys.(*JWKSKeySource)
+	loaded := source.loaded
+
+	if code := serveWithToken(m, token); code != http.StatusUnauthorized {
+		t.Error("token with unknown key accepted")
+	}
+
+	if source.loaded != loaded {
+		t.Error("key set reloaded before MinRefreshInterval")
+	}
+
+	source.loaded = time.Now().Add(-DefaultJWKSMaxAge - time.Second)
+	serveWithToken(m, token)
+
+	if !source.loaded.After(loaded) {
+		t.Error("key set not reloaded after MaxAge")
+	}
+}
+
+func TestJWKSKeySource_ReloadFailure(t *testing.T) {
+	keys := generateTestKeys(t)
+
+	key, err := NewSigningKey(keys["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(NewRegistryWithKey(newMockStorage(), key).JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := false
+	loads := 0
+
+	source, err := newJWKSKeySource(func() ([]byte, error) {
+		loads++
+		if failing {
+			return nil, errors.New("unavailable")
+		}
+		return data, nil
+	})
+	if err != nil {
+		t.Fatalf("error loading key set: %v", err)
+	}
+
+	// the key set is outdated, and can not be reloaded
+	failing = true
+	source.loaded = time.Now().Add(-DefaultJWKSMaxAge - time.Second)
+
+	for i := 0; i < 3; i++ {
+		k, err := source.VerificationKey(key.ID())
+		if err != nil || k == nil {
+			t.Fatalf("last loaded key not used: %v", err)
+		}
+	}
+
+	if loads != 2 {
+		t.Errorf("failed reload not backed off, %d loads", loads)
+	}
+
+	if source.failures != 1 || !source.retryAt.After(time.Now().Add(DefaultJWKSMinRefreshInterval-time.Second)) {
+		t.Errorf("unexpected backoff: %d failures, retry at %v", source.failures, source.retryAt)
+	}
+
+	// the retry fails again, and waits twice as long
+	source.retryAt = time.Now()
+	source.VerificationKey(key.ID())
+
+	if source.failures != 2 || !source.retryAt.After(time.Now().Add(2*DefaultJWKSMinRefreshInterval-time.Second)) {
+		t.Errorf("unexpected backoff: %d failures, retry at %v", source.failures, source.retryAt)
+	}
+
+	failing = false
+	source.retryAt = time.Now()
+	source.VerificationKey(key.ID())
+
+	if source.failures != 0 || time.Since(source.loaded) > time.Second {
+		t.Error("key set not reloaded after recovery")
+	}
+}
+
+func TestJWKSKeySource_SlowReload(t *testing.T) {
+	keys := generateTestKeys(t)
+
+	key, err := NewSigningKey(keys["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(NewRegistryWithKey(newMockStorage(), key).JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	blocking := false
+
+	source, err := newJWKSKeySource(func() ([]byte, error) {
+		if blocking {
+			entered <- struct{}{}
+			<-release
+		}
+		return data, nil
+	})
+	if err != nil {
+		t.Fatalf("error loading key set: %v", err)
+	}
+
+	blocking = true
+	source.loaded = time.Now().Add(-DefaultJWKSMaxAge - time.Second)
+
+	reloaded := make(chan *VerificationKey)
+	go func() {
+		k, _ := source.VerificationKey(key.ID())
+		reloaded <- k
+	}()
+	<-entered
+
+	// the reload is running, other requests use the loaded keys without waiting for it
+	done := make(chan *VerificationKey)
+	go func() {
+		k, _ := source.VerificationKey(key.ID())
+		done <- k
+	}()
+
+	select {
+	case k := <-done:
+		if k == nil {
+			t.Error("loaded key not used during reload")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request blocked by the reload")
+	}
+
+	close(release)
+	if k := <-reloaded; k == nil {
+		t.Error("key not found after reload")
+	}
+}
+
+func TestJWKSKeySource_LargeResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"keys":[`))
+		writer.Write(make([]byte, maxFetchSize))
+	}))
+	defer srv.Close()
+
+	if _, err := NewJWKSURL(srv.URL, nil); err == nil {
+		t.Error("key set larger than maxFetchSize loaded")
+	}
+}
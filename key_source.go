@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeySource provides the keys Middleware uses to verify access tokens.
+type KeySource interface {
+	// VerificationKey returns the key matching the "kid" header of a token,
+	// or nil if there is no such key. kid is empty if the token has no "kid" header.
+	VerificationKey(kid string) (*VerificationKey, error)
+}
+
+// StaticKeys is a fixed set of verification keys.
+type StaticKeys []*VerificationKey
+
+// VerificationKey returns the key with the given ID. If the set consists of a single key,
+// tokens without "kid" header and keys without ID match it too.
+func (s StaticKeys) VerificationKey(kid string) (*VerificationKey, error) {
+	for _, k := range s {
+		if k.id == kid {
+			return k, nil
+		}
+	}
+
+	if len(s) == 1 && (kid == "" || s[0].id == "") {
+		return s[0], nil
+	}
+
+	return nil, nil
+}
+
+const (
+	// DefaultJWKSMaxAge is how long JWKSKeySource uses the loaded keys before reloading them.
+	DefaultJWKSMaxAge = 10 * time.Minute
+	// DefaultJWKSMinRefreshInterval is how often JWKSKeySource may reload the keys when
+	// it sees an unknown key ID.
+	DefaultJWKSMinRefreshInterval = 30 * time.Second
+
+	// fetchTimeout is the timeout of the client fetching key sets and revocation lists, if none is given.
+	fetchTimeout = 10 * time.Second
+	// maxFetchSize limits the size of fetched key sets and revocation lists.
+	maxFetchSize = 8 << 20
+)
+
+// JWKSKeySource loads verification keys from a JSON Web Key Set, published by the authentication
+// server (see server.JWKSHandler) or stored in a file.
+// The keys are reloaded when they get older than MaxAge, or when a token with an unknown key ID
+// arrives (but not more often than MinRefreshInterval), so new keys are picked up without a restart.
+// If a reload fails, the last loaded keys stay in use, so an outage of the key set does not reject
+// all tokens. Failed reloads are retried after MinRefreshInterval, doubling up to MaxAge.
+// Only one request reloads the keys at a time, the others keep using the loaded keys meanwhile.
+type JWKSKeySource struct {
+	MaxAge             time.Duration
+	MinRefreshInterval time.Duration
+
+	load func() ([]byte, error)
+
+	m      sync.Mutex
+	keys   StaticKeys
+	loaded time.Time
+
+	// loading is set while a reload is running
+	loading bool
+	// failures counts the reloads failed since the last successful one, retryAt is the time of the next attempt
+	failures int
+	retryAt  time.Time
+}
+
+// NewJWKSFile creates a key source that reads the key set from a file.
+func NewJWKSFile(path string) (*JWKSKeySource, error) {
+	return newJWKSKeySource(fileLoader(path))
+}
+
+// NewJWKSURL creates a key source that fetches the key set from a URL.
+// If client is nil, a client with a timeout of 10 seconds is used.
+func NewJWKSURL(url string, client *http.Client) (*JWKSKeySource, error) {
+	return newJWKSKeySource(urlLoader(url, client))
+}
+
+func newJWKSKeySource(load func() ([]byte, error)) (*JWKSKeySource, error) {
+	s := &JWKSKeySource{
+		MaxAge:             DefaultJWKSMaxAge,
+		MinRefreshInterval: DefaultJWKSMinRefreshInterval,
+		load:               load,
+	}
+
+	err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// VerificationKey returns the key with the given ID, reloading the key set if needed.
+func (s *JWKSKeySource) VerificationKey(kid string) (*VerificationKey, error) {
+	s.m.Lock()
+	keys, loaded := s.keys, s.loaded
+	s.m.Unlock()
+
+	if time.Since(loaded) > s.MaxAge {
+		if reloaded, ok := s.retry(); ok {
+			keys, loaded = reloaded, time.Now()
+		}
+	}
+
+	key, _ := keys.VerificationKey(kid)
+	if key != nil || time.Since(loaded) < s.MinRefreshInterval {
+		return key, nil
+	}
+
+	if reloaded, ok := s.retry(); ok {
+		return reloaded.VerificationKey(kid)
+	}
+
+	return nil, nil
+}
+
+// retry reloads the key set, unless another reload is running or a failed reload is backing off.
+// It returns the keys and true if they were reloaded. The keys are loaded without holding the lock,
+// so a slow key set does not block requests using the loaded keys.
+func (s *JWKSKeySource) retry() (StaticKeys, bool) {
+	s.m.Lock()
+	if s.loading || time.Now().Before(s.retryAt) {
+		s.m.Unlock()
+		return nil, false
+	}
+	s.loading = true
+	s.m.Unlock()
+
+	keys, err := s.fetch()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.loading = false
+
+	if err != nil {
+		s.retryAt = time.Now().Add(retryBackoff(s.MinRefreshInterval, s.MaxAge, s.failures))
+		s.failures++
+		return nil, false
+	}
+
+	s.keys = keys
+	s.loaded = time.Now()
+	s.failures = 0
+	s.retryAt = time.Time{}
+
+	return keys, true
+}
+
+// refresh reloads the key set before the source is shared.
+func (s *JWKSKeySource) refresh() error {
+	keys, err := s.fetch()
+	if err != nil {
+		return err
+	}
+
+	s.keys = keys
+	s.loaded = time.Now()
+
+	return nil
+}
+
+// fetch loads and parses the key set.
+func (s *JWKSKeySource) fetch() (StaticKeys, error) {
+	data, err := s.load()
+	if err != nil {
+		return nil, fmt.Errorf("error loading key set: %w", err)
+	}
+
+	return ParseJWKS(data)
+}
+
+// retryBackoff returns the time to wait before retrying after the given number of failed reloads:
+// base, doubling after every failure up to max.
+func retryBackoff(base time.Duration, max time.Duration, failures int) time.Duration {
+	backoff := base
+	for i := 0; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+
+	return backoff
+}
+
+// fileLoader returns a function reading the file.
+func fileLoader(path string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return os.ReadFile(path)
+	}
+}
+
+// urlLoader returns a function fetching the URL. If client is nil, a client with fetchTimeout is used.
+// Responses larger than maxFetchSize are rejected.
+func urlLoader(url string, client *http.Client) func() ([]byte, error) {
+	if client == nil {
+		client = &http.Client{Timeout: fetchTimeout}
+	}
+
+	return func() ([]byte, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchSize+1))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(data) > maxFetchSize {
+			return nil, fmt.Errorf("response larger than %d bytes", maxFetchSize)
+		}
+
+		return data, nil
+	}
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KeyRing holds the signing keys of a Registry. One key is active and signs new tokens,
+// the other keys are only used to verify tokens until they are retired. Every token
+// is stamped with the ID of its key in the "kid" header.
+//
+// Rotating a key without logging out users works like this:
+//  1. Add the new key. It is published (see Registry.JWKS), but not used yet.
+//  2. Wait until every Middleware has picked up the new key.
+//  3. Activate the new key, or Rotate to it with an overlap of at least the access token lifetime,
+//     so tokens signed with the old key stay valid until they expire.
+//  4. Retire the old key, unless Rotate scheduled it already.
+//
+// KeyRing is safe for concurrent use, so keys can be rotated while the Registry is serving requests.
+type KeyRing struct {
+	m        sync.RWMutex
+	keys     []*SigningKey
+	active   *SigningKey
+	retireAt map[string]time.Time
+}
+
+// NewKeyRing creates a key ring with the active signing key.
+func NewKeyRing(active *SigningKey) *KeyRing {
+	return &KeyRing{
+		keys:     []*SigningKey{active},
+		active:   active,
+		retireAt: make(map[string]time.Time),
+	}
+}
+
+// Add adds a key to the ring without activating it.
+// Keys must have unique IDs; set one with WithID for HMAC keys.
+func (r *KeyRing) Add(key *SigningKey) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.add(key)
+}
+
+// add adds the key. Must be called with the write lock held.
+func (r *KeyRing) add(key *SigningKey) error {
+	r.prune()
+
+	if key.id == "" {
+		return errors.New("key ID required")
+	}
+
+	for _, k := range r.keys {
+		if k.id == key.id {
+			return fmt.Errorf("key %s already exists", key.id)
+		}
+	}
+
+	r.keys = append(r.keys, key)
+	return nil
+}
+
+// Activate makes the key with the given ID the active signing key.
+// The previously active key stays in the ring.
+func (r *KeyRing) Activate(id string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.activate(id)
+}
+
+// activate activates the key. Must be called with the write lock held.
+func (r *KeyRing) activate(id string) error {
+	r.prune()
+
+	for _, k := range r.keys {
+		if k.id == id {
+			r.active = k
+			delete(r.retireAt, id)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("key %s not found", id)
+}
+
+// Rotate adds the key, activates it and schedules the previously active key to be retired
+// after overlap. overlap should be at least the access token lifetime.
+// The rotation is atomic, concurrent operations see the ring either before or after it.
+func (r *KeyRing) Rotate(key *SigningKey, overlap time.Duration) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	previous := r.active.id
+
+	err := r.add(key)
+	if err != nil {
+		return err
+	}
+
+	err = r.activate(key.id)
+	if err != nil {
+		return err
+	}
+
+	return r.scheduleRetirement(previous, time.Now().Add(overlap))
+}
+
+// Retire removes the key with the given ID from the ring. Tokens signed with it are no longer accepted.
+// The active key can not be retired.
+func (r *KeyRing) Retire(id string) error {
+	return r.RetireAt(id, time.Now())
+}
+
+// RetireAt schedules the key with the given ID to be removed from the ring at the given time.
+func (r *KeyRing) RetireAt(id string, at time.Time) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.scheduleRetirement(id, at)
+}
+
+// scheduleRetirement schedules the key to be retired. Must be called with the write lock held.
+func (r *KeyRing) scheduleRetirement(id string, at time.Time) error {
+	if r.active.id == id {
+		return errors.New("active key can not be retired")
+	}
+
+	for _, k := range r.keys {
+		if k.id == id {
+			r.retireAt[id] = at
+			r.prune()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("key %s not found", id)
+}
+
+// Active returns the key used to sign new tokens.
+func (r *KeyRing) Active() *SigningKey {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.active
+}
+
+// VerificationKeys returns the verification keys of all keys that are not retired.
+func (r *KeyRing) VerificationKeys() []*VerificationKey {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	now := time.Now()
+	result := make([]*VerificationKey, 0, len(r.keys))
+	for _, k := range r.keys {
+		if r.retired(k.id, now) {
+			continue
+		}
+		result = append(result, k.VerificationKey())
+	}
+
+	return result
+}
+
+// VerificationKey implements KeySource, so a Middleware running in the same process as the
+// Registry can use the key ring directly.
+func (r *KeyRing) VerificationKey(kid string) (*VerificationKey, error) {
+	return StaticKeys(r.VerificationKeys()).VerificationKey(kid)
+}
+
+func (r *KeyRing) retired(id string, now time.Time) bool {
+	at, ok := r.retireAt[id]
+	return ok && !now.Before(at)
+}
+
+// prune removes retired keys. Must be called with the write lock held.
+func (r *KeyRing) prune() {
+	now := time.Now()
+	keys := r.keys[:0]
+	for _, k := range r.keys {
+		if r.retired(k.id, now) {
+			delete(r.retireAt, k.id)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	r.keys = keys
+}
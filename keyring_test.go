@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func loginToken(t *testing.T, users *Registry) string {
+	token, _, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+	return token
+}
+
+func tokenKeyID(t *testing.T, token string) string {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestKeyRing_Rotate(t *testing.T) {
+	ring := NewKeyRing(NewHMACKey("secret1").WithID("k1"))
+
+	users := NewRegistryWithKeyRing(newMockStorage(), ring)
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	m := NewMiddlewareWithKeySource(ring)
+
+	oldToken := loginToken(t, users)
+	if kid := tokenKeyID(t, oldToken); kid != "k1" {
+		t.Errorf("expected kid k1, got %q", kid)
+	}
+
+	err := ring.Rotate(NewHMACKey("secret2").WithID("k2"), time.Hour)
+	if err != nil {
+		t.Fatalf("rotation failed: %v", err)
+	}
+
+	newToken := loginToken(t, users)
+	if kid := tokenKeyID(t, newToken); kid != "k2" {
+		t.Errorf("expected kid k2, got %q", kid)
+	}
+
+	if code := serveWithToken(m, oldToken); code != http.StatusOK {
+		t.Error("token signed with previous key rejected during overlap")
+	}
+
+	if code := serveWithToken(m, newToken); code != http.StatusOK {
+		t.Error("token signed with active key rejected")
+	}
+
+	err = ring.Retire("k1")
+	if err != nil {
+		t.Fatalf("retire failed: %v", err)
+	}
+
+	if code := serveWithToken(m, oldToken); code != http.StatusUnauthorized {
+		t.Error("token signed with retired key accepted")
+	}
+
+	if code := serveWithToken(m, newToken); code != http.StatusOK {
+		t.Error("token signed with active key rejected after retirement")
+	}
+}
+
+func TestKeyRing_OverlapExpires(t *testing.T) {
+	ring := NewKeyRing(NewHMACKey("secret1").WithID("k1"))
+
+	err := ring.Rotate(NewHMACKey("secret2").WithID("k2"), -time.Second)
+	if err != nil {
+		t.Fatalf("rotation failed: %v", err)
+	}
+
+	if len(ring.VerificationKeys()) != 1 {
+		t.Error("previous key not retired after overlap")
+	}
+}
+
+func TestKeyRing_StaticKeys(t *testing.T) {
+	k1 := NewHMACKey("secret1").WithID("k1")
+	k2 := NewHMACKey("secret2").WithID("k2")
+
+	ring := NewKeyRing(k1)
+	users := NewRegistryWithKeyRing(newMockStorage(), ring)
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	token1 := loginToken(t, users)
+
+	ring.Add(k2)
+	ring.Activate("k2")
+
+	token2 := loginToken(t, users)
+
+	m := NewMiddlewareWithKeys([]*VerificationKey{k1.VerificationKey(), k2.VerificationKey()})
+
+	if serveWithToken(m, token1) != http.StatusOK || serveWithToken(m, token2) != http.StatusOK {
+		t.Error("token rejected by middleware knowing both keys")
+	}
+
+	m = NewMiddlewareWithKeys([]*VerificationKey{k2.VerificationKey()})
+
+	if serveWithToken(m, token1) != http.StatusUnauthorized {
+		t.Error("token signed with unknown key accepted")
+	}
+}
+
+func TestKeyRing_Errors(t *testing.T) {
+	ring := NewKeyRing(NewHMACKey("secret1").WithID("k1"))
+
+	if ring.Add(NewHMACKey("secret2")) == nil {
+		t.Error("key without ID added")
+	}
+
+	if ring.Add(NewHMACKey("secret2").WithID("k1")) == nil {
+		t.Error("duplicate key ID added")
+	}
+
+	if ring.Retire("k1") == nil {
+		t.Error("active key retired")
+	}
+
+	if ring.Activate("unknown") == nil {
+		t.Error("unknown key activated")
+	}
+}
+
+func TestKeyRing_ConcurrentRotate(t *testing.T) {
+	ring := NewKeyRing(NewHMACKey("secret0").WithID("k0"))
+
+	const rotations = 32
+
+	wg := sync.WaitGroup{}
+	start := make(chan struct{})
+	for i := 1; i <= rotations; i++ {
+		key := NewHMACKey(fmt.Sprintf("secret%d", i)).WithID(fmt.Sprintf("k%d", i))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			err := ring.Rotate(key, time.Hour)
+			if err != nil {
+				t.Errorf("rotation failed: %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	// every previously active key is scheduled for retirement, none is left behind
+	ring.m.RLock()
+	defer ring.m.RUnlock()
+
+	if len(ring.keys) != rotations+1 || len(ring.retireAt) != rotations {
+		t.Errorf("expected %d keys scheduled for retirement, got %d of %d", rotations, len(ring.retireAt), len(ring.keys))
+	}
+
+	if _, ok := ring.retireAt[ring.active.id]; ok {
+		t.Error("active key scheduled for retirement")
+	}
+}
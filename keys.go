@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is a key used by Registry to sign access tokens.
+// It is either a shared HMAC secret or a private key (RSA, ECDSA or Ed25519).
+// Private keys should only ever be held by the authentication server.
+type SigningKey struct {
+	id     string
+	method jwt.SigningMethod
+	key    interface{} // key passed to method.Sign
+	public interface{} // key passed to method.Verify
+}
+
+// VerificationKey is a key used by Middleware to verify access tokens.
+// It is either a shared HMAC secret or a public key (RSA, ECDSA or Ed25519).
+// A VerificationKey built from a public key can not be used to issue tokens.
+type VerificationKey struct {
+	id     string
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+// NewHMACKey creates a HS256 signing key from a shared secret.
+// The same secret must be used by Middleware (see NewMiddleware).
+func NewHMACKey(secret string) *SigningKey {
+	return &SigningKey{
+		method: jwt.SigningMethodHS256,
+		key:    []byte(secret),
+		public: []byte(secret),
+	}
+}
+
+// NewSigningKey creates a signing key from a private key.
+// Supported keys are *rsa.PrivateKey (RS256), *ecdsa.PrivateKey (ES256, ES384 or ES512 depending
+// on the curve) and ed25519.PrivateKey (EdDSA).
+func NewSigningKey(private crypto.Signer) (*SigningKey, error) {
+	method, err := signingMethodFor(private.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{
+		method: method,
+		key:    private,
+		public: private.Public(),
+	}
+	key.id = thumbprint(key.VerificationKey())
+
+	return key, nil
+}
+
+// NewVerificationKey creates a verification key from a public key.
+// Supported keys are *rsa.PublicKey, *ecdsa.PublicKey and ed25519.PublicKey.
+func NewVerificationKey(public crypto.PublicKey) (*VerificationKey, error) {
+	method, err := signingMethodFor(public)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &VerificationKey{
+		method: method,
+		key:    public,
+	}
+	key.id = thumbprint(key)
+
+	return key, nil
+}
+
+// ParseSigningKeyPEM parses a PEM encoded private key (PKCS#1, PKCS#8 or SEC 1) into a signing key.
+func ParseSigningKeyPEM(data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var private interface{}
+	var err error
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %s", block.Type)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key: %w", err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type: %T", private)
+	}
+
+	return NewSigningKey(signer)
+}
+
+// ParseVerificationKeyPEM parses a PEM encoded public key (PKIX or PKCS#1) into a verification key.
+func ParseVerificationKeyPEM(data []byte) (*VerificationKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var public interface{}
+	var err error
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %s", block.Type)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key: %w", err)
+	}
+
+	return NewVerificationKey(public)
+}
+
+// ID returns the key ID, which is sent in the "kid" header of signed tokens.
+// Asymmetric keys default to the RFC 7638 thumbprint of the public key, HMAC keys have no ID by default.
+func (k *SigningKey) ID() string {
+	return k.id
+}
+
+// WithID sets the key ID.
+func (k *SigningKey) WithID(id string) *SigningKey {
+	k.id = id
+	return k
+}
+
+// Method returns the JWT signing method of the key.
+func (k *SigningKey) Method() jwt.SigningMethod {
+	return k.method
+}
+
+// VerificationKey returns the key that verifies tokens signed by this key.
+// For asymmetric keys it contains only the public part and is safe to share.
+func (k *SigningKey) VerificationKey() *VerificationKey {
+	return &VerificationKey{
+		id:     k.id,
+		method: k.method,
+		key:    k.public,
+	}
+}
+
+// ID returns the key ID, which is matched against the "kid" header of verified tokens.
+func (k *VerificationKey) ID() string {
+	return k.id
+}
+
+// WithID sets the key ID.
+func (k *VerificationKey) WithID(id string) *VerificationKey {
+	k.id = id
+	return k
+}
+
+// Method returns the JWT signing method of the key.
+func (k *VerificationKey) Method() jwt.SigningMethod {
+	return k.method
+}
+
+// sign signs the token with the key.
+func (k *SigningKey) sign(claims jwt.Claims) (string, error) {
+	tkn := jwt.NewWithClaims(k.method, claims)
+	if k.id != "" {
+		tkn.Header["kid"] = k.id
+	}
+	return tkn.SignedString(k.key)
+}
+
+// signingMethodFor picks the JWT signing method matching the public key.
+func signingMethodFor(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch pk := public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch pk.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported elliptic curve: %s", pk.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", public)
+}
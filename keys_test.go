@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func generateTestKeys(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]crypto.Signer{
+		"RS256": rsaKey,
+		"ES256": ecKey,
+		"EdDSA": edKey,
+	}
+}
+
+// serveWithToken runs a request with the token through the middleware and returns the status code.
+func serveWithToken(m *Middleware, token string) int {
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+
+	m.Wrap(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}), false, "user").ServeHTTP(rr, req)
+
+	return rr.Code
+}
+
+func TestSigningKey_Asymmetric(t *testing.T) {
+	for alg, private := range generateTestKeys(t) {
+		key, err := NewSigningKey(private)
+		if err != nil {
+			t.Fatalf("%s: error creating signing key: %v", alg, err)
+		}
+
+		if key.Method().Alg() != alg {
+			t.Errorf("expected %s, got %s", alg, key.Method().Alg())
+		}
+
+		users := NewRegistryWithKey(newMockStorage(), key)
+
+		err = users.Register("user1", "password1")
+		if err != nil {
+			t.Fatalf("%s: registering user failed", alg)
+		}
+
+		err = users.SetRoles("user1", "user")
+		if err != nil {
+			t.Fatalf("%s: setting roles failed", alg)
+		}
+
+		token, _, err := users.Login("user1", "password1")
+		if err != nil {
+			t.Fatalf("%s: login failed: %v", alg, err)
+		}
+
+		public, err := NewVerificationKey(private.Public())
+		if err != nil {
+			t.Fatalf("%s: error creating verification key: %v", alg, err)
+		}
+
+		if code := serveWithToken(NewMiddlewareWithKey(public), token); code != http.StatusOK {
+			t.Errorf("%s: token rejected by public key, status %d", alg, code)
+		}
+
+		if code := serveWithToken(NewMiddleware(secret), token); code != http.StatusUnauthorized {
+			t.Errorf("%s: token accepted by HMAC middleware", alg)
+		}
+	}
+}
+
+func TestSigningKey_WrongPublicKey(t *testing.T) {
+	keys := generateTestKeys(t)
+
+	key, err := NewSigningKey(keys["RS256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewRegistryWithKey(newMockStorage(), key)
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	token, _, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := NewVerificationKey(&other.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := serveWithToken(NewMiddlewareWithKey(public), token); code != http.StatusUnauthorized {
+		t.Error("token accepted with wrong public key")
+	}
+}
+
+func TestSigningKey_HMACTokenRejectedByPublicKey(t *testing.T) {
+	keys := generateTestKeys(t)
+
+	users := NewRegistry(newMockStorage(), secret)
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	token, _, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	public, err := NewVerificationKey(keys["RS256"].Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := serveWithToken(NewMiddlewareWithKey(public), token); code != http.StatusUnauthorized {
+		t.Error("HMAC token accepted by public key middleware")
+	}
+}
+
+func TestSigningKey_PEM(t *testing.T) {
+	for alg, private := range generateTestKeys(t) {
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := ParseSigningKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		if err != nil {
+			t.Fatalf("%s: error parsing private key: %v", alg, err)
+		}
+
+		if key.Method().Alg() != alg {
+			t.Errorf("expected %s, got %s", alg, key.Method().Alg())
+		}
+
+		der, err = x509.MarshalPKIXPublicKey(private.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		public, err := ParseVerificationKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		if err != nil {
+			t.Fatalf("%s: error parsing public key: %v", alg, err)
+		}
+
+		if public.Method().Alg() != alg {
+			t.Errorf("expected %s, got %s", alg, public.Method().Alg())
+		}
+	}
+
+	_, err := ParseSigningKeyPEM([]byte("not a key"))
+	if err == nil {
+		t.Error("parsing garbage succeeded")
+	}
+}
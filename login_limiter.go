@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// LoginThrottledError is returned by Login if there were too many failed logins of the user,
+// or from the IP address of the client.
+type LoginThrottledError struct {
+	// RetryAfter is the time until the next login attempt is allowed.
+	RetryAfter time.Duration
+	// Locked is set if the account is locked out, rather than just delayed.
+	Locked bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return "account locked after too many failed logins"
+	}
+	return "too many failed logins, retry later"
+}
+
+// LoginLimiter protects against guessing passwords, by delaying logins after failed attempts
+// per username and per client IP address. Every failure beyond FreeAttempts doubles the delay,
+// and after LockoutThreshold consecutive failures the account is locked for LockoutDuration.
+// Logins are refused during the delay, whether the password is correct or not.
+// A successful login resets the failures of the user, but not of the IP address.
+// Zero values disable the respective rules. LoginLimiter is safe for concurrent use.
+type LoginLimiter struct {
+	// FreeAttempts is the number of failures without a delay.
+	FreeAttempts int
+	// BaseDelay is the delay after the first failure beyond FreeAttempts.
+	BaseDelay time.Duration
+	// MaxDelay limits the delay.
+	MaxDelay time.Duration
+
+	// LockoutThreshold is the number of consecutive failures of a user, after which the account is locked.
+	// IP addresses are only delayed, since many users can share one.
+	LockoutThreshold int
+	// LockoutDuration is the time the account is locked.
+	LockoutDuration time.Duration
+
+	// ForgetAfter is the time without failures, after which earlier failures are forgotten.
+	ForgetAfter time.Duration
+
+	m     sync.Mutex
+	users map[string]*loginFailures
+	ips   map[string]*loginFailures
+}
+
+// loginFailures counts consecutive failed logins of a user or an IP address.
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// NewLoginLimiter creates a LoginLimiter which allows 3 failures, then delays logins by 1 second doubling
+// up to 15 minutes, locks accounts for 1 hour after 10 failures, and forgets failures after 24 hours.
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         15 * time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  time.Hour,
+		ForgetAfter:      24 * time.Hour,
+	}
+}
+
+// Check returns *LoginThrottledError if a login of the user from the IP address is not allowed at the given time.
+// ip can be empty if it is not known.
+func (l *LoginLimiter) Check(username string, ip string, now time.Time) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	var retryAfter time.Duration
+
+	if f, ok := l.users[username]; ok {
+		if now.Before(f.lockedUntil) {
+			return &LoginThrottledError{RetryAfter: f.lockedUntil.Sub(now), Locked: true}
+		}
+		retryAfter = l.retryAfter(f, now)
+	}
+
+	if f, ok := l.ips[ip]; ok && ip != "" {
+		if d := l.retryAfter(f, now); d > retryAfter {
+			retryAfter = d
+		}
+	}
+
+	if retryAfter > 0 {
+		return &LoginThrottledError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// Failed records a failed login of the user from the IP address.
+func (l *LoginLimiter) Failed(username string, ip string, now time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.makeMaps()
+
+	f := l.fail(l.users, username, now)
+	if l.LockoutThreshold > 0 && f.count >= l.LockoutThreshold {
+		f.lockedUntil = now.Add(l.LockoutDuration)
+	}
+
+	if ip != "" {
+		l.fail(l.ips, ip, now)
+	}
+}
+
+// Succeeded records a successful login of the user, which resets the failures of the user.
+func (l *LoginLimiter) Succeeded(username string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	delete(l.users, username)
+}
+
+// Restore restores the failures of the user, e.g. persisted in User.FailedLogins before a restart.
+// It has no effect if the limiter already counts failures of the user.
+func (l *LoginLimiter) Restore(username string, failures int, last time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if _, ok := l.users[username]; ok || failures <= 0 {
+		return
+	}
+
+	l.makeMaps()
+
+	f := &loginFailures{count: failures, last: last}
+	if l.LockoutThreshold > 0 && failures >= l.LockoutThreshold {
+		f.lockedUntil = last.Add(l.LockoutDuration)
+	}
+	l.users[username] = f
+}
+
+// Unlock clears the failures and the lockout of the user.
+func (l *LoginLimiter) Unlock(username string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	delete(l.users, username)
+}
+
+// UnlockIP clears the failures of the IP address.
+func (l *LoginLimiter) UnlockIP(ip string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	delete(l.ips, ip)
+}
+
+// Prune removes failures forgotten at the given time.
+func (l *LoginLimiter) Prune(now time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for _, failures := range []map[string]*loginFailures{l.users, l.ips} {
+		for k, f := range failures {
+			if l.forgotten(f, now) && !now.Before(f.lockedUntil) {
+				delete(failures, k)
+			}
+		}
+	}
+}
+
+// makeMaps creates the maps, which are nil if the LoginLimiter was not created with NewLoginLimiter.
+// Must be called with the lock held.
+func (l *LoginLimiter) makeMaps() {
+	if l.users == nil {
+		l.users = make(map[string]*loginFailures)
+	}
+	if l.ips == nil {
+		l.ips = make(map[string]*loginFailures)
+	}
+}
+
+// fail counts a failure. Must be called with the lock held.
+func (l *LoginLimiter) fail(failures map[string]*loginFailures, key string, now time.Time) *loginFailures {
+	f, ok := failures[key]
+	if !ok || l.forgotten(f, now) {
+		f = &loginFailures{}
+		failures[key] = f
+	}
+
+	f.count++
+	f.last = now
+
+	return f
+}
+
+// forgotten checks if the failures are old enough to be forgotten.
+func (l *LoginLimiter) forgotten(f *loginFailures, now time.Time) bool {
+	return l.ForgetAfter > 0 && now.Sub(f.last) >= l.ForgetAfter
+}
+
+// retryAfter returns the remaining delay after the failures.
+func (l *LoginLimiter) retryAfter(f *loginFailures, now time.Time) time.Duration {
+	if l.forgotten(f, now) || f.count <= l.FreeAttempts {
+		return 0
+	}
+
+	delay := l.BaseDelay
+	for i := l.FreeAttempts + 1; i < f.count && delay < math.MaxInt64/2 && (l.MaxDelay <= 0 || delay < l.MaxDelay); i++ {
+		delay *= 2
+	}
+	if l.MaxDelay > 0 && delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+
+	return f.last.Add(delay).Sub(now)
+}
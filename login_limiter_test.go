@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter_Backoff(t *testing.T) {
+	now := time.Now()
+	l := NewLoginLimiter()
+	l.LockoutThreshold = 0
+
+	for i := 0; i < l.FreeAttempts; i++ {
+		if l.Check("user1", "ip1", now) != nil {
+			t.Fatalf("attempt %d throttled", i+1)
+		}
+		l.Failed("user1", "ip1", now)
+	}
+
+	if l.Check("user1", "ip1", now) != nil {
+		t.Fatal("free attempts throttled")
+	}
+
+	// delays double: 1s, 2s, 4s, ...
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		l.Failed("user1", "ip1", now)
+
+		var throttled *LoginThrottledError
+		if err := l.Check("user1", "ip1", now); !errors.As(err, &throttled) || throttled.RetryAfter != delay || throttled.Locked {
+			t.Fatalf("failure %d: expected delay %v, got %v", i+1, delay, err)
+		}
+
+		now = now.Add(delay)
+		if err := l.Check("user1", "ip1", now); err != nil {
+			t.Fatalf("failure %d: throttled after delay: %v", i+1, err)
+		}
+	}
+
+	// the IP address is throttled for other users too
+	if l.Check("user2", "ip1", now.Add(-time.Second)) == nil {
+		t.Error("IP address not throttled")
+	}
+	if l.Check("user2", "ip2", now.Add(-time.Second)) != nil {
+		t.Error("other user throttled")
+	}
+
+	for i := 0; i < 20; i++ {
+		l.Failed("user1", "ip1", now)
+	}
+	var throttled *LoginThrottledError
+	if err := l.Check("user1", "", now); !errors.As(err, &throttled) || throttled.RetryAfter != l.MaxDelay {
+		t.Errorf("expected max delay, got %v", err)
+	}
+
+	// success resets the user, not the IP address
+	l.Succeeded("user1")
+	if l.Check("user1", "", now) != nil {
+		t.Error("user throttled after success")
+	}
+	if l.Check("user1", "ip1", now) == nil {
+		t.Error("IP address not throttled after success of user")
+	}
+
+	l.UnlockIP("ip1")
+	if l.Check("user1", "ip1", now) != nil {
+		t.Error("IP address throttled after unlock")
+	}
+}
+
+func TestLoginLimiter_Lockout(t *testing.T) {
+	now := time.Now()
+	l := NewLoginLimiter()
+
+	for i := 0; i < l.LockoutThreshold; i++ {
+		l.Failed("user1", "", now)
+	}
+
+	var throttled *LoginThrottledError
+	if err := l.Check("user1", "", now.Add(l.MaxDelay)); !errors.As(err, &throttled) || !throttled.Locked {
+		t.Fatalf("expected lockout, got %v", err)
+	}
+
+	if l.Check("user1", "", now.Add(l.LockoutDuration)) != nil {
+		t.Error("locked after lockout duration")
+	}
+
+	l.Failed("user1", "", now)
+	l.Unlock("user1")
+	if l.Check("user1", "", now) != nil {
+		t.Error("locked after unlock")
+	}
+
+	// failures are forgotten
+	for i := 0; i < l.LockoutThreshold-1; i++ {
+		l.Failed("user1", "ip1", now)
+	}
+	now = now.Add(l.ForgetAfter)
+	l.Failed("user1", "ip1", now)
+	if l.Check("user1", "ip1", now) != nil {
+		t.Error("forgotten failures counted")
+	}
+
+	l.Prune(now.Add(l.ForgetAfter))
+	if len(l.users) != 0 || len(l.ips) != 0 {
+		t.Errorf("forgotten failures not pruned: %d users, %d IP addresses", len(l.users), len(l.ips))
+	}
+}
+
+func TestLoginLimiter_StructLiteral(t *testing.T) {
+	now := time.Now()
+	l := &LoginLimiter{LockoutThreshold: 2, LockoutDuration: time.Hour}
+
+	if l.Check("user1", "ip1", now) != nil {
+		t.Fatal("throttled without failures")
+	}
+
+	l.Failed("user1", "ip1", now)
+	l.Failed("user1", "ip1", now)
+
+	var throttled *LoginThrottledError
+	if err := l.Check("user1", "ip1", now); !errors.As(err, &throttled) || !throttled.Locked {
+		t.Fatalf("expected lockout, got %v", err)
+	}
+
+	l = &LoginLimiter{LockoutThreshold: 2, LockoutDuration: time.Hour}
+	l.Restore("user1", 2, now)
+	if err := l.Check("user1", "", now); !errors.As(err, &throttled) || !throttled.Locked {
+		t.Errorf("expected restored lockout, got %v", err)
+	}
+}
+
+func TestRegistry_LoginLimiter(t *testing.T) {
+	c := &clock{now: time.Now()}
+	users := NewRegistry(newMockStorage(), secret, WithLoginLimiter(NewLoginLimiter()))
+	users.now = c.Now
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	client := ClientInfo{IP: "192.0.2.1"}
+
+	for i := 0; i < 3; i++ {
+		_, _, err = users.LoginWithClient("user1", "wrong", client)
+		if !errors.Is(err, UnauthorizedError) {
+			t.Fatalf("expected unauthorized, got %v", err)
+		}
+	}
+
+	// success resets the failures
+	_, _, err = users.LoginWithClient("user1", "password1", client)
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		users.LoginWithClient("user1", "wrong", ClientInfo{})
+	}
+
+	// the correct password is refused during the delay
+	var throttled *LoginThrottledError
+	_, _, err = users.LoginWithClient("user1", "password1", ClientInfo{})
+	if !errors.As(err, &throttled) {
+		t.Fatalf("expected throttled login, got %v", err)
+	}
+
+	c.Advance(throttled.RetryAfter)
+	_, _, err = users.LoginWithClient("user1", "password1", ClientInfo{})
+	if err != nil {
+		t.Fatalf("error logging in after delay: %v", err)
+	}
+
+	// lockout
+	for i := 0; i < 10; i++ {
+		c.Advance(time.Hour)
+		users.LoginWithClient("user1", "wrong", ClientInfo{})
+	}
+
+	_, _, err = users.LoginWithClient("user1", "password1", ClientInfo{})
+	if !errors.As(err, &throttled) || !throttled.Locked {
+		t.Fatalf("expected locked account, got %v", err)
+	}
+
+	err = users.ClearLoginLockout("user1")
+	if err != nil {
+		t.Fatalf("error clearing lockout: %v", err)
+	}
+
+	_, _, err = users.LoginWithClient("user1", "password1", ClientInfo{})
+	if err != nil {
+		t.Errorf("error logging in after clearing lockout: %v", err)
+	}
+
+	if NewRegistry(newMockStorage(), secret).ClearLoginLockout("user1") == nil {
+		t.Error("cleared lockout without limiter")
+	}
+}
+
+func TestRegistry_LoginLimiterPasswordChecks(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(users *Registry, password string) error
+	}{
+		{"change password", func(users *Registry, password string) error {
+			return users.ChangePassword("user1", password, "password2")
+		}},
+		{"enroll TOTP", func(users *Registry, password string) error {
+			_, _, err := users.EnrollTOTP("user1", password)
+			return err
+		}},
+		{"disable TOTP", func(users *Registry, password string) error {
+			return users.DisableTOTP("user1", password, "000000")
+		}},
+		{"register passkey", func(users *Registry, password string) error {
+			_, err := users.BeginWebAuthnRegistration("user1", password)
+			return err
+		}},
+	}
+
+	for _, test := range tests {
+		users := NewRegistry(newMockStorage(), secret, WithLoginLimiter(NewLoginLimiter()), WithWebAuthn(RP_ID, "Example"))
+
+		err := users.Register("user1", "password1")
+		if err != nil {
+			t.Fatalf("error registering user: %v", err)
+		}
+
+		for i := 0; i < 4; i++ {
+			err = test.check(users, "wrong")
+			if !errors.Is(err, UnauthorizedError) {
+				t.Fatalf("%s: expected unauthorized, got %v", test.name, err)
+			}
+		}
+
+		var throttled *LoginThrottledError
+		if err = test.check(users, "password1"); !errors.As(err, &throttled) {
+			t.Errorf("%s: expected throttled, got %v", test.name, err)
+		}
+
+		if _, _, err = users.Login("user1", "password1"); !errors.As(err, &throttled) {
+			t.Errorf("%s: expected throttled login, got %v", test.name, err)
+		}
+	}
+}
+
+func TestRegistry_LoginLimiterUnsavedActivity(t *testing.T) {
+	limiter := NewLoginLimiter()
+	users := NewRegistry(newMockStorage(), secret, WithLoginLimiter(limiter))
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	// the failures are saved, but do not delay the login
+	limiter.FreeAttempts = 10
+	for i := 0; i < 4; i++ {
+		users.Login("user1", "wrong")
+	}
+
+	err = users.Sweep()
+	if err != nil {
+		t.Fatalf("error sweeping: %v", err)
+	}
+
+	_, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	// the saved failures are not restored, since the login reset them
+	limiter.FreeAttempts = 3
+	_, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Errorf("error logging in again: %v", err)
+	}
+}
+
+func TestRegistry_LoginLimiterRestart(t *testing.T) {
+	c := &clock{now: time.Now()}
+	storage := newMockStorage()
+
+	users := NewRegistry(storage, secret, WithLoginLimiter(NewLoginLimiter()))
+	users.now = c.Now
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Advance(time.Hour)
+		users.Login("user1", "wrong")
+	}
+
+	// the lockout survives a restart, since the failures are persisted
+	err = users.Sweep()
+	if err != nil {
+		t.Fatalf("error sweeping: %v", err)
+	}
+
+	users = NewRegistry(storage, secret, WithLoginLimiter(NewLoginLimiter()))
+	users.now = c.Now
+
+	var throttled *LoginThrottledError
+	_, _, err = users.Login("user1", "password1")
+	if !errors.As(err, &throttled) || !throttled.Locked {
+		t.Fatalf("expected locked account after restart, got %v", err)
+	}
+
+	err = users.ClearLoginLockout("user1")
+	if err != nil {
+		t.Fatalf("error clearing lockout: %v", err)
+	}
+
+	if user, _ := storage.Load("user1"); user.FailedLogins != 0 {
+		t.Errorf("persisted failures not cleared: %d", user.FailedLogins)
+	}
+
+	users = NewRegistry(storage, secret, WithLoginLimiter(NewLoginLimiter()))
+	users.now = c.Now
+
+	_, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Errorf("error logging in after clearing lockout: %v", err)
+	}
+}
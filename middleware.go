@@ -1,10 +1,12 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // Middleware  checks if the user is authenticated and has the required roles
@@ -18,20 +20,74 @@ import (
 //	  "roles": "admin,user"
 //	}`
 //
-// The middleware expects the JWT token to be signed with HMAC and the secret must be provided
+// The middleware expects the JWT token to be signed with the same method as the verification key:
+// either HMAC with a shared secret or RSA/ECDSA/EdDSA with a public key.
+// The token must not be expired ("exp" claim is required), and if the middleware is configured with
+// RequireIssuer or RequireAudience, the "iss" and "aud" claims must match.
+// If the middleware is configured with WithRevocationChecker, revoked tokens are rejected too.
 // roles is a comma separated list of roles
 // if "admin" is present in the roles list, the user is allowed to access all endpoints,
 // otherwise the user must have at least one of the required roles.
 type Middleware struct {
-	secret string
+	keys KeySource
+
+	issuer   string
+	audience string
+	leeway   time.Duration
+
+	revocations RevocationChecker
 }
 
 // NewMiddleware creates a new Middleware
 // secret is the secret used to sign the JWT token
-func NewMiddleware(secret string) *Middleware {
-	return &Middleware{
-		secret: secret,
+func NewMiddleware(secret string, opts ...MiddlewareOption) *Middleware {
+	return NewMiddlewareWithKey(NewHMACKey(secret).VerificationKey(), opts...)
+}
+
+// NewMiddlewareWithKey creates a new Middleware
+// key is the key used to verify the JWT token, usually a public key (see NewVerificationKey)
+func NewMiddlewareWithKey(key *VerificationKey, opts ...MiddlewareOption) *Middleware {
+	return NewMiddlewareWithKeySource(StaticKeys{key}, opts...)
+}
+
+// NewMiddlewareWithKeys creates a new Middleware
+// keys are the keys used to verify the JWT token, selected by the "kid" token header,
+// e.g. the current and the previous key during a key rotation
+func NewMiddlewareWithKeys(keys []*VerificationKey, opts ...MiddlewareOption) *Middleware {
+	return NewMiddlewareWithKeySource(StaticKeys(keys), opts...)
+}
+
+// NewMiddlewareWithKeySource creates a new Middleware
+// keys provides the keys used to verify the JWT token, selected by the "kid" token header
+func NewMiddlewareWithKeySource(keys KeySource, opts ...MiddlewareOption) *Middleware {
+	a := &Middleware{
+		keys: keys,
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+// NewMiddlewareFromJWKS creates a new Middleware that verifies JWT tokens with keys from a JSON Web Key Set
+// location is either an http(s) URL of the key set (see server.JWKSHandler) or a path to a file
+func NewMiddlewareFromJWKS(location string, opts ...MiddlewareOption) (*Middleware, error) {
+	var keys *JWKSKeySource
+	var err error
+
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		keys, err = NewJWKSURL(location, nil)
+	} else {
+		keys, err = NewJWKSFile(location)
 	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMiddlewareWithKeySource(keys, opts...), nil
 }
 
 // Wrap wraps the next handler and checks if the user is authenticated and has the required roles
@@ -55,13 +111,29 @@ func (a *Middleware) Wrap(next http.Handler, requireAllRoles bool, requiredRoles
 
 		token, err := jwt.Parse(hdr, func(token *jwt.Token) (interface{}, error) {
 			// Don't forget to validate the alg is what you expect:
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			kid, _ := token.Header["kid"].(string)
+
+			key, err := a.keys.VerificationKey(kid)
+			if err != nil {
+				return nil, err
+			}
+
+			if key == nil {
+				return nil, fmt.Errorf("unknown key: %s", kid)
+			}
+
+			if token.Method.Alg() != key.method.Alg() {
 				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 			}
 
-			// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-			return []byte(a.secret), nil
-		})
+			return key.key, nil
+		}, a.parserOptions()...)
+
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			writer.WriteHeader(http.StatusUnauthorized)
+			writer.Write([]byte("Token expired"))
+			return
+		}
 
 		if err != nil {
 			writer.WriteHeader(http.StatusUnauthorized)
@@ -83,6 +155,36 @@ func (a *Middleware) Wrap(next http.Handler, requireAllRoles bool, requiredRoles
 			return
 		}
 
+		exp, err := claims.GetExpirationTime()
+		if err != nil || exp == nil {
+			writer.WriteHeader(http.StatusUnauthorized)
+			writer.Write([]byte("Token without expiration"))
+			return
+		}
+
+		if a.revocations != nil {
+			jti, _ := claims["jti"].(string)
+			username, _ := claims["username"].(string)
+
+			var issuedAt time.Time
+			if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+				issuedAt = iat.Time
+			}
+
+			revoked, err := a.revocations.Revoked(jti, username, issuedAt)
+			if err != nil {
+				writer.WriteHeader(http.StatusServiceUnavailable)
+				writer.Write([]byte("Revocation check failed"))
+				return
+			}
+
+			if revoked {
+				writer.WriteHeader(http.StatusUnauthorized)
+				writer.Write([]byte("Token revoked"))
+				return
+			}
+		}
+
 		roles := claims["roles"]
 		if roles == nil {
 			writer.WriteHeader(http.StatusUnauthorized)
@@ -123,3 +225,21 @@ func (a *Middleware) Wrap(next http.Handler, requireAllRoles bool, requiredRoles
 
 	}
 }
+
+// parserOptions returns the JWT parser options validating the registered claims.
+func (a *Middleware) parserOptions() []jwt.ParserOption {
+	opts := []jwt.ParserOption{
+		jwt.WithLeeway(a.leeway),
+		jwt.WithIssuedAt(),
+	}
+
+	if a.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+
+	if a.audience != "" {
+		opts = append(opts, jwt.WithAudience(a.audience))
+	}
+
+	return opts
+}
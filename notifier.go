@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notification is a message to a user, carrying a one-time token, e.g. to reset a forgotten password.
+type Notification struct {
+	// Purpose is the action the token allows, e.g. TokenPurposePasswordReset.
+	Purpose string `json:"purpose"`
+	// Username is the user to notify.
+	Username string `json:"username"`
+	// Email is the email address of the user, empty if unknown.
+	Email string `json:"email,omitempty"`
+	// Token is the one-time token, the user has to present it to the server to complete the action.
+	Token string `json:"token"`
+	// ExpiresAt is the time the token expires.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Notifier delivers notifications to users, e.g. by email. It is used by Registry (see WithNotifier),
+// and should be implemented by the user of the library.
+// Implementations must be safe for concurrent use.
+type Notifier interface {
+	// Notify delivers the notification. The token must only be sent through a channel the user controls.
+	Notify(n *Notification) error
+}
+
+// FileNotifier appends notifications as JSON lines to a file. It is meant for local testing.
+type FileNotifier struct {
+	path string
+	m    sync.Mutex
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{
+		path: path,
+	}
+}
+
+func (f *FileNotifier) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("error marshaling notification: %w", err)
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+
+	return nil
+}
+
+// LogNotifier writes notifications to a logger. It is meant for local testing.
+type LogNotifier struct {
+	logger *log.Logger
+}
+
+// NewLogNotifier creates a notifier writing to the logger, or to the standard logger if logger is nil.
+func NewLogNotifier(logger *log.Logger) *LogNotifier {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &LogNotifier{
+		logger: logger,
+	}
+}
+
+func (l *LogNotifier) Notify(n *Notification) error {
+	l.logger.Printf("%s for %s <%s>: %s (expires at %s)", n.Purpose, n.Username, n.Email, n.Token, n.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const NOTIFICATION_FILE = ".local/notifications.jsonl"
+
+// recordingNotifier keeps the notifications in memory.
+type recordingNotifier struct {
+	m             sync.Mutex
+	notifications []*Notification
+}
+
+func (r *recordingNotifier) Notify(n *Notification) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.notifications = append(r.notifications, n)
+	return nil
+}
+
+func (r *recordingNotifier) last() *Notification {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(r.notifications) == 0 {
+		return nil
+	}
+	return r.notifications[len(r.notifications)-1]
+}
+
+func TestFileNotifier(t *testing.T) {
+	os.Remove(NOTIFICATION_FILE)
+
+	notifier := NewFileNotifier(NOTIFICATION_FILE)
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	for _, username := range []string{"user1", "user2"} {
+		err := notifier.Notify(&Notification{Purpose: TokenPurposePasswordReset, Username: username, Token: "token-" + username, ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatalf("error writing notification: %v", err)
+		}
+	}
+
+	f, err := os.Open(NOTIFICATION_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var notifications []Notification
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n := Notification{}
+		err = json.Unmarshal(scanner.Bytes(), &n)
+		if err != nil {
+			t.Fatalf("error unmarshaling notification: %v", err)
+		}
+		notifications = append(notifications, n)
+	}
+
+	if len(notifications) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(notifications))
+	}
+
+	if n := notifications[1]; n.Username != "user2" || n.Token != "token-user2" || n.Purpose != TokenPurposePasswordReset || !n.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("unexpected notification %+v", n)
+	}
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// TokenPurposePasswordReset is the purpose of tokens issued by Registry.RequestPasswordReset.
+	TokenPurposePasswordReset = "password_reset"
+	// TokenPurposeEmailVerification is the purpose of tokens verifying the email address of a user.
+	TokenPurposeEmailVerification = "email_verification"
+	// TokenPurposeMFAChallenge is the purpose of challenge tokens returned by Registry.Login
+	// with *MFARequiredError.
+	TokenPurposeMFAChallenge = "mfa_challenge"
+	// TokenPurposeWebAuthnRegistration is the purpose of challenges of passkey registrations.
+	TokenPurposeWebAuthnRegistration = "webauthn_registration"
+	// TokenPurposeWebAuthnLogin is the purpose of challenges of passkey logins.
+	TokenPurposeWebAuthnLogin = "webauthn_login"
+)
+
+// OneTimeToken is a short-lived token, which is sent to the user and can be used only once,
+// e.g. to reset a forgotten password.
+type OneTimeToken struct {
+	// Token is the SHA-256 hash of the token value sent to the user. The value itself is never stored.
+	Token string
+	// Purpose is the action the token allows, e.g. TokenPurposePasswordReset.
+	Purpose string
+	// Username is the user the token was issued to.
+	Username string
+	// Email is the email address the token was sent to.
+	Email string
+	// ExpiresAt is the time the token expires.
+	ExpiresAt time.Time
+}
+
+// Expired checks if the token is expired at the given time.
+func (t *OneTimeToken) Expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+// OneTimeTokenStore is an interface for one-time token storage. It is used by Registry.
+// Implementations must be safe for concurrent use.
+type OneTimeTokenStore interface {
+	// Save saves a new token.
+	Save(t *OneTimeToken) error
+	// Load loads a token by its hash. Returns nil if token not found.
+	Load(token string) (*OneTimeToken, error)
+	// Delete deletes a token by its hash. Missing token should not return error.
+	Delete(token string) error
+	// DeleteUser deletes all tokens of the user issued for the purpose.
+	DeleteUser(username string, purpose string) error
+	// DeleteExpired deletes all tokens expired at the given time.
+	DeleteExpired(now time.Time) error
+}
+
+// MemoryOneTimeTokenStore keeps one-time tokens in memory.
+// Tokens are lost on restart, and can not be shared between several instances of the server.
+type MemoryOneTimeTokenStore struct {
+	m      sync.Mutex
+	tokens map[string]OneTimeToken
+}
+
+func NewMemoryOneTimeTokenStore() *MemoryOneTimeTokenStore {
+	return &MemoryOneTimeTokenStore{
+		tokens: make(map[string]OneTimeToken),
+	}
+}
+
+func (s *MemoryOneTimeTokenStore) Save(t *OneTimeToken) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.tokens[t.Token] = *t
+	return nil
+}
+
+func (s *MemoryOneTimeTokenStore) Load(token string) (*OneTimeToken, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	t, ok := s.tokens[token]
+	if !ok {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (s *MemoryOneTimeTokenStore) Delete(token string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.tokens, token)
+	return nil
+}
+
+func (s *MemoryOneTimeTokenStore) DeleteUser(username string, purpose string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for k, t := range s.tokens {
+		if t.Username == username && t.Purpose == purpose {
+			delete(s.tokens, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryOneTimeTokenStore) DeleteExpired(now time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for k, t := range s.tokens {
+		if t.Expired(now) {
+			delete(s.tokens, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"time"
+)
+
+const (
+	// DefaultAccessTokenTTL is the default lifetime of access tokens issued by Registry.
+	DefaultAccessTokenTTL = 15 * time.Minute
+	// DefaultRefreshTokenIdleTimeout is the default time after which an unused refresh token expires.
+	DefaultRefreshTokenIdleTimeout = 30 * 24 * time.Hour
+	// DefaultSessionLifetime is the default time after login, after which the session can not be refreshed anymore.
+	DefaultSessionLifetime = 90 * 24 * time.Hour
+	// DefaultPasswordResetTTL is the default lifetime of password reset tokens.
+	DefaultPasswordResetTTL = 30 * time.Minute
+	// DefaultPasswordResetCooldown is the default time after a password reset request, during which
+	// further requests of the user are ignored.
+	DefaultPasswordResetCooldown = time.Minute
+	// DefaultEmailVerificationTTL is the default lifetime of email verification tokens.
+	DefaultEmailVerificationTTL = 24 * time.Hour
+	// DefaultMFAChallengeTTL is the default time to complete a login with the second factor.
+	DefaultMFAChallengeTTL = 5 * time.Minute
+	// DefaultLoginActivitySaveInterval is the default time login activity is kept in memory before it is saved.
+	DefaultLoginActivitySaveInterval = time.Minute
+)
+
+// RegistryOption configures a Registry.
+type RegistryOption func(u *Registry)
+
+// WithAccessTokenTTL sets the lifetime of issued access tokens (DefaultAccessTokenTTL by default).
+func WithAccessTokenTTL(ttl time.Duration) RegistryOption {
+	return func(u *Registry) {
+		u.accessTokenTTL = ttl
+	}
+}
+
+// WithIssuer sets the "iss" claim of issued access tokens.
+func WithIssuer(issuer string) RegistryOption {
+	return func(u *Registry) {
+		u.issuer = issuer
+	}
+}
+
+// WithAudience sets the "aud" claim of issued access tokens.
+func WithAudience(audience ...string) RegistryOption {
+	return func(u *Registry) {
+		u.audience = audience
+	}
+}
+
+// WithRefreshTokenStore sets the storage of refresh tokens (MemoryRefreshTokenStore by default).
+// Use a persistent store, e.g. SimpleFileRefreshTokenStore, to keep users logged in across restarts,
+// or a shared one to run several instances of the server.
+func WithRefreshTokenStore(store RefreshTokenStore) RegistryOption {
+	return func(u *Registry) {
+		u.refreshTokens = store
+	}
+}
+
+// WithRefreshTokenIdleTimeout sets the time after which an unused refresh token expires
+// (DefaultRefreshTokenIdleTimeout by default). Every refresh extends the session by this time.
+// Zero disables the idle timeout.
+func WithRefreshTokenIdleTimeout(timeout time.Duration) RegistryOption {
+	return func(u *Registry) {
+		u.refreshTokenIdleTimeout = timeout
+	}
+}
+
+// WithSessionLifetime sets the absolute lifetime of a session (DefaultSessionLifetime by default).
+// After this time since login, refreshing fails and the user has to login again, no matter how
+// active the session is. Zero disables the absolute lifetime.
+func WithSessionLifetime(lifetime time.Duration) RegistryOption {
+	return func(u *Registry) {
+		u.sessionLifetime = lifetime
+	}
+}
+
+// WithRevocationList makes the Registry revoke access tokens of users who are blacklisted,
+// deleted or logged out of all sessions, and enables Registry.RevokeAccessToken.
+// Middleware must check the list (see WithRevocationChecker) to reject revoked tokens.
+func WithRevocationList(list *RevocationList) RegistryOption {
+	return func(u *Registry) {
+		u.revocations = list
+	}
+}
+
+// WithPasswordHasher makes the Registry upgrade password hashes on successful login, when the hasher
+// reports them as outdated (see PasswordHasher.NeedsRehash), by setting the password again through
+// Storage.SetPassword. The storage must hash passwords with the same hasher and implement PasswordHashStorage,
+// e.g. SimpleFileStorage created by NewSimpleFileStorageWithHasher.
+func WithPasswordHasher(hasher PasswordHasher) RegistryOption {
+	return func(u *Registry) {
+		u.passwordHasher = hasher
+	}
+}
+
+// WithPasswordPolicy sets the rules passwords must meet when they are set by the Registry
+// (DefaultPasswordPolicy by default). An empty PasswordPolicy accepts any non-empty password.
+func WithPasswordPolicy(policy *PasswordPolicy) RegistryOption {
+	return func(u *Registry) {
+		u.passwordPolicy = policy
+	}
+}
+
+// WithUsernamePolicy sets how usernames are normalized, and which usernames can be registered,
+// e.g. DefaultUsernamePolicy. Without a policy (the default) usernames are used verbatim,
+// and any non-control characters are allowed.
+// Setting or changing the policy makes users registered before unreachable, if their stored usernames
+// are not normalized the same way, so existing usernames must be migrated to UsernamePolicy.Normalize first.
+func WithUsernamePolicy(policy *UsernamePolicy) RegistryOption {
+	return func(u *Registry) {
+		u.usernamePolicy = policy
+	}
+}
+
+// WithNotifier sets the notifier delivering one-time tokens to users, and enables
+// Registry.RequestPasswordReset.
+func WithNotifier(notifier Notifier) RegistryOption {
+	return func(u *Registry) {
+		u.notifier = notifier
+	}
+}
+
+// WithOneTimeTokenStore sets the storage of one-time tokens, e.g. password reset tokens
+// (MemoryOneTimeTokenStore by default).
+func WithOneTimeTokenStore(store OneTimeTokenStore) RegistryOption {
+	return func(u *Registry) {
+		u.oneTimeTokens = store
+	}
+}
+
+// WithPasswordResetTTL sets the lifetime of password reset tokens (DefaultPasswordResetTTL by default).
+func WithPasswordResetTTL(ttl time.Duration) RegistryOption {
+	return func(u *Registry) {
+		u.passwordResetTTL = ttl
+	}
+}
+
+// WithPasswordResetCooldown sets the time after a password reset request, during which further requests
+// of the user are ignored, so users can not be flooded with notifications (DefaultPasswordResetCooldown by default).
+func WithPasswordResetCooldown(cooldown time.Duration) RegistryOption {
+	return func(u *Registry) {
+		u.passwordResetCooldown = cooldown
+	}
+}
+
+// WithEmailVerificationTTL sets the lifetime of email verification tokens (DefaultEmailVerificationTTL by default).
+func WithEmailVerificationTTL(ttl time.Duration) RegistryOption {
+	return func(u *Registry) {
+		u.emailVerificationTTL = ttl
+	}
+}
+
+// WithMFAChallengeTTL sets the time to complete a login with the second factor (DefaultMFAChallengeTTL by default).
+func WithMFAChallengeTTL(ttl time.Duration) RegistryOption {
+	return func(u *Registry) {
+		u.mfaChallengeTTL = ttl
+	}
+}
+
+// WithWebAuthn enables login with passkeys (see Registry.BeginWebAuthnRegistration). rpID is the domain of the
+// site (e.g. "example.com"), rpName is shown by authenticators, and origins are the origins of the pages
+// starting the ceremonies (https://{rpID} if none are given). Passkeys are bound to rpID, so it can not be changed
+// without registering them again.
+func WithWebAuthn(rpID string, rpName string, origins ...string) RegistryOption {
+	return func(u *Registry) {
+		u.webAuthn = newWebAuthnConfig(rpID, rpName, origins)
+	}
+}
+
+// WithLoginActivitySaveInterval sets the time login activity (see User.LastLoginAt) is kept in memory
+// before it is saved (DefaultLoginActivitySaveInterval by default). Zero saves it only in Registry.Sweep.
+func WithLoginActivitySaveInterval(interval time.Duration) RegistryOption {
+	return func(u *Registry) {
+		u.loginActivitySaveInterval = interval
+	}
+}
+
+// WithLoginLimiter throttles failed logins per user and per client IP address, see LoginLimiter.
+// Logins are not limited by default.
+func WithLoginLimiter(limiter *LoginLimiter) RegistryOption {
+	return func(u *Registry) {
+		u.loginLimiter = limiter
+	}
+}
+
+// UnverifiedEmailPolicy defines how Registry treats users whose email address is not verified,
+// including users without an email address.
+type UnverifiedEmailPolicy int
+
+const (
+	// AllowUnverifiedEmail treats users the same, whether their email address is verified or not.
+	AllowUnverifiedEmail UnverifiedEmailPolicy = iota
+	// RefuseUnverifiedEmail refuses Login and Refresh with EmailNotVerifiedError until the address is verified.
+	RefuseUnverifiedEmail
+	// StripRolesUnverifiedEmail issues access tokens without roles until the address is verified.
+	StripRolesUnverifiedEmail
+)
+
+// WithUnverifiedEmailPolicy sets how users whose email address is not verified are treated
+// (AllowUnverifiedEmail by default).
+func WithUnverifiedEmailPolicy(policy UnverifiedEmailPolicy) RegistryOption {
+	return func(u *Registry) {
+		u.unverifiedEmail = policy
+	}
+}
+
+// MiddlewareOption configures a Middleware.
+type MiddlewareOption func(a *Middleware)
+
+// RequireIssuer rejects tokens with an "iss" claim other than issuer.
+func RequireIssuer(issuer string) MiddlewareOption {
+	return func(a *Middleware) {
+		a.issuer = issuer
+	}
+}
+
+// RequireAudience rejects tokens that do not contain audience in the "aud" claim.
+func RequireAudience(audience string) MiddlewareOption {
+	return func(a *Middleware) {
+		a.audience = audience
+	}
+}
+
+// WithLeeway allows for clock skew between servers when checking "exp", "nbf" and "iat" claims.
+func WithLeeway(leeway time.Duration) MiddlewareOption {
+	return func(a *Middleware) {
+		a.leeway = leeway
+	}
+}
+
+// WithRevocationChecker rejects tokens revoked before they expired, e.g. a RevocationList shared with
+// the Registry, or a RevocationFeed loaded from the authentication server.
+func WithRevocationChecker(checker RevocationChecker) MiddlewareOption {
+	return func(a *Middleware) {
+		a.revocations = checker
+	}
+}
@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"strings"
+)
+
+// PasswordHasher hashes passwords for storage. It can be used by Storage implementations,
+// so they do not have to implement password hashing themselves (see SimpleFileStorage).
+//
+// Hashes are self-describing strings (PHC or modular crypt format), containing the algorithm,
+// its parameters and the salt. The built-in hashers verify hashes of any built-in algorithm,
+// so the algorithm or its parameters can be changed at any time: outdated hashes are reported
+// by NeedsRehash and replaced on the next successful login (see WithPasswordHasher).
+type PasswordHasher interface {
+	// Hash hashes the password with a random salt.
+	Hash(password string) (string, error)
+	// Verify checks the password against a hash. The comparison is done in constant time.
+	Verify(hash string, password string) (bool, error)
+	// NeedsRehash checks if the hash was created with another algorithm or other parameters
+	// than the hasher uses, and should be replaced.
+	NeedsRehash(hash string) bool
+}
+
+const passwordSaltLen = 16
+
+var phc = base64.RawStdEncoding
+
+// Argon2idHasher hashes passwords with argon2id (RFC 9106).
+// Format: $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+type Argon2idHasher struct {
+	// Time is the number of passes over the memory.
+	Time uint32
+	// Memory is the size of the memory in KiB.
+	Memory uint32
+	// Threads is the number of lanes.
+	Threads uint8
+	// KeyLen is the length of the hash in bytes.
+	KeyLen uint32
+}
+
+// NewArgon2idHasher creates an argon2id hasher with the parameters recommended by RFC 9106, section 4:
+// 3 passes over 64 MiB of memory with 4 lanes. This is the default hasher.
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		KeyLen:  32,
+	}
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := passwordSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads, phc.EncodeToString(salt), phc.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Verify(hash string, password string) (bool, error) {
+	return verifyPasswordHash(hash, password)
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	p, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return p.memory != h.Memory || p.time != h.Time || p.threads != h.Threads || uint32(len(p.key)) != h.KeyLen
+}
+
+// BcryptHasher hashes passwords with bcrypt.
+// Format: $2a$12$saltsaltsaltsaltsaltsahashhashhashhashhashhashhas
+// Note that bcrypt can not hash passwords longer than 72 bytes.
+type BcryptHasher struct {
+	// Cost is the base-2 logarithm of the number of rounds.
+	Cost int
+}
+
+// NewBcryptHasher creates a bcrypt hasher with cost 12.
+func NewBcryptHasher() *BcryptHasher {
+	return &BcryptHasher{
+		Cost: 12,
+	}
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) Verify(hash string, password string) (bool, error) {
+	return verifyPasswordHash(hash, password)
+}
+
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	if passwordHashAlgorithm(hash) != "bcrypt" {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.Cost
+}
+
+// ScryptHasher hashes passwords with scrypt (RFC 7914).
+// Format: $scrypt$ln=16,r=8,p=1$salt$hash
+type ScryptHasher struct {
+	// LogN is the base-2 logarithm of the CPU/memory cost parameter N.
+	LogN int
+	// R is the block size.
+	R int
+	// P is the parallelization parameter.
+	P int
+	// KeyLen is the length of the hash in bytes.
+	KeyLen int
+}
+
+// NewScryptHasher creates a scrypt hasher with N=2^16, r=8, p=1 (64 MiB of memory).
+func NewScryptHasher() *ScryptHasher {
+	return &ScryptHasher{
+		LogN:   16,
+		R:      8,
+		P:      1,
+		KeyLen: 32,
+	}
+}
+
+func (h *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := passwordSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		h.LogN, h.R, h.P, phc.EncodeToString(salt), phc.EncodeToString(key)), nil
+}
+
+func (h *ScryptHasher) Verify(hash string, password string) (bool, error) {
+	return verifyPasswordHash(hash, password)
+}
+
+func (h *ScryptHasher) NeedsRehash(hash string) bool {
+	p, err := parseScrypt(hash)
+	if err != nil {
+		return true
+	}
+	return p.logN != h.LogN || p.r != h.R || p.p != h.P || len(p.key) != h.KeyLen
+}
+
+// PBKDF2Hasher hashes passwords with PBKDF2-HMAC-SHA256 (RFC 8018).
+// It is the weakest of the built-in hashers, use it only if it is required, e.g. for FIPS compliance.
+// Format: $pbkdf2-sha256$i=600000$salt$hash
+type PBKDF2Hasher struct {
+	// Iterations is the number of iterations.
+	Iterations int
+	// KeyLen is the length of the hash in bytes.
+	KeyLen int
+}
+
+// NewPBKDF2Hasher creates a PBKDF2-HMAC-SHA256 hasher with 600000 iterations, as recommended by OWASP.
+func NewPBKDF2Hasher() *PBKDF2Hasher {
+	return &PBKDF2Hasher{
+		Iterations: 600000,
+		KeyLen:     32,
+	}
+}
+
+func (h *PBKDF2Hasher) Hash(password string) (string, error) {
+	salt, err := passwordSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, h.Iterations, h.KeyLen, sha256.New)
+
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", h.Iterations, phc.EncodeToString(salt), phc.EncodeToString(key)), nil
+}
+
+func (h *PBKDF2Hasher) Verify(hash string, password string) (bool, error) {
+	return verifyPasswordHash(hash, password)
+}
+
+func (h *PBKDF2Hasher) NeedsRehash(hash string) bool {
+	p, err := parsePBKDF2(hash)
+	if err != nil {
+		return true
+	}
+	return p.iterations != h.Iterations || len(p.key) != h.KeyLen
+}
+
+// verifyPasswordHash checks the password against a hash of any built-in algorithm.
+func verifyPasswordHash(hash string, password string) (bool, error) {
+	var key, expected []byte
+
+	switch passwordHashAlgorithm(hash) {
+	case "argon2id":
+		p, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		expected = p.key
+		key = argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	case "bcrypt":
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case "scrypt":
+		p, err := parseScrypt(hash)
+		if err != nil {
+			return false, err
+		}
+		expected = p.key
+		key, err = scrypt.Key([]byte(password), p.salt, 1<<p.logN, p.r, p.p, len(p.key))
+		if err != nil {
+			return false, err
+		}
+	case "pbkdf2-sha256":
+		p, err := parsePBKDF2(hash)
+		if err != nil {
+			return false, err
+		}
+		expected = p.key
+		key = pbkdf2.Key([]byte(password), p.salt, p.iterations, len(p.key), sha256.New)
+	default:
+		return false, errors.New("unsupported password hash format")
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+// passwordHashAlgorithm returns the algorithm identifier of the hash.
+func passwordHashAlgorithm(hash string) string {
+	if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") {
+		return "bcrypt"
+	}
+
+	parts := strings.SplitN(hash, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+	return parts[1]
+}
+
+// splitPHC splits a PHC string into the parameters, salt and hash fields.
+// version is the expected version field, empty if the algorithm has none.
+func splitPHC(hash string, algorithm string, version string) (params string, salt []byte, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+
+	if version != "" {
+		if len(parts) != 6 || parts[2] != version {
+			return "", nil, nil, fmt.Errorf("unsupported %s hash format", algorithm)
+		}
+		parts = append(parts[:2], parts[3:]...)
+	}
+
+	if len(parts) != 5 || parts[0] != "" || parts[1] != algorithm {
+		return "", nil, nil, fmt.Errorf("unsupported %s hash format", algorithm)
+	}
+
+	salt, err = phc.DecodeString(parts[3])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid salt: %w", err)
+	}
+
+	key, err = phc.DecodeString(parts[4])
+	if err != nil || len(key) == 0 {
+		return "", nil, nil, fmt.Errorf("invalid hash: %w", err)
+	}
+
+	return parts[2], salt, key, nil
+}
+
+type argon2idParams struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func parseArgon2id(hash string) (*argon2idParams, error) {
+	params, salt, key, err := splitPHC(hash, "argon2id", fmt.Sprintf("v=%d", argon2.Version))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &argon2idParams{salt: salt, key: key}
+	_, err = fmt.Sscanf(params, "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil || p.time == 0 || p.threads == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters: %s", params)
+	}
+
+	return p, nil
+}
+
+type scryptParams struct {
+	logN, r, p int
+	salt, key  []byte
+}
+
+func parseScrypt(hash string) (*scryptParams, error) {
+	params, salt, key, err := splitPHC(hash, "scrypt", "")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &scryptParams{salt: salt, key: key}
+	_, err = fmt.Sscanf(params, "ln=%d,r=%d,p=%d", &p.logN, &p.r, &p.p)
+	if err != nil || p.logN < 1 || p.logN > 30 {
+		return nil, fmt.Errorf("invalid scrypt parameters: %s", params)
+	}
+
+	return p, nil
+}
+
+type pbkdf2Params struct {
+	iterations int
+	salt, key  []byte
+}
+
+func parsePBKDF2(hash string) (*pbkdf2Params, error) {
+	params, salt, key, err := splitPHC(hash, "pbkdf2-sha256", "")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pbkdf2Params{salt: salt, key: key}
+	_, err = fmt.Sscanf(params, "i=%d", &p.iterations)
+	if err != nil || p.iterations < 1 {
+		return nil, fmt.Errorf("invalid pbkdf2 parameters: %s", params)
+	}
+
+	return p, nil
+}
+
+func passwordSalt() ([]byte, error) {
+	salt := make([]byte, passwordSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+	return salt, nil
+}
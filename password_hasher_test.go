@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// testHashers returns hashers of every built-in algorithm with low cost parameters.
+func testHashers() map[string]PasswordHasher {
+	return map[string]PasswordHasher{
+		"argon2id":      &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32},
+		"bcrypt":        &BcryptHasher{Cost: 4},
+		"scrypt":        &ScryptHasher{LogN: 10, R: 8, P: 1, KeyLen: 32},
+		"pbkdf2-sha256": &PBKDF2Hasher{Iterations: 1000, KeyLen: 32},
+	}
+}
+
+func TestPasswordHasher_HashVerify(t *testing.T) {
+	for name, h := range testHashers() {
+		hash, err := h.Hash("password")
+		if err != nil {
+			t.Fatalf("%s: error hashing password: %v", name, err)
+		}
+
+		if passwordHashAlgorithm(hash) != name {
+			t.Errorf("%s: unexpected hash format: %s", name, hash)
+		}
+
+		other, _ := h.Hash("password")
+		if hash == other {
+			t.Errorf("%s: same password hashed with the same salt", name)
+		}
+
+		ok, err := h.Verify(hash, "password")
+		if err != nil || !ok {
+			t.Errorf("%s: password verification failed: %v", name, err)
+		}
+
+		ok, err = h.Verify(hash, "wrong")
+		if err != nil || ok {
+			t.Errorf("%s: wrong password verified: %v", name, err)
+		}
+
+		if h.NeedsRehash(hash) {
+			t.Errorf("%s: fresh hash needs rehash", name)
+		}
+	}
+}
+
+func TestPasswordHasher_CrossAlgorithm(t *testing.T) {
+	hashers := testHashers()
+
+	for name, h := range hashers {
+		hash, err := h.Hash("password")
+		if err != nil {
+			t.Fatalf("%s: error hashing password: %v", name, err)
+		}
+
+		for other, o := range hashers {
+			ok, err := o.Verify(hash, "password")
+			if err != nil || !ok {
+				t.Errorf("%s hash not verified by %s hasher: %v", name, other, err)
+			}
+
+			if other != name && !o.NeedsRehash(hash) {
+				t.Errorf("%s hash does not need rehash by %s hasher", name, other)
+			}
+		}
+	}
+}
+
+func TestPasswordHasher_NeedsRehash(t *testing.T) {
+	argon := &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}
+	bcrypt := &BcryptHasher{Cost: 4}
+	scrypt := &ScryptHasher{LogN: 10, R: 8, P: 1, KeyLen: 32}
+	pbkdf2 := &PBKDF2Hasher{Iterations: 1000, KeyLen: 32}
+
+	argonHash, _ := argon.Hash("password")
+	bcryptHash, _ := bcrypt.Hash("password")
+	scryptHash, _ := scrypt.Hash("password")
+	pbkdf2Hash, _ := pbkdf2.Hash("password")
+
+	argon.Time = 2
+	bcrypt.Cost = 5
+	scrypt.LogN = 11
+	pbkdf2.Iterations = 2000
+
+	if !argon.NeedsRehash(argonHash) || !bcrypt.NeedsRehash(bcryptHash) ||
+		!scrypt.NeedsRehash(scryptHash) || !pbkdf2.NeedsRehash(pbkdf2Hash) {
+		t.Error("hash with old parameters does not need rehash")
+	}
+
+	if !argon.NeedsRehash("not a hash") {
+		t.Error("invalid hash does not need rehash")
+	}
+
+	for _, hash := range []string{"", "plain", "$argon2id$v=19$m=1024,t=1,p=1$$", "$unknown$x$y$z"} {
+		if ok, err := argon.Verify(hash, "password"); ok || err == nil {
+			t.Errorf("invalid hash %q verified", hash)
+		}
+	}
+}
+
+func TestRegistry_PasswordRehash(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+
+	old := &PBKDF2Hasher{Iterations: 1000, KeyLen: 32}
+	storage, err := NewSimpleFileStorageWithHasher(STORAGE_FILE, SALT, old)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	users := NewRegistry(storage, secret)
+	err = users.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	// the hasher is replaced
+	hasher := &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}
+	storage, err = NewSimpleFileStorageWithHasher(STORAGE_FILE, SALT, hasher)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	users = NewRegistry(storage, secret, WithPasswordHasher(hasher))
+
+	_, _, err = users.Login("user1", "wrong")
+	if err == nil {
+		t.Fatal("login with wrong password succeeded")
+	}
+
+	hash, _ := storage.PasswordHash("user1")
+	if !strings.HasPrefix(hash, "$pbkdf2-sha256$") {
+		t.Errorf("password hash upgraded after failed login: %s", hash)
+	}
+
+	_, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Fatalf("login with old hash failed: %v", err)
+	}
+
+	hash, _ = storage.PasswordHash("user1")
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("password hash not upgraded: %s", hash)
+	}
+
+	storage, err = NewSimpleFileStorageWithHasher(STORAGE_FILE, SALT, hasher)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	_, _, err = NewRegistry(storage, secret).Login("user1", "password1")
+	if err != nil {
+		t.Errorf("login with upgraded hash failed: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PolicyViolation is a single reason a password or username was rejected.
+type PolicyViolation struct {
+	// Code identifies the rule, e.g. "too_short".
+	Code string `json:"code"`
+	// Message describes the rule for humans.
+	Message string `json:"message"`
+}
+
+// PolicyError is returned by Registry when a password or username does not meet the policy.
+// Handlers can return the violations to the client (see server.RegisterHandler).
+type PolicyError struct {
+	// Field is the rejected field, "password" or "username".
+	Field string
+	// Violations are all rules the value breaks.
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return fmt.Sprintf("invalid %s: %s", e.Field, strings.Join(messages, ", "))
+}
+
+// PasswordPolicy defines the rules passwords must meet when they are set by the Registry.
+// Lengths are counted in characters, not bytes. Zero values disable the rules.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool // any character other than a letter or a digit
+
+	// RejectUsername rejects passwords containing the username, ignoring case. Usernames shorter than
+	// minRejectedUsernameLength are not checked, since most passwords would contain them.
+	RejectUsername bool
+
+	// rejected are lower-cased breached or common passwords, see LoadRejectedPasswords.
+	rejected map[string]struct{}
+}
+
+// minRejectedUsernameLength is the minimum length of usernames checked by RejectUsername.
+const minRejectedUsernameLength = 3
+
+// DefaultPasswordPolicy returns the policy used by Registry unless WithPasswordPolicy is given:
+// 8 to 64 characters, not containing the username. Following NIST SP 800-63B, there are no
+// character class rules, it is better to reject breached passwords (see LoadRejectedPasswords).
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:      8,
+		MaxLength:      64,
+		RejectUsername: true,
+	}
+}
+
+// LoadRejectedPasswords adds the passwords listed in a file, one per line, to the passwords the policy
+// rejects, e.g. a list of breached or most common passwords. Passwords are compared ignoring case.
+// The list must be loaded before the policy is used by a Registry.
+func (p *PasswordPolicy) LoadRejectedPasswords(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening password list: %w", err)
+	}
+	defer f.Close()
+
+	if p.rejected == nil {
+		p.rejected = make(map[string]struct{})
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		password := strings.TrimRight(scanner.Text(), "\r")
+		if password == "" {
+			continue
+		}
+		p.rejected[strings.ToLower(password)] = struct{}{}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("error reading password list: %w", err)
+	}
+
+	return nil
+}
+
+// Validate checks the password of the user against the policy.
+// It returns a *PolicyError listing all violated rules, or nil if the password is acceptable.
+func (p *PasswordPolicy) Validate(username string, password string) error {
+	var violations []PolicyViolation
+
+	violate := func(code string, message string) {
+		violations = append(violations, PolicyViolation{Code: code, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+
+	if length == 0 {
+		violate("empty", "must not be empty")
+	} else if length < p.MinLength {
+		violate("too_short", fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violate("too_long", fmt.Sprintf("must be at most %d characters long", p.MaxLength))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireLower && !lower {
+		violate("missing_lower", "must contain a lower case letter")
+	}
+
+	if p.RequireUpper && !upper {
+		violate("missing_upper", "must contain an upper case letter")
+	}
+
+	if p.RequireDigit && !digit {
+		violate("missing_digit", "must contain a digit")
+	}
+
+	if p.RequireSymbol && !symbol {
+		violate("missing_symbol", "must contain a symbol")
+	}
+
+	if p.RejectUsername && utf8.RuneCountInString(username) >= minRejectedUsernameLength &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violate("contains_username", "must not contain the username")
+	}
+
+	if _, ok := p.rejected[strings.ToLower(password)]; ok {
+		violate("rejected", "is too common or was found in a data breach")
+	}
+
+	if violations != nil {
+		return &PolicyError{Field: "password", Violations: violations}
+	}
+
+	return nil
+}
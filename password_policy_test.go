@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+const PASSWORD_LIST_FILE = ".local/passwords.txt"
+
+func policyViolations(err error) []string {
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+
+	codes := make([]string, len(policyErr.Violations))
+	for i, v := range policyErr.Violations {
+		codes[i] = v.Code
+	}
+	return codes
+}
+
+func TestPasswordPolicy_Validate(t *testing.T) {
+	policy := &PasswordPolicy{
+		MinLength:      8,
+		MaxLength:      12,
+		RequireLower:   true,
+		RequireUpper:   true,
+		RequireDigit:   true,
+		RequireSymbol:  true,
+		RejectUsername: true,
+	}
+
+	tests := []struct {
+		password   string
+		violations []string
+	}{
+		{"Secret-42", nil},
+		{"Ünïcödé-42", nil},
+		{"", []string{"empty", "missing_lower", "missing_upper", "missing_digit", "missing_symbol"}},
+		{"Se-4", []string{"too_short"}},
+		{"Secret-42-Secret-42", []string{"too_long"}},
+		{"secret-42", []string{"missing_upper"}},
+		{"SECRET-42", []string{"missing_lower"}},
+		{"Secret-ab", []string{"missing_digit"}},
+		{"Secret42", []string{"missing_symbol"}},
+		{"xALICEx-42", []string{"contains_username"}},
+	}
+
+	for _, test := range tests {
+		violations := policyViolations(policy.Validate("alice", test.password))
+		if len(violations) != len(test.violations) {
+			t.Errorf("%q: expected violations %v, got %v", test.password, test.violations, violations)
+			continue
+		}
+		for i := range violations {
+			if violations[i] != test.violations[i] {
+				t.Errorf("%q: expected violations %v, got %v", test.password, test.violations, violations)
+				break
+			}
+		}
+	}
+}
+
+func TestPasswordPolicy_ShortUsername(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+
+	for _, username := range []string{"a", "ab"} {
+		if err := policy.Validate(username, "a-password-with-ab"); err != nil {
+			t.Errorf("%q: password rejected for a short username: %v", username, err)
+		}
+	}
+
+	if v := policyViolations(policy.Validate("abc", "a-password-with-abc")); len(v) != 1 || v[0] != "contains_username" {
+		t.Errorf("expected password containing username, got %v", v)
+	}
+}
+
+func TestPasswordPolicy_RejectedPasswords(t *testing.T) {
+	err := os.WriteFile(PASSWORD_LIST_FILE, []byte("password1\r\n\nCorrectHorse\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(PASSWORD_LIST_FILE)
+
+	policy := DefaultPasswordPolicy()
+	err = policy.LoadRejectedPasswords(PASSWORD_LIST_FILE)
+	if err != nil {
+		t.Fatalf("error loading password list: %v", err)
+	}
+
+	for _, password := range []string{"password1", "PASSWORD1", "correcthorse"} {
+		if v := policyViolations(policy.Validate("user1", password)); len(v) != 1 || v[0] != "rejected" {
+			t.Errorf("%q: expected rejected password, got %v", password, v)
+		}
+	}
+
+	if policy.Validate("user1", "password2") != nil {
+		t.Error("password not in the list rejected")
+	}
+
+	if policy.LoadRejectedPasswords(".local/missing.txt") == nil {
+		t.Error("missing password list loaded")
+	}
+}
+
+func TestRegistry_PasswordPolicy(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	err := users.Register("user1", "short")
+	if v := policyViolations(err); len(v) != 1 || v[0] != "too_short" {
+		t.Errorf("expected too short password, got %v", err)
+	}
+
+	err = users.Register("user1", "my-user1-password")
+	if v := policyViolations(err); len(v) != 1 || v[0] != "contains_username" {
+		t.Errorf("expected password containing username, got %v", err)
+	}
+
+	if user, _ := users.storage.Load("user1"); user != nil {
+		t.Error("user with rejected password registered")
+	}
+
+	users = NewRegistry(newMockStorage(), secret, WithPasswordPolicy(&PasswordPolicy{}))
+
+	if users.Register("user1", "user1") != nil {
+		t.Error("empty policy rejected password")
+	}
+
+	if v := policyViolations(users.Register("user2", "")); len(v) != 1 || v[0] != "empty" {
+		t.Error("empty policy accepted empty password")
+	}
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientInfo describes the client a refresh token was issued to.
+type ClientInfo struct {
+	// IP is the IP address of the client.
+	IP string
+	// UserAgent is the User-Agent header sent by the client.
+	UserAgent string
+}
+
+// Limits of the ClientInfo fields stored by Registry. They are sent by the client, so they are truncated
+// to keep the records of refresh tokens and users small.
+const (
+	maxClientIPLength        = 64
+	maxClientUserAgentLength = 512
+)
+
+// truncated returns the client info with the fields truncated to their limits.
+func (c ClientInfo) truncated() ClientInfo {
+	return ClientInfo{
+		IP:        truncate(c.IP, maxClientIPLength),
+		UserAgent: truncate(c.UserAgent, maxClientUserAgentLength),
+	}
+}
+
+// truncate cuts s to at most n bytes, without splitting UTF-8 characters.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+// RefreshToken is a refresh token issued by Registry on login.
+type RefreshToken struct {
+	// Token is the opaque token value handed to the client.
+	Token string
+	// Username is the user the token was issued to.
+	Username string
+	// Family identifies the login session. Every token issued by Registry.Refresh
+	// replaces the previous one and inherits its family.
+	Family string
+	// AuthenticatedAt is the time the user logged in and the session started.
+	AuthenticatedAt time.Time
+	// CreatedAt is the time the token was issued.
+	CreatedAt time.Time
+	// ExpiresAt is the time the token expires. Zero value means the token does not expire.
+	ExpiresAt time.Time
+	// Client describes the client the token was issued to.
+	Client ClientInfo
+	// RotatedAt is the time the token was replaced by a new one. Zero value means the token is current.
+	// Rotated tokens are kept to detect their reuse.
+	RotatedAt time.Time
+}
+
+// Expired checks if the token is expired at the given time.
+func (t *RefreshToken) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// RefreshTokenStore is an interface for refresh token storage. It is used by Registry.
+// Implementations must be safe for concurrent use.
+type RefreshTokenStore interface {
+	// Save saves a new refresh token or updates an existing one.
+	Save(t *RefreshToken) error
+	// Load loads a refresh token by its value. Returns nil if token not found.
+	Load(token string) (*RefreshToken, error)
+	// LoadUser loads all refresh tokens of the user, including rotated ones. The Token values
+	// may be empty, if the store keeps only their hashes.
+	LoadUser(username string) ([]*RefreshToken, error)
+	// Delete deletes a refresh token by its value. Missing token should not return error.
+	Delete(token string) error
+	// DeleteFamily deletes all refresh tokens of the family.
+	DeleteFamily(family string) error
+	// DeleteUser deletes all refresh tokens of the user.
+	DeleteUser(username string) error
+	// DeleteExpired deletes all refresh tokens expired at the given time.
+	DeleteExpired(now time.Time) error
+}
+
+// MemoryRefreshTokenStore keeps refresh tokens in memory.
+// Tokens are lost on restart, and can not be shared between several instances of the server.
+type MemoryRefreshTokenStore struct {
+	m      sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{
+		tokens: make(map[string]RefreshToken),
+	}
+}
+
+func (s *MemoryRefreshTokenStore) Save(t *RefreshToken) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.tokens[t.Token] = *t
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) Load(token string) (*RefreshToken, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	t, ok := s.tokens[token]
+	if !ok {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (s *MemoryRefreshTokenStore) LoadUser(username string) ([]*RefreshToken, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	tokens := make([]*RefreshToken, 0)
+	for _, t := range s.tokens {
+		if t.Username == username {
+			t := t
+			tokens = append(tokens, &t)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *MemoryRefreshTokenStore) Delete(token string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.tokens, token)
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) DeleteFamily(family string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for k, t := range s.tokens {
+		if t.Family == family {
+			delete(s.tokens, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) DeleteUser(username string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for k, t := range s.tokens {
+		if t.Username == username {
+			delete(s.tokens, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) DeleteExpired(now time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for k, t := range s.tokens {
+		if t.Expired(now) {
+			delete(s.tokens, k)
+		}
+	}
+	return nil
+}
@@ -5,25 +5,158 @@ import (
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"hash/fnv"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 var UnauthorizedError = errors.New("unauthorized")
 
+// EmailNotVerifiedError is returned by Login and Refresh, if the Registry refuses users
+// whose email address is not verified (see WithUnverifiedEmailPolicy).
+var EmailNotVerifiedError = errors.New("email not verified")
+
+// Registry registers users and issues access and refresh tokens.
+// Registry is safe for concurrent use, e.g. from the http handlers of the server package,
+// as long as its Storage and RefreshTokenStore are.
 type Registry struct {
+	// m serializes access to the users: operations modifying users hold the write lock,
+	// all other operations hold the read lock. Operations hashing or validating passwords hold
+	// the read lock and the lock of the user instead (see lockUser), so they do not block other users.
+	m sync.RWMutex
+	// userLocks serialize operations of single users, see lockUser.
+	userLocks [userLockCount]sync.Mutex
+	// activity guards pendingActivity, which is updated under the read lock
+	activity sync.Mutex
+	// pendingActivity is the login activity of users not saved yet, see loginActivity.
+	pendingActivity map[string]*loginActivity
+	// activitySaveScheduled is set while a save of pendingActivity is scheduled, guarded by activity.
+	activitySaveScheduled bool
+	// refreshLock makes the rotation of refresh tokens atomic.
+	refreshLock sync.Mutex
+	// resetLock guards resetRequests.
+	resetLock sync.Mutex
+	// resetRequests is the time of the last password reset request of users, see WithPasswordResetCooldown.
+	resetRequests map[string]time.Time
+
 	storage       Storage
-	refreshTokens map[string]string // refresh token -> username
-	secret        string
+	refreshTokens RefreshTokenStore
+	keys          *KeyRing
+
+	accessTokenTTL time.Duration
+	issuer         string
+	audience       []string
+
+	refreshTokenIdleTimeout time.Duration
+	sessionLifetime         time.Duration
+
+	revocations *RevocationList
+
+	passwordHasher PasswordHasher
+	passwordPolicy *PasswordPolicy
+	usernamePolicy *UsernamePolicy
+
+	notifier              Notifier
+	oneTimeTokens         OneTimeTokenStore
+	passwordResetTTL      time.Duration
+	passwordResetCooldown time.Duration
+
+	emailVerificationTTL time.Duration
+	unverifiedEmail      UnverifiedEmailPolicy
+
+	mfaChallengeTTL time.Duration
+	webAuthn        *webAuthnConfig
+	loginLimiter    *LoginLimiter
+
+	loginActivitySaveInterval time.Duration
+
+	now func() time.Time
+}
+
+// NewRegistry creates a Registry that signs access tokens with a shared HMAC secret.
+// Every service verifying the tokens must know the same secret.
+func NewRegistry(storage Storage, secret string, opts ...RegistryOption) *Registry {
+	return NewRegistryWithKey(storage, NewHMACKey(secret), opts...)
+}
+
+// NewRegistryWithKey creates a Registry that signs access tokens with the given key.
+// With an asymmetric key (see NewSigningKey) other services only need the public part
+// of the key to verify tokens (see NewMiddlewareWithKey).
+func NewRegistryWithKey(storage Storage, key *SigningKey, opts ...RegistryOption) *Registry {
+	return NewRegistryWithKeyRing(storage, NewKeyRing(key), opts...)
 }
 
-func NewRegistry(storage Storage, secret string) *Registry {
-	return &Registry{
-		storage:       storage,
-		refreshTokens: make(map[string]string),
-		secret:        secret,
+// NewRegistryWithKeyRing creates a Registry that signs access tokens with the active key of the ring.
+// Keys can be rotated through the ring while the Registry is in use.
+func NewRegistryWithKeyRing(storage Storage, keys *KeyRing, opts ...RegistryOption) *Registry {
+	u := &Registry{
+		storage:        storage,
+		refreshTokens:  NewMemoryRefreshTokenStore(),
+		keys:           keys,
+		accessTokenTTL: DefaultAccessTokenTTL,
+		now:            time.Now,
+
+		refreshTokenIdleTimeout: DefaultRefreshTokenIdleTimeout,
+		sessionLifetime:         DefaultSessionLifetime,
+		passwordPolicy:          DefaultPasswordPolicy(),
+		oneTimeTokens:           NewMemoryOneTimeTokenStore(),
+		passwordResetTTL:        DefaultPasswordResetTTL,
+		passwordResetCooldown:   DefaultPasswordResetCooldown,
+		emailVerificationTTL:    DefaultEmailVerificationTTL,
+		mfaChallengeTTL:         DefaultMFAChallengeTTL,
+
+		loginActivitySaveInterval: DefaultLoginActivitySaveInterval,
+	}
+
+	for _, opt := range opts {
+		opt(u)
 	}
+
+	return u
 }
 
+// Register creates a user with the given password. The username is normalized, if a username policy is set
+// (see UsernamePolicy.Normalize). It returns a *PolicyError if the username or the password does not meet the username policy
+// (see WithUsernamePolicy) or the password policy (see WithPasswordPolicy).
 func (u *Registry) Register(username string, password string) error {
+	return u.RegisterWithEmail(username, password, "")
+}
+
+// RegisterWithEmail creates a user with the given password and email address like Register, and sends
+// a verification token to the address through the notifier (see WithNotifier and VerifyEmail).
+// Empty email registers the user without an address.
+func (u *Registry) RegisterWithEmail(username string, password string, email string) error {
+	username = u.normalizeUsername(username)
+
+	err := u.validateUsername(username)
+	if err != nil {
+		return err
+	}
+
+	err = u.validatePassword(username, password)
+	if err != nil {
+		return err
+	}
+
+	if email != "" {
+		err = u.validateEmail(email)
+		if err != nil {
+			return err
+		}
+
+		if u.notifier == nil {
+			return errors.New("notifier not configured")
+		}
+	}
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	defer u.lockUser(username)()
+
 	user, err := u.storage.Load(username)
 
 	if err != nil {
@@ -34,11 +167,14 @@ func (u *Registry) Register(username string, password string) error {
 		return errors.New("user already exists")
 	}
 
-	err = u.storage.Save(&User{
+	user = &User{
 		Username: username,
 		Roles:    NewRoleSet(),
+		Email:    email,
 		Options:  make(map[string]string),
-	})
+	}
+
+	err = u.storage.Save(user)
 
 	if err != nil {
 		return err
@@ -46,92 +182,489 @@ func (u *Registry) Register(username string, password string) error {
 
 	err = u.storage.SetPassword(username, password)
 	if err != nil {
-		return err
+		// a user without a password could never login, and its username could not be registered again
+		if deleteErr := u.storage.Delete(username); deleteErr != nil {
+			return fmt.Errorf("error setting password: %w (error deleting user: %v)", err, deleteErr)
+		}
+		return fmt.Errorf("error setting password: %w", err)
+	}
+
+	if email != "" {
+		return u.sendOneTimeToken(user, TokenPurposeEmailVerification, u.emailVerificationTTL)
+	}
+
+	return nil
+}
+
+// userLockCount is the number of locks shared by all users, see lockUser.
+const userLockCount = 64
+
+// lockUser locks the user against concurrent operations of the same user, and returns the unlock function.
+// Users share a fixed number of locks by hash of the username, so the locks do not grow with the number
+// of users, and an operation only waits for the few users sharing its lock.
+// Must be called with the read lock held, and not with the lock of another user held.
+func (u *Registry) lockUser(username string) (unlock func()) {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+
+	l := &u.userLocks[h.Sum32()%userLockCount]
+	l.Lock()
+
+	return l.Unlock
+}
+
+// NormalizeUsername returns the canonical form of the username, under which the user is stored
+// (see WithUsernamePolicy), e.g. to use usernames as keys outside of the Registry.
+func (u *Registry) NormalizeUsername(username string) string {
+	return u.normalizeUsername(username)
+}
+
+// normalizeUsername returns the canonical form of the username according to the username policy.
+// All operations taking a username normalize it, so users are found however the username is spelled.
+func (u *Registry) normalizeUsername(username string) string {
+	if u.usernamePolicy == nil {
+		return username
+	}
+	return u.usernamePolicy.Normalize(username)
+}
+
+// validateUsername checks the normalized username against the username policy.
+func (u *Registry) validateUsername(username string) error {
+	if u.usernamePolicy != nil {
+		return u.usernamePolicy.Validate(username)
+	}
+
+	if username == "" {
+		return &PolicyError{Field: "username", Violations: []PolicyViolation{{Code: "empty", Message: "must not be empty"}}}
+	}
+
+	if strings.IndexFunc(username, unicode.IsControl) >= 0 {
+		return &PolicyError{Field: "username", Violations: []PolicyViolation{{Code: "invalid_character", Message: "must not contain control characters"}}}
 	}
 
 	return nil
 }
 
+// validatePassword checks the password against the password policy.
+func (u *Registry) validatePassword(username string, password string) error {
+	if u.passwordPolicy == nil {
+		return (&PasswordPolicy{}).Validate(username, password)
+	}
+	return u.passwordPolicy.Validate(username, password)
+}
+
 func (u *Registry) Login(username string, password string) (token string, refreshToken string, err error) {
-	user, err := u.storage.Load(username)
+	return u.LoginWithClient(username, password, ClientInfo{})
+}
+
+// LoginWithClient logs in the user like Login, and records the client the refresh token is issued to.
+// If the user enabled two-factor authentication, it returns *MFARequiredError instead of tokens
+// (see CompleteMFALogin). If a LoginLimiter is configured, it returns *LoginThrottledError after
+// too many failed logins of the user or from the IP address of the client.
+func (u *Registry) LoginWithClient(username string, password string, client ClientInfo) (token string, refreshToken string, err error) {
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
 
+	// a login must not start a session after a concurrent password change revoked the sessions
+	defer u.lockUser(username)()
+
+	user, err := u.authenticate(username, password, client)
 	if err != nil {
-		return "", "", fmt.Errorf("error loading user: %w", err)
+		return "", "", err
 	}
 
-	if user == nil {
-		return "", "", UnauthorizedError
+	if u.unverifiedEmail == RefuseUnverifiedEmail && !user.EmailVerified {
+		return "", "", EmailNotVerifiedError
 	}
 
-	if user.Blacklisted {
-		return "", "", UnauthorizedError
+	u.rehashPassword(username, password)
+
+	// the failures are reset only after the second factor, see CompleteMFALogin
+	err = u.requireSecondFactor(user)
+	if err != nil {
+		return "", "", err
+	}
+
+	u.loginSucceeded(user, client)
+
+	return u.startSession(user, client)
+}
+
+// authenticate checks the password of the user, limited by the login limiter (see WithLoginLimiter).
+// It returns UnauthorizedError if the user is missing or blacklisted, or the password is wrong,
+// and records the failure. The caller records the success (see loginSucceeded and passwordSucceeded).
+// Must be called with the read or write lock held.
+func (u *Registry) authenticate(username string, password string, client ClientInfo) (*User, error) {
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return nil, fmt.Errorf("error loading user: %w", err)
+	}
+
+	err = u.checkLoginLimiter(username, user, client)
+	if err != nil {
+		return nil, err
 	}
 
+	// the password is validated even if the user is missing or blacklisted, so all failures
+	// take the same time and the response time does not reveal which users exist
 	ok, err := u.storage.ValidatePassword(username, password)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	if user == nil || user.Blacklisted || !ok {
+		u.loginFailed(username, user, client)
+		return nil, UnauthorizedError
+	}
+
+	return user, nil
+}
+
+// checkLoginLimiter returns *LoginThrottledError if the login limiter delays logins of the user from the client.
+// user is the loaded user, whose persisted failures are restored, or nil if the user does not exist.
+// Must be called with the read or write lock held.
+func (u *Registry) checkLoginLimiter(username string, user *User, client ClientInfo) error {
+	if u.loginLimiter == nil {
+		return nil
+	}
+
+	if user != nil {
+		// the stored failures are outdated by the activity not saved yet
+		current := *user
+
+		u.activity.Lock()
+		if a, ok := u.pendingActivity[username]; ok {
+			a.apply(&current)
+		}
+		u.activity.Unlock()
+
+		u.loginLimiter.Restore(username, current.FailedLogins, current.LastFailedLoginAt)
+	}
+
+	return u.loginLimiter.Check(username, client.IP, u.now())
+}
+
+// loginFailed records a failed login of the user, with a wrong password or a wrong second factor.
+// user is the loaded user, or nil if the user does not exist.
+// Must be called with the read or write lock held.
+func (u *Registry) loginFailed(username string, user *User, client ClientInfo) {
+	if u.loginLimiter != nil {
+		u.loginLimiter.Failed(username, client.IP, u.now())
+	}
+
+	if user == nil {
+		return
+	}
+
+	u.activity.Lock()
+	defer u.activity.Unlock()
+
+	a := u.loginActivity(user.Username)
+	a.failures++
+	a.lastFailedLoginAt = u.now()
+}
+
+// loginSucceeded records a login of the user, which passed all factors.
+// Must be called with the read or write lock held.
+func (u *Registry) loginSucceeded(user *User, client ClientInfo) {
+	u.resetLoginFailures(user)
+
+	u.activity.Lock()
+	defer u.activity.Unlock()
+
+	a := u.loginActivity(user.Username)
+	a.lastLoginAt = u.now()
+	a.lastLoginIP = client.truncated().IP
+}
+
+// passwordSucceeded resets the failures of the user after a correct password outside of a login,
+// unless the user enabled two-factor authentication: then only a login passing the second factor resets them.
+// Must be called with the read or write lock held.
+func (u *Registry) passwordSucceeded(user *User) {
+	if storage, ok := u.storage.(TOTPStorage); ok {
+		t, err := storage.LoadTOTP(user.Username)
+		if err != nil || t != nil && t.Confirmed {
+			return
+		}
+	}
+
+	u.resetLoginFailures(user)
+}
+
+// resetLoginFailures resets the failures of the user in the login limiter and in the login activity.
+// Must be called with the read or write lock held.
+func (u *Registry) resetLoginFailures(user *User) {
+	if u.loginLimiter != nil {
+		u.loginLimiter.Succeeded(user.Username)
+	}
+
+	u.activity.Lock()
+	defer u.activity.Unlock()
+
+	a := u.loginActivity(user.Username)
+	a.reset = true
+	a.failures = 0
+}
+
+// loginActivity is the login activity of a user (see User.LastLoginAt) not saved yet.
+// The activity is kept in memory and saved in the background after the save interval
+// (see WithLoginActivitySaveInterval) or by Sweep, so logins do not write to the storage: the storage
+// is accessed alike whether the user exists or not, and is written once per interval however many logins fail.
+type loginActivity struct {
+	// reset is set if the failures were reset, then failures counts the failures since.
+	reset             bool
+	failures          int
+	lastFailedLoginAt time.Time
+	// lastLoginAt is zero if no login succeeded.
+	lastLoginAt time.Time
+	lastLoginIP string
+}
+
+// apply updates the user with the activity.
+func (a *loginActivity) apply(user *User) {
+	if a.reset {
+		user.FailedLogins = 0
+	}
+
+	if a.failures > 0 {
+		user.FailedLogins += a.failures
+		user.LastFailedLoginAt = a.lastFailedLoginAt
+	}
+
+	if !a.lastLoginAt.IsZero() {
+		user.LastLoginAt = a.lastLoginAt
+		user.LastLoginIP = a.lastLoginIP
+	}
+}
+
+// loginActivity returns the activity of the user not saved yet, adding it if there is none,
+// and schedules saving it. Must be called with the activity lock held.
+func (u *Registry) loginActivity(username string) *loginActivity {
+	if u.pendingActivity == nil {
+		u.pendingActivity = make(map[string]*loginActivity)
+	}
+
+	if u.loginActivitySaveInterval > 0 && !u.activitySaveScheduled {
+		u.activitySaveScheduled = true
+		time.AfterFunc(u.loginActivitySaveInterval, func() {
+			u.activity.Lock()
+			u.activitySaveScheduled = false
+			u.activity.Unlock()
+
+			// errors are not reported, like in StartSweeper, the next save retries the activity added meanwhile
+			u.saveLoginActivity()
+		})
 	}
 
+	a, ok := u.pendingActivity[username]
 	if !ok {
-		return "", "", UnauthorizedError
+		a = &loginActivity{}
+		u.pendingActivity[username] = a
 	}
 
-	tkn := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": user.Username,
-		"roles":    user.Roles.String(),
-	})
+	return a
+}
 
-	refreshToken = uuid.New().String()
+// saveLoginActivity saves the login activity recorded since the last call.
+// The activity is informational, so it is dropped if it can not be saved.
+func (u *Registry) saveLoginActivity() error {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	u.activity.Lock()
+	pending := u.pendingActivity
+	u.pendingActivity = nil
+	u.activity.Unlock()
+
+	var firstErr error
 
-	u.refreshTokens[refreshToken] = user.Username
+	for username, a := range pending {
+		user, err := u.storage.Load(username)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error loading user: %w", err)
+			}
+			continue
+		}
 
-	token, err = tkn.SignedString([]byte(u.secret))
+		// deleted since
+		if user == nil {
+			continue
+		}
+
+		// other readers may hold the loaded user, so it is replaced rather than modified
+		updated := *user
+		a.apply(&updated)
+
+		err = u.storage.Save(&updated)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error saving user: %w", err)
+		}
+	}
+
+	return firstErr
+}
+
+// startSession issues an access token and the first refresh token of a new session of the authenticated user.
+func (u *Registry) startSession(user *User, client ClientInfo) (token string, refreshToken string, err error) {
+	token, err = u.accessToken(user)
 	if err != nil {
 		return "", "", err
 	}
 
+	refreshToken = uuid.New().String()
+	now := u.now()
+
+	err = u.refreshTokens.Save(&RefreshToken{
+		Token:           refreshToken,
+		Username:        user.Username,
+		Family:          uuid.New().String(),
+		AuthenticatedAt: now,
+		CreatedAt:       now,
+		ExpiresAt:       u.refreshTokenExpiry(now, now),
+		Client:          client.truncated(),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("error saving refresh token: %w", err)
+	}
+
 	return token, refreshToken, nil
 }
 
-func (u *Registry) Refresh(username, refreshToken string) (token string, err error) {
+// rehashPassword replaces an outdated password hash of the user with a hash of the configured hasher.
+// Failures are ignored, the old hash stays valid and the upgrade is retried on the next login.
+func (u *Registry) rehashPassword(username string, password string) {
+	if u.passwordHasher == nil {
+		return
+	}
 
-	_, ok := u.refreshTokens[refreshToken]
+	storage, ok := u.storage.(PasswordHashStorage)
 	if !ok {
-		return "", UnauthorizedError
+		return
+	}
+
+	hash, err := storage.PasswordHash(username)
+	if err != nil || hash == "" || !u.passwordHasher.NeedsRehash(hash) {
+		return
+	}
+
+	u.storage.SetPassword(username, password)
+}
+
+// Refresh issues a new access token and a new refresh token, replacing the presented refresh token.
+// Every refresh token can be used only once: if an already replaced token is presented again,
+// it was most likely stolen, so the whole session (all tokens of the family) is revoked.
+// Refresh fails if the refresh token was not used for longer than the idle timeout,
+// or if the session is older than the session lifetime.
+func (u *Registry) Refresh(username, refreshToken string) (token string, newRefreshToken string, err error) {
+	return u.RefreshWithClient(username, refreshToken, ClientInfo{})
+}
+
+// RefreshWithClient refreshes the session like Refresh, and records the client the new refresh token
+// is issued to, e.g. when the IP address of a mobile device changed (see Registry.ListSessions).
+// Empty client keeps the client of the presented token.
+func (u *Registry) RefreshWithClient(username, refreshToken string, client ClientInfo) (token string, newRefreshToken string, err error) {
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	u.refreshLock.Lock()
+	defer u.refreshLock.Unlock()
+
+	rt, err := u.refreshTokens.Load(refreshToken)
+	if err != nil {
+		return "", "", fmt.Errorf("error loading refresh token: %w", err)
+	}
+
+	if rt == nil {
+		return "", "", UnauthorizedError
+	}
+
+	if !rt.RotatedAt.IsZero() {
+		err = u.refreshTokens.DeleteFamily(rt.Family)
+		if err != nil {
+			return "", "", fmt.Errorf("error revoking refresh tokens: %w", err)
+		}
+		return "", "", UnauthorizedError
+	}
+
+	if rt.Username != username {
+		return "", "", UnauthorizedError
 	}
 
-	if u.refreshTokens[refreshToken] != username {
-		return "", UnauthorizedError
+	now := u.now()
+
+	// the settings might have changed since the token was issued
+	limit := u.refreshTokenExpiry(rt.AuthenticatedAt, rt.CreatedAt)
+
+	if rt.Expired(now) || (!limit.IsZero() && !now.Before(limit)) {
+		u.refreshTokens.DeleteFamily(rt.Family)
+		return "", "", UnauthorizedError
 	}
 
 	user, err := u.storage.Load(username)
 	if err != nil {
-		return "", fmt.Errorf("error loading user: %w", err)
+		return "", "", fmt.Errorf("error loading user: %w", err)
 	}
 
 	if user == nil {
-		return "", UnauthorizedError
+		return "", "", UnauthorizedError
 	}
 
 	if user.Blacklisted {
-		return "", UnauthorizedError
+		return "", "", UnauthorizedError
 	}
 
-	tkn := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": user.Username,
-		"roles":    user.Roles.String(),
-	})
+	if u.unverifiedEmail == RefuseUnverifiedEmail && !user.EmailVerified {
+		return "", "", EmailNotVerifiedError
+	}
+
+	token, err = u.accessToken(user)
+	if err != nil {
+		return "", "", err
+	}
+
+	newRefreshToken = uuid.New().String()
+	expiresAt := u.refreshTokenExpiry(rt.AuthenticatedAt, now)
 
-	token, err = tkn.SignedString([]byte(u.secret))
+	if client == (ClientInfo{}) {
+		client = rt.Client
+	}
+
+	err = u.refreshTokens.Save(&RefreshToken{
+		Token:           newRefreshToken,
+		Username:        rt.Username,
+		Family:          rt.Family,
+		AuthenticatedAt: rt.AuthenticatedAt,
+		CreatedAt:       now,
+		ExpiresAt:       expiresAt,
+		Client:          client.truncated(),
+	})
 	if err != nil {
-		return "", err
+		return "", "", fmt.Errorf("error saving refresh token: %w", err)
 	}
 
-	return token, nil
+	// the replaced token is kept as long as the session lives, to detect its reuse
+	rt.RotatedAt = now
+	rt.ExpiresAt = expiresAt
+
+	err = u.refreshTokens.Save(rt)
+	if err != nil {
+		return "", "", fmt.Errorf("error saving refresh token: %w", err)
+	}
 
+	return token, newRefreshToken, nil
 }
 
 func (u *Registry) Logout(username, refreshToken string) error {
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
 	user, err := u.storage.Load(username)
 
 	if err != nil {
@@ -142,15 +675,24 @@ func (u *Registry) Logout(username, refreshToken string) error {
 		return UnauthorizedError
 	}
 
-	if u.refreshTokens[refreshToken] != username {
+	rt, err := u.refreshTokens.Load(refreshToken)
+	if err != nil {
+		return fmt.Errorf("error loading refresh token: %w", err)
+	}
+
+	if rt == nil || rt.Username != username {
 		return UnauthorizedError
 	}
 
-	delete(u.refreshTokens, refreshToken)
-	return nil
+	return u.refreshTokens.DeleteFamily(rt.Family)
 }
 
 func (u *Registry) Blacklist(username string) error {
+	username = u.normalizeUsername(username)
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
 	user, err := u.storage.Load(username)
 	if err != nil {
 		return fmt.Errorf("error loading user: %w", err)
@@ -162,12 +704,22 @@ func (u *Registry) Blacklist(username string) error {
 
 	user.Blacklisted = true
 
-	return u.storage.Save(user)
+	err = u.storage.Save(user)
+	if err != nil {
+		return err
+	}
+
+	return u.revokeSessions(username)
 }
 
-func (u *Registry) Unblacklist(username string) error {
-	user, err := u.storage.Load(username)
+// Delete deletes the user and revokes all their sessions.
+func (u *Registry) Delete(username string) error {
+	username = u.normalizeUsername(username)
+
+	u.m.Lock()
+	defer u.m.Unlock()
 
+	user, err := u.storage.Load(username)
 	if err != nil {
 		return fmt.Errorf("error loading user: %w", err)
 	}
@@ -176,14 +728,72 @@ func (u *Registry) Unblacklist(username string) error {
 		return UnauthorizedError
 	}
 
-	user.Blacklisted = false
+	err = u.storage.Delete(username)
+	if err != nil {
+		return err
+	}
 
-	return u.storage.Save(user)
+	u.activity.Lock()
+	delete(u.pendingActivity, username)
+	u.activity.Unlock()
+
+	return u.revokeSessions(username)
 }
 
-func (u *Registry) SetRoles(username string, roles ...string) error {
+// LogoutAll logs the user out of every session by revoking all their refresh tokens.
+// Access tokens already issued stay valid until they expire, unless the Registry has a
+// revocation list (see WithRevocationList).
+func (u *Registry) LogoutAll(username string) error {
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
 	user, err := u.storage.Load(username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil {
+		return UnauthorizedError
+	}
+
+	return u.revokeSessions(username)
+}
+
+// ChangePassword changes the password of the user, who has to know the old one.
+// All sessions of the user are revoked, so the user has to login again with the new password.
+// It returns a *PolicyError if the new password does not meet the password policy (see WithPasswordPolicy).
+func (u *Registry) ChangePassword(username string, oldPassword string, newPassword string) error {
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	defer u.lockUser(username)()
+
+	user, err := u.authenticate(username, oldPassword, ClientInfo{})
+	if err != nil {
+		return err
+	}
 
+	u.passwordSucceeded(user)
+
+	return u.setPassword(username, newPassword)
+}
+
+// ResetPassword sets a new password of the user without knowing the old one, e.g. by an admin.
+// All sessions of the user are revoked.
+// It returns a *PolicyError if the new password does not meet the password policy (see WithPasswordPolicy).
+func (u *Registry) ResetPassword(username string, newPassword string) error {
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	defer u.lockUser(username)()
+
+	user, err := u.storage.Load(username)
 	if err != nil {
 		return fmt.Errorf("error loading user: %w", err)
 	}
@@ -192,10 +802,584 @@ func (u *Registry) SetRoles(username string, roles ...string) error {
 		return UnauthorizedError
 	}
 
-	if user.Roles.HasAny(RoleAdmin) {
-		return errors.New("admin role can't be removed")
+	return u.setPassword(username, newPassword)
+}
+
+// RequestPasswordReset sends a single-use password reset token to the user through the notifier
+// (see WithNotifier). The token expires after the password reset TTL (see WithPasswordResetTTL),
+// and replaces the tokens sent before. Requests within the cooldown after the previous one are ignored
+// (see WithPasswordResetCooldown).
+// To not reveal which users exist, it returns no error if the user is missing or blacklisted.
+func (u *Registry) RequestPasswordReset(username string) error {
+	if u.notifier == nil {
+		return errors.New("notifier not configured")
 	}
 
-	user.Roles.Add(roles...)
-	return u.storage.Save(user)
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil || user.Blacklisted || !u.allowPasswordReset(username) {
+		return nil
+	}
+
+	err = u.oneTimeTokens.DeleteUser(username, TokenPurposePasswordReset)
+	if err != nil {
+		return fmt.Errorf("error deleting reset tokens: %w", err)
+	}
+
+	return u.sendOneTimeToken(user, TokenPurposePasswordReset, u.passwordResetTTL)
+}
+
+// allowPasswordReset checks and records a password reset request of the user, which is allowed
+// if the cooldown after the previous request passed.
+func (u *Registry) allowPasswordReset(username string) bool {
+	u.resetLock.Lock()
+	defer u.resetLock.Unlock()
+
+	now := u.now()
+	if last, ok := u.resetRequests[username]; ok && now.Sub(last) < u.passwordResetCooldown {
+		return false
+	}
+
+	if u.resetRequests == nil {
+		u.resetRequests = make(map[string]time.Time)
+	}
+	u.resetRequests[username] = now
+
+	return true
+}
+
+// CompletePasswordReset sets a new password of the user the reset token was issued to (see RequestPasswordReset),
+// and revokes all their sessions. The token can be used only once.
+// It returns a *PolicyError if the new password does not meet the password policy, the token stays valid then.
+func (u *Registry) CompletePasswordReset(token string, newPassword string) error {
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	t, err := u.loadOneTimeToken(token, TokenPurposePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	defer u.lockUser(t.Username)()
+
+	// the token is loaded again, since a concurrent reset might have used it
+	t, err = u.loadOneTimeToken(token, TokenPurposePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	user, err := u.storage.Load(t.Username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil || user.Blacklisted {
+		u.oneTimeTokens.Delete(t.Token)
+		return UnauthorizedError
+	}
+
+	err = u.setPassword(t.Username, newPassword)
+	if err != nil {
+		return err
+	}
+
+	err = u.oneTimeTokens.Delete(t.Token)
+	if err != nil {
+		return fmt.Errorf("error deleting reset token: %w", err)
+	}
+
+	return nil
+}
+
+// SetEmail sets the email address of the user, and sends a verification token to it through
+// the notifier (see VerifyEmail). The address is unverified until then.
+// Empty email removes the address of the user.
+// It returns a *PolicyError if the address is not valid.
+func (u *Registry) SetEmail(username string, email string) error {
+	username = u.normalizeUsername(username)
+
+	if email != "" {
+		err := u.validateEmail(email)
+		if err != nil {
+			return err
+		}
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil {
+		return UnauthorizedError
+	}
+
+	if email != "" && u.notifier == nil {
+		return errors.New("notifier not configured")
+	}
+
+	user.Email = email
+	user.EmailVerified = false
+
+	err = u.storage.Save(user)
+	if err != nil {
+		return err
+	}
+
+	if email == "" {
+		return nil
+	}
+
+	return u.sendOneTimeToken(user, TokenPurposeEmailVerification, u.emailVerificationTTL)
+}
+
+// RequestEmailVerification sends a new verification token to the email address of the user,
+// e.g. when the previous one expired. To not reveal which users exist, it returns no error
+// if the user is missing, blacklisted, has no email address or it is already verified.
+func (u *Registry) RequestEmailVerification(username string) error {
+	if u.notifier == nil {
+		return errors.New("notifier not configured")
+	}
+
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil || user.Blacklisted || user.Email == "" || user.EmailVerified {
+		return nil
+	}
+
+	return u.sendOneTimeToken(user, TokenPurposeEmailVerification, u.emailVerificationTTL)
+}
+
+// VerifyEmail marks the email address of the user the verification token was sent to as verified.
+// The token can be used only once, and is not valid anymore if the address changed since it was sent.
+func (u *Registry) VerifyEmail(token string) error {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	t, err := u.loadOneTimeToken(token, TokenPurposeEmailVerification)
+	if err != nil {
+		return err
+	}
+
+	err = u.oneTimeTokens.Delete(t.Token)
+	if err != nil {
+		return fmt.Errorf("error deleting verification token: %w", err)
+	}
+
+	user, err := u.storage.Load(t.Username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil || user.Email != t.Email {
+		return UnauthorizedError
+	}
+
+	user.EmailVerified = true
+
+	return u.storage.Save(user)
+}
+
+// validateEmail checks that the email is a plain address, without a display name.
+func (u *Registry) validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" || strings.ContainsAny(email, "\r\n") {
+		return &PolicyError{Field: "email", Violations: []PolicyViolation{{Code: "invalid", Message: "must be a valid email address"}}}
+	}
+	return nil
+}
+
+// sendOneTimeToken issues a one-time token for the purpose, and sends it to the user.
+func (u *Registry) sendOneTimeToken(user *User, purpose string, ttl time.Duration) error {
+	if u.notifier == nil {
+		return errors.New("notifier not configured")
+	}
+
+	token, expiresAt, err := u.issueOneTimeToken(user, purpose, ttl)
+	if err != nil {
+		return err
+	}
+
+	err = u.notifier.Notify(&Notification{
+		Purpose:   purpose,
+		Username:  user.Username,
+		Email:     user.Email,
+		Token:     token,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return fmt.Errorf("error sending notification: %w", err)
+	}
+
+	return nil
+}
+
+// issueOneTimeToken issues a one-time token for the purpose. Only the hash of the token is stored.
+func (u *Registry) issueOneTimeToken(user *User, purpose string, ttl time.Duration) (token string, expiresAt time.Time, err error) {
+	token = uuid.New().String()
+	expiresAt = u.now().Add(ttl)
+
+	err = u.oneTimeTokens.Save(&OneTimeToken{
+		Token:     hashToken(token),
+		Purpose:   purpose,
+		Username:  user.Username,
+		Email:     user.Email,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error saving token: %w", err)
+	}
+
+	return token, expiresAt, nil
+}
+
+// loadOneTimeToken loads a one-time token presented by the user. It returns UnauthorizedError
+// if the token is unknown, expired or issued for another purpose.
+func (u *Registry) loadOneTimeToken(token string, purpose string) (*OneTimeToken, error) {
+	t, err := u.oneTimeTokens.Load(hashToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("error loading token: %w", err)
+	}
+
+	if t == nil || t.Purpose != purpose {
+		return nil, UnauthorizedError
+	}
+
+	if t.Expired(u.now()) {
+		u.oneTimeTokens.Delete(t.Token)
+		return nil, UnauthorizedError
+	}
+
+	return t, nil
+}
+
+// setPassword validates and sets the password, and revokes all sessions and password reset tokens of the user.
+// Must be called with the write lock, or the read lock and the lock of the user held.
+func (u *Registry) setPassword(username string, password string) error {
+	err := u.validatePassword(username, password)
+	if err != nil {
+		return err
+	}
+
+	err = u.storage.SetPassword(username, password)
+	if err != nil {
+		return fmt.Errorf("error setting password: %w", err)
+	}
+
+	err = u.oneTimeTokens.DeleteUser(username, TokenPurposePasswordReset)
+	if err != nil {
+		return fmt.Errorf("error deleting reset tokens: %w", err)
+	}
+
+	return u.revokeSessions(username)
+}
+
+// revokeSessions revokes all refresh tokens of the user, and all access tokens issued so far
+// if the Registry has a revocation list.
+func (u *Registry) revokeSessions(username string) error {
+	u.refreshLock.Lock()
+	defer u.refreshLock.Unlock()
+
+	if u.revocations != nil {
+		now := u.now()
+		u.revocations.RevokeUser(username, now, now.Add(u.accessTokenTTL))
+	}
+
+	err := u.refreshTokens.DeleteUser(username)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh tokens: %w", err)
+	}
+
+	return nil
+}
+
+func (u *Registry) Unblacklist(username string) error {
+	username = u.normalizeUsername(username)
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	user, err := u.storage.Load(username)
+
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil {
+		return UnauthorizedError
+	}
+
+	user.Blacklisted = false
+
+	return u.storage.Save(user)
+}
+
+// ClearLoginLockout clears failed logins and the lockout of the user (see WithLoginLimiter),
+// e.g. by an admin after the user was locked out by someone guessing the password.
+func (u *Registry) ClearLoginLockout(username string) error {
+	username = u.normalizeUsername(username)
+
+	if u.loginLimiter == nil {
+		return errors.New("login limiter not configured")
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	u.loginLimiter.Unlock(username)
+
+	u.activity.Lock()
+	if a, ok := u.pendingActivity[username]; ok {
+		a.failures = 0
+	}
+	u.activity.Unlock()
+
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil || user.FailedLogins == 0 {
+		return nil
+	}
+
+	updated := *user
+	updated.FailedLogins = 0
+
+	return u.storage.Save(&updated)
+}
+
+func (u *Registry) SetRoles(username string, roles ...string) error {
+	username = u.normalizeUsername(username)
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	user, err := u.storage.Load(username)
+
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil {
+		return UnauthorizedError
+	}
+
+	if user.Roles.HasAny(RoleAdmin) {
+		return errors.New("admin role can't be removed")
+	}
+
+	user.Roles.Add(roles...)
+	return u.storage.Save(user)
+}
+
+// refreshTokenExpiry computes the expiration time of a refresh token issued at createdAt,
+// in a session started at authenticatedAt. Zero time means the token does not expire.
+func (u *Registry) refreshTokenExpiry(authenticatedAt, createdAt time.Time) time.Time {
+	var expiresAt time.Time
+
+	if authenticatedAt.IsZero() {
+		authenticatedAt = createdAt
+	}
+
+	if u.refreshTokenIdleTimeout > 0 {
+		expiresAt = createdAt.Add(u.refreshTokenIdleTimeout)
+	}
+
+	if u.sessionLifetime > 0 {
+		end := authenticatedAt.Add(u.sessionLifetime)
+		if expiresAt.IsZero() || end.Before(expiresAt) {
+			expiresAt = end
+		}
+	}
+
+	return expiresAt
+}
+
+// Sweep saves the login activity of users (see User.LastLoginAt), compacts the Storage if it implements
+// CompactingStorage, and deletes expired refresh tokens from the RefreshTokenStore, expired one-time tokens,
+// forgotten failed logins and password reset requests.
+func (u *Registry) Sweep() error {
+	err := u.saveLoginActivity()
+	if err != nil {
+		return fmt.Errorf("error saving login activity: %w", err)
+	}
+
+	if storage, ok := u.storage.(CompactingStorage); ok {
+		err = storage.Compact()
+		if err != nil {
+			return fmt.Errorf("error compacting storage: %w", err)
+		}
+	}
+
+	if u.revocations != nil {
+		u.revocations.Prune(u.now())
+	}
+
+	if u.loginLimiter != nil {
+		u.loginLimiter.Prune(u.now())
+	}
+
+	u.pruneResetRequests()
+
+	err = u.oneTimeTokens.DeleteExpired(u.now())
+	if err != nil {
+		return fmt.Errorf("error deleting expired one-time tokens: %w", err)
+	}
+
+	return u.refreshTokens.DeleteExpired(u.now())
+}
+
+// pruneResetRequests removes password reset requests older than the cooldown.
+func (u *Registry) pruneResetRequests() {
+	u.resetLock.Lock()
+	defer u.resetLock.Unlock()
+
+	now := u.now()
+	for username, last := range u.resetRequests {
+		if now.Sub(last) >= u.passwordResetCooldown {
+			delete(u.resetRequests, username)
+		}
+	}
+}
+
+// RevokeAccessToken revokes an access token issued by the Registry, so Middleware using the
+// revocation list of the Registry rejects it before it expires.
+func (u *Registry) RevokeAccessToken(token string) error {
+	if u.revocations == nil {
+		return errors.New("revocation list not configured")
+	}
+
+	claims := jwt.MapClaims{}
+
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		key, _ := u.keys.VerificationKey(kid)
+		if key == nil || token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unknown key: %s", kid)
+		}
+
+		return key.key, nil
+	}, jwt.WithoutClaimsValidation())
+
+	if err != nil {
+		return UnauthorizedError
+	}
+
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
+		return errors.New("token can not be revoked")
+	}
+
+	u.revocations.RevokeToken(jti, exp.Time)
+	return nil
+}
+
+// RevocationList returns the revocation list of the Registry, nil if it has none.
+func (u *Registry) RevocationList() *RevocationList {
+	return u.revocations
+}
+
+// StartSweeper calls Sweep every interval in the background, until the returned stop function is called.
+// The stop function saves the login activity recorded since the last sweep, e.g. on shutdown.
+func (u *Registry) StartSweeper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				u.Sweep()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			u.saveLoginActivity()
+		})
+	}
+}
+
+// accessToken issues a signed access token for the user.
+func (u *Registry) accessToken(user *User) (string, error) {
+	now := u.now()
+
+	roles := user.Roles.String()
+	if u.unverifiedEmail == StripRolesUnverifiedEmail && !user.EmailVerified {
+		roles = ""
+	}
+
+	claims := jwt.MapClaims{
+		"username": user.Username,
+		"roles":    roles,
+		"sub":      user.Username,
+		"iat":      jwt.NewNumericDate(now),
+		"nbf":      jwt.NewNumericDate(now),
+		"exp":      jwt.NewNumericDate(now.Add(u.accessTokenTTL)),
+		"jti":      uuid.New().String(),
+	}
+
+	if user.Email != "" {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+
+	if u.issuer != "" {
+		claims["iss"] = u.issuer
+	}
+
+	switch len(u.audience) {
+	case 0:
+	case 1:
+		claims["aud"] = u.audience[0]
+	default:
+		claims["aud"] = u.audience
+	}
+
+	return u.keys.Active().sign(claims)
+}
+
+// JWKS returns the public keys verifying tokens issued by the Registry as a JSON Web Key Set.
+// It contains every key of the key ring that is not retired yet.
+// HMAC secrets are never published, so the set is empty for a Registry created with NewRegistry.
+func (u *Registry) JWKS() *JWKS {
+	set := &JWKS{Keys: []JWK{}}
+
+	for _, key := range u.keys.VerificationKeys() {
+		jwk, err := key.JWK()
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
 }
@@ -1,24 +1,37 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"hash/fnv"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 var secret = "test_secret"
 
 type mockStorage struct {
+	m         *sync.Mutex
 	storage   map[string]*User
 	passwords map[string]string
+	totp      map[string]*TOTP
+	webAuthn  map[string][]*WebAuthnCredential
 }
 
 func (m mockStorage) Save(u *User) error {
+	m.m.Lock()
+	defer m.m.Unlock()
 	m.storage[u.Username] = u
 	return nil
 }
 
 func (m mockStorage) Load(username string) (*User, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
 	u, ok := m.storage[username]
 	if !ok {
 		return nil, nil
@@ -27,12 +40,18 @@ func (m mockStorage) Load(username string) (*User, error) {
 }
 
 func (m mockStorage) Delete(username string) error {
+	m.m.Lock()
+	defer m.m.Unlock()
 	delete(m.storage, username)
 	delete(m.passwords, username)
+	delete(m.totp, username)
+	delete(m.webAuthn, username)
 	return nil
 }
 
 func (m mockStorage) SetPassword(username string, password string) error {
+	m.m.Lock()
+	defer m.m.Unlock()
 	_, ok := m.storage[username]
 	if !ok {
 		return nil
@@ -42,6 +61,8 @@ func (m mockStorage) SetPassword(username string, password string) error {
 }
 
 func (m mockStorage) ValidatePassword(username string, password string) (bool, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
 	_, ok := m.storage[username]
 	if !ok {
 		return false, nil
@@ -53,10 +74,66 @@ func (m mockStorage) ValidatePassword(username string, password string) (bool, e
 	return p == password, nil
 }
 
+func (m mockStorage) SaveTOTP(username string, t *TOTP) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if t == nil {
+		delete(m.totp, username)
+		return nil
+	}
+	m.totp[username] = copyTOTP(t)
+	return nil
+}
+
+func (m mockStorage) LoadTOTP(username string) (*TOTP, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return copyTOTP(m.totp[username]), nil
+}
+
+func (m mockStorage) SaveWebAuthnCredential(username string, c *WebAuthnCredential) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	credentials := []*WebAuthnCredential{copyWebAuthnCredential(c)}
+	for _, existing := range m.webAuthn[username] {
+		if string(existing.ID) != string(c.ID) {
+			credentials = append(credentials, existing)
+		}
+	}
+	m.webAuthn[username] = credentials
+	return nil
+}
+
+func (m mockStorage) LoadWebAuthnCredentials(username string) ([]*WebAuthnCredential, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	var credentials []*WebAuthnCredential
+	for _, c := range m.webAuthn[username] {
+		credentials = append(credentials, copyWebAuthnCredential(c))
+	}
+	return credentials, nil
+}
+
+func (m mockStorage) WebAuthnCredentialUser(id []byte) (string, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	for username, credentials := range m.webAuthn {
+		for _, c := range credentials {
+			if string(c.ID) == string(id) {
+				return username, nil
+			}
+		}
+	}
+	return "", nil
+}
+
 func newMockStorage() *mockStorage {
 	return &mockStorage{
+		m:         &sync.Mutex{},
 		passwords: make(map[string]string),
 		storage:   make(map[string]*User),
+		totp:      make(map[string]*TOTP),
+		webAuthn:  make(map[string][]*WebAuthnCredential),
 	}
 }
 
@@ -84,6 +161,33 @@ func TestUsers_RegisterDuplicate(t *testing.T) {
 
 }
 
+// failingPasswordStorage fails to set passwords, like a hasher refusing the password.
+type failingPasswordStorage struct {
+	Storage
+}
+
+func (s failingPasswordStorage) SetPassword(username string, password string) error {
+	return errors.New("password refused")
+}
+
+func TestUsers_RegisterPasswordFailure(t *testing.T) {
+	storage := newMockStorage()
+	users := NewRegistry(failingPasswordStorage{Storage: storage}, secret)
+
+	if users.Register("user1", "password1") == nil {
+		t.Fatal("registering user without password succeeded")
+	}
+
+	if user, _ := storage.Load("user1"); user != nil {
+		t.Error("user without password stored")
+	}
+
+	err := NewRegistry(storage, secret).Register("user1", "password1")
+	if err != nil {
+		t.Errorf("registering user again failed: %v", err)
+	}
+}
+
 func TestUsers_Login(t *testing.T) {
 	users := NewRegistry(newMockStorage(), secret)
 
@@ -147,7 +251,7 @@ func TestUsers_Refresh(t *testing.T) {
 		t.Error("login failed")
 	}
 
-	token, err := users.Refresh("user1", refreshToken)
+	token, newRefreshToken, err := users.Refresh("user1", refreshToken)
 	if err != nil {
 		t.Error("refresh failed")
 	}
@@ -155,6 +259,10 @@ func TestUsers_Refresh(t *testing.T) {
 	if token == "" {
 		t.Error("token is empty")
 	}
+
+	if newRefreshToken == "" || newRefreshToken == refreshToken {
+		t.Error("refresh token not rotated")
+	}
 }
 
 func TestUsers_RefreshWrongRefreshToken(t *testing.T) {
@@ -170,7 +278,7 @@ func TestUsers_RefreshWrongRefreshToken(t *testing.T) {
 		t.Error("login failed")
 	}
 
-	_, err = users.Refresh("user1", "wrong refresh token")
+	_, _, err = users.Refresh("user1", "wrong refresh token")
 	if err == nil {
 		t.Error("refresh succeeded with wrong refresh token")
 	}
@@ -193,7 +301,7 @@ func TestUsers_RefreshWrongUsername(t *testing.T) {
 
 	ms.Delete("user1")
 
-	_, err = users.Refresh("user1", refreshToken)
+	_, _, err = users.Refresh("user1", refreshToken)
 	if err == nil {
 		t.Error("refresh succeeded with wrong username")
 	}
@@ -217,7 +325,7 @@ func TestUsers_Blacklist(t *testing.T) {
 		t.Error("blacklist failed")
 	}
 
-	_, err = users.Refresh("user1", refreshToken)
+	_, _, err = users.Refresh("user1", refreshToken)
 	if err == nil {
 		t.Error("refresh succeeded with blacklisted refresh token")
 	}
@@ -241,7 +349,7 @@ func TestUsers_BlacklistWrongUsername(t *testing.T) {
 		t.Error("blacklist succeeded with wrong username")
 	}
 
-	_, err = users.Refresh("user1", refreshToken)
+	_, _, err = users.Refresh("user1", refreshToken)
 	if err != nil {
 		t.Error("refresh failed")
 	}
@@ -313,3 +421,1092 @@ func TestAuthRequired_AuthCorrect(t *testing.T) {
 		t.Error("Authorization failed")
 	}
 }
+
+func TestUsers_LoginClaims(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret, WithIssuer("auth.example.com"), WithAudience("api"), WithAccessTokenTTL(time.Minute))
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Error("registering user failed")
+	}
+
+	token, _, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	})
+	if err != nil {
+		t.Fatalf("error parsing token: %v", err)
+	}
+
+	for _, claim := range []string{"exp", "iat", "nbf", "jti", "sub"} {
+		if claims[claim] == nil {
+			t.Errorf("claim %s missing", claim)
+		}
+	}
+
+	if claims["iss"] != "auth.example.com" {
+		t.Errorf("unexpected issuer %v", claims["iss"])
+	}
+
+	if claims["aud"] != "api" {
+		t.Errorf("unexpected audience %v", claims["aud"])
+	}
+
+	exp, _ := claims.GetExpirationTime()
+	iat, _ := claims.GetIssuedAt()
+	if exp.Sub(iat.Time) != time.Minute {
+		t.Errorf("unexpected token lifetime %v", exp.Sub(iat.Time))
+	}
+}
+
+func TestAuthRequired_Expired(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	users.now = func() time.Time {
+		return time.Now().Add(-DefaultAccessTokenTTL - time.Minute)
+	}
+
+	token, _, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	if code := serveWithToken(NewMiddleware(secret), token); code != http.StatusUnauthorized {
+		t.Error("expired token accepted")
+	}
+
+	if code := serveWithToken(NewMiddleware(secret, WithLeeway(2*time.Minute)), token); code != http.StatusOK {
+		t.Error("token within leeway rejected")
+	}
+}
+
+func TestAuthRequired_NoExpiration(t *testing.T) {
+	token, err := NewHMACKey(secret).sign(jwt.MapClaims{
+		"username": "user1",
+		"roles":    "admin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := serveWithToken(NewMiddleware(secret), token); code != http.StatusUnauthorized {
+		t.Error("token without expiration accepted")
+	}
+}
+
+func TestAuthRequired_IssuerAudience(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret, WithIssuer("auth.example.com"), WithAudience("api", "admin-ui"))
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	token, _, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	if code := serveWithToken(NewMiddleware(secret, RequireIssuer("auth.example.com"), RequireAudience("admin-ui")), token); code != http.StatusOK {
+		t.Error("token with expected issuer and audience rejected")
+	}
+
+	if code := serveWithToken(NewMiddleware(secret, RequireIssuer("evil.example.com")), token); code != http.StatusUnauthorized {
+		t.Error("token with wrong issuer accepted")
+	}
+
+	if code := serveWithToken(NewMiddleware(secret, RequireAudience("billing")), token); code != http.StatusUnauthorized {
+		t.Error("token with wrong audience accepted")
+	}
+}
+
+// TestRegistry_Concurrent is meant to be run with the race detector: go test -race
+func TestRegistry_Concurrent(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	const workers = 16
+	const iterations = 50
+
+	for i := 0; i < workers; i++ {
+		err := users.Register(fmt.Sprintf("user%d", i), "password")
+		if err != nil {
+			t.Fatal("registering user failed")
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, workers*iterations)
+
+	for i := 0; i < workers; i++ {
+		username := fmt.Sprintf("user%d", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				_, refreshToken, err := users.Login(username, "password")
+				if err != nil {
+					errs <- fmt.Errorf("login failed: %w", err)
+					continue
+				}
+
+				_, refreshToken, err = users.Refresh(username, refreshToken)
+				if err != nil {
+					errs <- fmt.Errorf("refresh failed: %w", err)
+					continue
+				}
+
+				err = users.Logout(username, refreshToken)
+				if err != nil {
+					errs <- fmt.Errorf("logout failed: %w", err)
+				}
+			}
+		}()
+
+		// admin operations on the same users
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				users.SetRoles(username, fmt.Sprintf("role%d", j))
+				users.Unblacklist(username)
+				users.Register(username, "password")
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRegistry_ConcurrentRegister(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	const workers = 32
+
+	wg := sync.WaitGroup{}
+	registered := make(chan bool, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			registered <- users.Register("user1", "password1") == nil
+		}()
+	}
+
+	wg.Wait()
+	close(registered)
+
+	count := 0
+	for ok := range registered {
+		if ok {
+			count++
+		}
+	}
+
+	if count != 1 {
+		t.Errorf("user registered %d times", count)
+	}
+}
+
+// blockingStorage blocks setting the password of a user, like a slow password hash.
+type blockingStorage struct {
+	Storage
+	username string
+	entered  chan struct{}
+	release  chan struct{}
+}
+
+func (s *blockingStorage) SetPassword(username string, password string) error {
+	if username == s.username {
+		close(s.entered)
+		<-s.release
+	}
+	return s.Storage.SetPassword(username, password)
+}
+
+func TestRegistry_PasswordHashingDoesNotBlock(t *testing.T) {
+	storage := &blockingStorage{Storage: newMockStorage(), entered: make(chan struct{}), release: make(chan struct{})}
+	users := NewRegistry(storage, secret)
+
+	users.Register("slow", "password1")
+	storage.username = "slow"
+
+	// another user not sharing the lock of the slow one
+	other := ""
+	for i := 0; other == ""; i++ {
+		name := fmt.Sprintf("user%d", i)
+		if userLockIndex(name) != userLockIndex("slow") {
+			other = name
+		}
+	}
+	users.Register(other, "password1")
+
+	changed := make(chan error)
+	go func() {
+		changed <- users.ChangePassword("slow", "password1", "password2")
+	}()
+	<-storage.entered
+
+	done := make(chan error)
+	go func() {
+		_, refreshToken, err := users.Login(other, "password1")
+		if err == nil {
+			_, _, err = users.Refresh(other, refreshToken)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("error logging in: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("login of another user blocked by password change")
+	}
+
+	close(storage.release)
+	if err := <-changed; err != nil {
+		t.Errorf("error changing password: %v", err)
+	}
+}
+
+// userLockIndex returns the index of the lock of the user, see Registry.lockUser.
+func userLockIndex(username string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return h.Sum32() % userLockCount
+}
+
+func TestUsers_RefreshRotation(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Error("registering user failed")
+	}
+
+	_, refreshToken1, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	_, refreshToken2, err := users.Refresh("user1", refreshToken1)
+	if err != nil {
+		t.Fatal("refresh failed")
+	}
+
+	_, refreshToken3, err := users.Refresh("user1", refreshToken2)
+	if err != nil {
+		t.Fatal("refresh with rotated token failed")
+	}
+
+	// another session of the same user is not affected by reuse detection
+	_, otherSession, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	// the first token was stolen and is replayed: the whole family is revoked
+	_, _, err = users.Refresh("user1", refreshToken1)
+	if err != UnauthorizedError {
+		t.Error("refresh succeeded with already used refresh token")
+	}
+
+	_, _, err = users.Refresh("user1", refreshToken3)
+	if err != UnauthorizedError {
+		t.Error("refresh succeeded after reuse was detected")
+	}
+
+	_, _, err = users.Refresh("user1", otherSession)
+	if err != nil {
+		t.Error("refresh of another session failed")
+	}
+}
+
+func TestUsers_LogoutRevokesFamily(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Error("registering user failed")
+	}
+
+	_, refreshToken1, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	_, refreshToken2, err := users.Refresh("user1", refreshToken1)
+	if err != nil {
+		t.Fatal("refresh failed")
+	}
+
+	err = users.Logout("user1", refreshToken2)
+	if err != nil {
+		t.Fatal("logout failed")
+	}
+
+	rt, _ := users.refreshTokens.Load(refreshToken1)
+	if rt != nil {
+		t.Error("rotated refresh token kept after logout")
+	}
+}
+
+// clock is a manually advanced time source for tests.
+type clock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestUsers_RefreshIdleTimeout(t *testing.T) {
+	c := &clock{now: time.Now()}
+
+	users := NewRegistry(newMockStorage(), secret, WithRefreshTokenIdleTimeout(time.Hour), WithSessionLifetime(0))
+	users.now = c.Now
+	users.Register("user1", "password1")
+
+	_, refreshToken, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	// an active session is extended by every refresh
+	for i := 0; i < 5; i++ {
+		c.Advance(50 * time.Minute)
+
+		_, refreshToken, err = users.Refresh("user1", refreshToken)
+		if err != nil {
+			t.Fatalf("refresh %d of active session failed", i)
+		}
+	}
+
+	c.Advance(61 * time.Minute)
+
+	_, _, err = users.Refresh("user1", refreshToken)
+	if err != UnauthorizedError {
+		t.Error("refresh succeeded after idle timeout")
+	}
+}
+
+func TestUsers_RefreshSessionLifetime(t *testing.T) {
+	c := &clock{now: time.Now()}
+
+	users := NewRegistry(newMockStorage(), secret, WithRefreshTokenIdleTimeout(time.Hour), WithSessionLifetime(3*time.Hour))
+	users.now = c.Now
+	users.Register("user1", "password1")
+
+	_, refreshToken, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	for i := 0; i < 5; i++ {
+		c.Advance(50 * time.Minute)
+
+		_, refreshToken, err = users.Refresh("user1", refreshToken)
+		if i < 3 && err != nil {
+			t.Fatalf("refresh %d within session lifetime failed", i)
+		}
+		if i >= 3 && err != UnauthorizedError {
+			t.Fatalf("refresh %d after session lifetime succeeded", i)
+		}
+	}
+}
+
+func TestUsers_RefreshNoExpiry(t *testing.T) {
+	c := &clock{now: time.Now()}
+
+	users := NewRegistry(newMockStorage(), secret, WithRefreshTokenIdleTimeout(0), WithSessionLifetime(0))
+	users.now = c.Now
+	users.Register("user1", "password1")
+
+	_, refreshToken, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	c.Advance(10 * 365 * 24 * time.Hour)
+
+	_, _, err = users.Refresh("user1", refreshToken)
+	if err != nil {
+		t.Error("refresh of non-expiring session failed")
+	}
+}
+
+func TestUsers_Sweep(t *testing.T) {
+	c := &clock{now: time.Now()}
+
+	store := NewMemoryRefreshTokenStore()
+
+	users := NewRegistry(newMockStorage(), secret, WithRefreshTokenStore(store), WithRefreshTokenIdleTimeout(time.Hour))
+	users.now = c.Now
+	users.Register("user1", "password1")
+
+	for i := 0; i < 10; i++ {
+		_, _, err := users.Login("user1", "password1")
+		if err != nil {
+			t.Fatal("login failed")
+		}
+	}
+
+	c.Advance(30 * time.Minute)
+
+	_, active, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	c.Advance(31 * time.Minute)
+
+	err = users.Sweep()
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+
+	if len(store.tokens) != 1 {
+		t.Errorf("expected 1 token after sweep, got %d", len(store.tokens))
+	}
+
+	_, _, err = users.Refresh("user1", active)
+	if err != nil {
+		t.Error("refresh of active session failed after sweep")
+	}
+}
+
+func TestUsers_BlacklistRevokesSessions(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Error("registering user failed")
+	}
+
+	_, refreshToken, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	err = users.Blacklist("user1")
+	if err != nil {
+		t.Fatal("blacklist failed")
+	}
+
+	err = users.Unblacklist("user1")
+	if err != nil {
+		t.Fatal("unblacklist failed")
+	}
+
+	_, _, err = users.Refresh("user1", refreshToken)
+	if err == nil {
+		t.Error("refresh token survived blacklisting")
+	}
+}
+
+func TestUsers_DeleteRevokesSessions(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Error("registering user failed")
+	}
+
+	_, refreshToken, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	err = users.Delete("user1")
+	if err != nil {
+		t.Fatal("delete failed")
+	}
+
+	// a new user with the same name must not inherit the sessions
+	err = users.Register("user1", "password2")
+	if err != nil {
+		t.Error("registering user failed")
+	}
+
+	_, _, err = users.Refresh("user1", refreshToken)
+	if err == nil {
+		t.Error("refresh token survived deletion of the user")
+	}
+
+	err = users.Delete("user2")
+	if err == nil {
+		t.Error("deleting unknown user succeeded")
+	}
+}
+
+func TestUsers_LogoutAll(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	users.Register("user1", "password1")
+	users.Register("user2", "password2")
+
+	tokens := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		_, refreshToken, err := users.Login("user1", "password1")
+		if err != nil {
+			t.Fatal("login failed")
+		}
+		tokens = append(tokens, refreshToken)
+	}
+
+	_, otherUser, err := users.Login("user2", "password2")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	err = users.LogoutAll("user1")
+	if err != nil {
+		t.Fatal("logout all failed")
+	}
+
+	for _, refreshToken := range tokens {
+		_, _, err = users.Refresh("user1", refreshToken)
+		if err == nil {
+			t.Error("refresh succeeded after logout all")
+		}
+	}
+
+	_, _, err = users.Refresh("user2", otherUser)
+	if err != nil {
+		t.Error("session of another user revoked")
+	}
+
+	_, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Error("login after logout all failed")
+	}
+}
+
+func TestUsers_ChangePassword(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Error("registering user failed")
+	}
+
+	_, refreshToken, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	err = users.ChangePassword("user1", "wrong password", "new password")
+	if err != UnauthorizedError {
+		t.Errorf("password changed with wrong old password: %v", err)
+	}
+
+	err = users.ChangePassword("missing", "password1", "new password")
+	if err != UnauthorizedError {
+		t.Errorf("password of missing user changed: %v", err)
+	}
+
+	if v := policyViolations(users.ChangePassword("user1", "password1", "short")); len(v) != 1 || v[0] != "too_short" {
+		t.Errorf("expected too short password, got %v", v)
+	}
+
+	err = users.ChangePassword("user1", "password1", "new password")
+	if err != nil {
+		t.Fatalf("change password failed: %v", err)
+	}
+
+	if _, _, err = users.Login("user1", "password1"); err == nil {
+		t.Error("login with old password succeeded")
+	}
+
+	if _, _, err = users.Login("user1", "new password"); err != nil {
+		t.Error("login with new password failed")
+	}
+
+	if _, _, err = users.Refresh("user1", refreshToken); err == nil {
+		t.Error("refresh token survived password change")
+	}
+}
+
+func TestUsers_ResetPassword(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Error("registering user failed")
+	}
+
+	_, refreshToken, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	if users.ResetPassword("missing", "new password") == nil {
+		t.Error("password of missing user reset")
+	}
+
+	if policyViolations(users.ResetPassword("user1", "short")) == nil {
+		t.Error("password policy not enforced on reset")
+	}
+
+	err = users.ResetPassword("user1", "new password")
+	if err != nil {
+		t.Fatalf("reset password failed: %v", err)
+	}
+
+	if _, _, err = users.Login("user1", "new password"); err != nil {
+		t.Error("login with new password failed")
+	}
+
+	if _, _, err = users.Refresh("user1", refreshToken); err == nil {
+		t.Error("refresh token survived password reset")
+	}
+}
+
+func TestUsers_PasswordReset(t *testing.T) {
+	notifier := &recordingNotifier{}
+	users := NewRegistry(newMockStorage(), secret, WithNotifier(notifier))
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Error("registering user failed")
+	}
+
+	_, refreshToken, err := users.Login("user1", "password1")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	err = users.RequestPasswordReset("missing")
+	if err != nil || notifier.last() != nil {
+		t.Errorf("password reset of missing user failed or notified: %v", err)
+	}
+
+	err = users.RequestPasswordReset("user1")
+	if err != nil {
+		t.Fatalf("password reset request failed: %v", err)
+	}
+
+	n := notifier.last()
+	if n == nil || n.Username != "user1" || n.Purpose != TokenPurposePasswordReset || n.Token == "" {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+
+	if t2, _ := users.oneTimeTokens.Load(n.Token); t2 != nil {
+		t.Error("one-time token stored in plain text")
+	}
+
+	if users.CompletePasswordReset("wrong token", "new password") != UnauthorizedError {
+		t.Error("password reset with wrong token succeeded")
+	}
+
+	if policyViolations(users.CompletePasswordReset(n.Token, "short")) == nil {
+		t.Error("password policy not enforced on reset")
+	}
+
+	err = users.CompletePasswordReset(n.Token, "new password")
+	if err != nil {
+		t.Fatalf("password reset failed: %v", err)
+	}
+
+	if users.CompletePasswordReset(n.Token, "other password") != UnauthorizedError {
+		t.Error("password reset token used twice")
+	}
+
+	if _, _, err = users.Login("user1", "new password"); err != nil {
+		t.Error("login with new password failed")
+	}
+
+	if _, _, err = users.Refresh("user1", refreshToken); err == nil {
+		t.Error("refresh token survived password reset")
+	}
+
+	if NewRegistry(newMockStorage(), secret).RequestPasswordReset("user1") == nil {
+		t.Error("password reset requested without notifier")
+	}
+}
+
+func TestUsers_PasswordResetExpired(t *testing.T) {
+	c := &clock{now: time.Now()}
+	notifier := &recordingNotifier{}
+	users := NewRegistry(newMockStorage(), secret, WithNotifier(notifier), WithPasswordResetTTL(time.Minute))
+	users.now = c.Now
+
+	users.Register("user1", "password1")
+
+	err := users.RequestPasswordReset("user1")
+	if err != nil {
+		t.Fatalf("password reset request failed: %v", err)
+	}
+
+	c.Advance(time.Minute)
+
+	if users.CompletePasswordReset(notifier.last().Token, "new password") != UnauthorizedError {
+		t.Error("expired password reset token accepted")
+	}
+
+	users.RequestPasswordReset("user1")
+	c.Advance(time.Minute)
+
+	err = users.Sweep()
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+
+	if len(users.oneTimeTokens.(*MemoryOneTimeTokenStore).tokens) != 0 {
+		t.Error("expired one-time tokens not swept")
+	}
+
+	users.RequestPasswordReset("user1")
+	users.Blacklist("user1")
+
+	if users.CompletePasswordReset(notifier.last().Token, "new password") != UnauthorizedError {
+		t.Error("password of blacklisted user reset")
+	}
+}
+
+func TestUsers_PasswordResetTokensRevoked(t *testing.T) {
+	c := &clock{now: time.Now()}
+	notifier := &recordingNotifier{}
+	users := NewRegistry(newMockStorage(), secret, WithNotifier(notifier))
+	users.now = c.Now
+
+	users.Register("user1", "password1")
+
+	users.RequestPasswordReset("user1")
+	first := notifier.last()
+
+	// requests within the cooldown are ignored
+	users.RequestPasswordReset("user1")
+	if notifier.last() != first {
+		t.Error("password reset requested within the cooldown")
+	}
+
+	c.Advance(DefaultPasswordResetCooldown)
+	users.RequestPasswordReset("user1")
+	second := notifier.last()
+
+	if second == first {
+		t.Fatal("password reset not requested after the cooldown")
+	}
+
+	if users.CompletePasswordReset(first.Token, "new password") != UnauthorizedError {
+		t.Error("replaced password reset token accepted")
+	}
+
+	err := users.ChangePassword("user1", "password1", "password2")
+	if err != nil {
+		t.Fatalf("change password failed: %v", err)
+	}
+
+	if users.CompletePasswordReset(second.Token, "new password") != UnauthorizedError {
+		t.Error("password reset token issued before password change accepted")
+	}
+
+	c.Advance(DefaultPasswordResetCooldown)
+	users.RequestPasswordReset("user1")
+
+	err = users.ResetPassword("user1", "password3")
+	if err != nil {
+		t.Fatalf("reset password failed: %v", err)
+	}
+
+	if users.CompletePasswordReset(notifier.last().Token, "new password") != UnauthorizedError {
+		t.Error("password reset token issued before admin reset accepted")
+	}
+
+	c.Advance(DefaultPasswordResetCooldown)
+	users.Sweep()
+	if len(users.resetRequests) != 0 {
+		t.Error("password reset requests not swept")
+	}
+}
+
+func TestUsers_EmailVerification(t *testing.T) {
+	notifier := &recordingNotifier{}
+	users := NewRegistry(newMockStorage(), secret, WithNotifier(notifier))
+
+	if v := policyViolations(users.RegisterWithEmail("user1", "password1", "Alice <alice@example.com>")); len(v) != 1 || v[0] != "invalid" {
+		t.Errorf("expected invalid email, got %v", v)
+	}
+
+	err := users.RegisterWithEmail("user1", "password1", "alice@example.com")
+	if err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	n := notifier.last()
+	if n == nil || n.Purpose != TokenPurposeEmailVerification || n.Email != "alice@example.com" || n.Username != "user1" {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+
+	if users.CompletePasswordReset(n.Token, "new password") != UnauthorizedError {
+		t.Error("verification token used for password reset")
+	}
+
+	err = users.VerifyEmail(n.Token)
+	if err != nil {
+		t.Fatalf("verification failed: %v", err)
+	}
+
+	user, _ := users.storage.Load("user1")
+	if !user.EmailVerified {
+		t.Error("email not verified")
+	}
+
+	if users.VerifyEmail(n.Token) != UnauthorizedError {
+		t.Error("verification token used twice")
+	}
+
+	err = users.SetEmail("user1", "bob@example.com")
+	if err != nil {
+		t.Fatalf("set email failed: %v", err)
+	}
+
+	if user, _ := users.storage.Load("user1"); user.Email != "bob@example.com" || user.EmailVerified {
+		t.Error("changed email still verified")
+	}
+
+	stale := notifier.last()
+
+	err = users.SetEmail("user1", "carol@example.com")
+	if err != nil {
+		t.Fatalf("set email failed: %v", err)
+	}
+
+	if users.VerifyEmail(stale.Token) != UnauthorizedError {
+		t.Error("token verified another email address")
+	}
+
+	users.RequestEmailVerification("user1")
+
+	if n = notifier.last(); n.Email != "carol@example.com" {
+		t.Errorf("verification sent to %s", n.Email)
+	}
+
+	if users.VerifyEmail(n.Token) != nil {
+		t.Error("verification failed")
+	}
+
+	count := len(notifier.notifications)
+	users.RequestEmailVerification("user1")
+	users.RequestEmailVerification("missing")
+
+	if len(notifier.notifications) != count {
+		t.Error("verification sent for verified email or missing user")
+	}
+}
+
+func TestUsers_UnverifiedEmailPolicy(t *testing.T) {
+	notifier := &recordingNotifier{}
+
+	users := NewRegistry(newMockStorage(), secret, WithNotifier(notifier), WithUnverifiedEmailPolicy(RefuseUnverifiedEmail))
+	users.RegisterWithEmail("user1", "password1", "alice@example.com")
+
+	_, _, err := users.Login("user1", "password1")
+	if err != EmailNotVerifiedError {
+		t.Errorf("expected unverified email error, got %v", err)
+	}
+
+	_, _, err = users.Login("user1", "wrong password")
+	if err != UnauthorizedError {
+		t.Errorf("unverified email revealed with wrong password: %v", err)
+	}
+
+	users.VerifyEmail(notifier.last().Token)
+
+	_, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Errorf("login with verified email failed: %v", err)
+	}
+
+	users = NewRegistry(newMockStorage(), secret, WithNotifier(notifier), WithUnverifiedEmailPolicy(StripRolesUnverifiedEmail))
+	users.RegisterWithEmail("user1", "password1", "alice@example.com")
+	users.SetRoles("user1", "user")
+
+	m := NewMiddleware(secret)
+
+	if code := serveWithToken(m, loginToken(t, users)); code == http.StatusOK {
+		t.Error("roles granted with unverified email")
+	}
+
+	users.VerifyEmail(notifier.last().Token)
+
+	if code := serveWithToken(m, loginToken(t, users)); code != http.StatusOK {
+		t.Errorf("roles not granted with verified email, status %d", code)
+	}
+}
+
+func TestUsers_LoginActivity(t *testing.T) {
+	c := &clock{now: time.Now()}
+	users := NewRegistry(newMockStorage(), secret)
+	users.now = c.Now
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		c.Advance(time.Minute)
+		users.LoginWithClient("user1", "password2", ClientInfo{IP: "192.0.2.2"})
+	}
+
+	if user, _ := users.storage.Load("user1"); user.FailedLogins != 0 {
+		t.Error("failures saved before the sweep")
+	}
+
+	err = users.Sweep()
+	if err != nil {
+		t.Fatalf("error sweeping: %v", err)
+	}
+
+	user, _ := users.storage.Load("user1")
+	if user.FailedLogins != 2 || !user.LastFailedLoginAt.Equal(c.Now()) || !user.LastLoginAt.IsZero() {
+		t.Errorf("failures not recorded: %+v", user)
+	}
+
+	c.Advance(time.Minute)
+	_, _, err = users.LoginWithClient("user1", "password1", ClientInfo{IP: "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	// one more failure after the login
+	c.Advance(time.Minute)
+	users.LoginWithClient("user1", "password2", ClientInfo{IP: "192.0.2.2"})
+
+	stop := users.StartSweeper(time.Hour)
+	stop()
+
+	user, _ = users.storage.Load("user1")
+	if user.FailedLogins != 1 || !user.LastLoginAt.Equal(c.Now().Add(-time.Minute)) || user.LastLoginIP != "192.0.2.1" ||
+		!user.LastFailedLoginAt.Equal(c.Now()) {
+		t.Errorf("login not recorded: %+v", user)
+	}
+
+	users.Login("unknown", "password1")
+	users.Sweep()
+	if user, _ := users.storage.Load("unknown"); user != nil {
+		t.Error("failed login of unknown user created the user")
+	}
+}
+
+func TestUsers_LoginActivitySaveInterval(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret, WithLoginActivitySaveInterval(10*time.Millisecond))
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	users.Login("user1", "password2")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		user, _ := users.storage.Load("user1")
+		if user.FailedLogins == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("failures not saved after the interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// tracingStorage records the calls made to the wrapped storage.
+type tracingStorage struct {
+	Storage
+	m     sync.Mutex
+	calls []string
+}
+
+func (s *tracingStorage) Load(username string) (*User, error) {
+	s.m.Lock()
+	s.calls = append(s.calls, "Load")
+	s.m.Unlock()
+	return s.Storage.Load(username)
+}
+
+func (s *tracingStorage) ValidatePassword(username string, password string) (bool, error) {
+	s.m.Lock()
+	s.calls = append(s.calls, "ValidatePassword")
+	s.m.Unlock()
+	return s.Storage.ValidatePassword(username, password)
+}
+
+func (s *tracingStorage) Save(u *User) error {
+	s.m.Lock()
+	s.calls = append(s.calls, "Save")
+	s.m.Unlock()
+	return s.Storage.Save(u)
+}
+
+func (s *tracingStorage) trace(f func()) string {
+	s.m.Lock()
+	s.calls = nil
+	s.m.Unlock()
+
+	f()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	return fmt.Sprint(s.calls)
+}
+
+func TestUsers_LoginFailuresEquivalent(t *testing.T) {
+	storage := &tracingStorage{Storage: newMockStorage()}
+	users := NewRegistry(storage, secret)
+
+	users.Register("user1", "password1")
+	users.Register("blacklisted", "password1")
+	users.Blacklist("blacklisted")
+
+	success := storage.trace(func() {
+		_, _, err := users.Login("user1", "password1")
+		if err != nil {
+			t.Error("login failed")
+		}
+	})
+
+	failures := map[string][2]string{
+		"unknown user":     {"unknown", "password1"},
+		"blacklisted user": {"blacklisted", "password1"},
+		"wrong password":   {"user1", "password2"},
+	}
+
+	for name, credentials := range failures {
+		trace := storage.trace(func() {
+			_, _, err := users.Login(credentials[0], credentials[1])
+			if err != UnauthorizedError {
+				t.Errorf("%s: expected UnauthorizedError, got %v", name, err)
+			}
+		})
+
+		if trace != success {
+			t.Errorf("%s: storage calls %s differ from successful login %s", name, trace, success)
+		}
+	}
+}
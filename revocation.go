@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RevocationChecker tells Middleware whether an access token was revoked before it expired.
+type RevocationChecker interface {
+	// Revoked checks if the token with the given ID ("jti" claim), issued to the user at issuedAt
+	// ("iat" claim), was revoked. jti is empty and issuedAt is zero if the token has no such claims.
+	Revoked(jti string, username string, issuedAt time.Time) (bool, error)
+}
+
+// RevokedToken is a single revoked access token.
+type RevokedToken struct {
+	// ID is the "jti" claim of the token.
+	ID string `json:"jti"`
+	// ExpiresAt is the expiration time of the token, after which it does not need to be listed anymore.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RevokedUser revokes all access tokens of a user issued before the second of RevokedAt,
+// e.g. when the user is blacklisted or logged out of all sessions.
+type RevokedUser struct {
+	// Username is the user whose tokens are revoked.
+	Username string `json:"username"`
+	// RevokedAt is the time of revocation. Tokens issued later are not affected. "iat" has a precision of a second,
+	// so tokens issued within the second of revocation are not affected either, e.g. the token of the login
+	// right after a password change.
+	RevokedAt time.Time `json:"revoked_at"`
+	// ExpiresAt is the time all revoked tokens are expired, after which the entry is not needed anymore.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RevocationList is an in-memory list of revoked access tokens.
+// Registry adds entries to it (see WithRevocationList), and the list can be shared with a
+// Middleware in the same process directly, or with other servers through server.RevocationListHandler
+// and NewRevocationListURL. RevocationList is safe for concurrent use.
+type RevocationList struct {
+	m      sync.RWMutex
+	tokens map[string]RevokedToken
+	users  map[string]RevokedUser
+}
+
+// revocationListData is the JSON representation of a RevocationList.
+type revocationListData struct {
+	Tokens []RevokedToken `json:"tokens"`
+	Users  []RevokedUser  `json:"users"`
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		tokens: make(map[string]RevokedToken),
+		users:  make(map[string]RevokedUser),
+	}
+}
+
+// RevokeToken revokes a single access token until it expires.
+func (l *RevocationList) RevokeToken(jti string, expiresAt time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.tokens[jti] = RevokedToken{ID: jti, ExpiresAt: expiresAt}
+}
+
+// RevokeUser revokes all access tokens of the user issued before the second of revokedAt.
+// expiresAt is the time all these tokens are expired.
+func (l *RevocationList) RevokeUser(username string, revokedAt time.Time, expiresAt time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.users[username] = RevokedUser{Username: username, RevokedAt: revokedAt, ExpiresAt: expiresAt}
+}
+
+func (l *RevocationList) Revoked(jti string, username string, issuedAt time.Time) (bool, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	if _, ok := l.tokens[jti]; ok && jti != "" {
+		return true, nil
+	}
+
+	u, ok := l.users[username]
+	if !ok {
+		return false, nil
+	}
+
+	return issuedAt.IsZero() || issuedAt.Before(u.RevokedAt.Truncate(time.Second)), nil
+}
+
+// Prune removes entries of tokens expired at the given time.
+func (l *RevocationList) Prune(now time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for k, t := range l.tokens {
+		if !now.Before(t.ExpiresAt) {
+			delete(l.tokens, k)
+		}
+	}
+
+	for k, u := range l.users {
+		if !now.Before(u.ExpiresAt) {
+			delete(l.users, k)
+		}
+	}
+}
+
+func (l *RevocationList) MarshalJSON() ([]byte, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	data := revocationListData{
+		Tokens: make([]RevokedToken, 0, len(l.tokens)),
+		Users:  make([]RevokedUser, 0, len(l.users)),
+	}
+
+	for _, t := range l.tokens {
+		data.Tokens = append(data.Tokens, t)
+	}
+
+	for _, u := range l.users {
+		data.Users = append(data.Users, u)
+	}
+
+	return json.Marshal(&data)
+}
+
+func (l *RevocationList) UnmarshalJSON(b []byte) error {
+	data := revocationListData{}
+	err := json.Unmarshal(b, &data)
+	if err != nil {
+		return err
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.tokens = make(map[string]RevokedToken, len(data.Tokens))
+	for _, t := range data.Tokens {
+		l.tokens[t.ID] = t
+	}
+
+	l.users = make(map[string]RevokedUser, len(data.Users))
+	for _, u := range data.Users {
+		l.users[u.Username] = u
+	}
+
+	return nil
+}
+
+// DefaultRevocationFeedMaxAge is how long RevocationFeed uses the loaded list before reloading it.
+const DefaultRevocationFeedMaxAge = 30 * time.Second
+
+// revocationFeedRetryInterval is the time RevocationFeed waits before retrying the first failed reload.
+const revocationFeedRetryInterval = time.Second
+
+// RevocationFeed loads a revocation list published by the authentication server
+// (see server.RevocationListHandler) or stored in a file, and reloads it when it gets older than MaxAge.
+// A token is rejected at most MaxAge after its revocation, as long as the list can be reloaded.
+// If a reload fails, the last loaded list stays in use, so an outage of the list does not reject
+// all tokens. Failed reloads are retried after a second, doubling up to MaxAge.
+// Only one request reloads the list at a time, the others keep using the loaded list meanwhile.
+type RevocationFeed struct {
+	MaxAge time.Duration
+
+	load func() ([]byte, error)
+
+	m      sync.Mutex
+	list   *RevocationList
+	loaded time.Time
+
+	// loading is set while a reload is running
+	loading bool
+	// failures counts the reloads failed since the last successful one, retryAt is the time of the next attempt
+	failures int
+	retryAt  time.Time
+}
+
+// NewRevocationListFile creates a revocation feed that reads the list from a file.
+func NewRevocationListFile(path string) (*RevocationFeed, error) {
+	return newRevocationFeed(fileLoader(path))
+}
+
+// NewRevocationListURL creates a revocation feed that fetches the list from a URL.
+// If client is nil, a client with a timeout of 10 seconds is used.
+func NewRevocationListURL(url string, client *http.Client) (*RevocationFeed, error) {
+	return newRevocationFeed(urlLoader(url, client))
+}
+
+func newRevocationFeed(load func() ([]byte, error)) (*RevocationFeed, error) {
+	f := &RevocationFeed{
+		MaxAge: DefaultRevocationFeedMaxAge,
+		load:   load,
+	}
+
+	err := f.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RevocationFeed) Revoked(jti string, username string, issuedAt time.Time) (bool, error) {
+	f.m.Lock()
+	list, loaded := f.list, f.loaded
+	f.m.Unlock()
+
+	if time.Since(loaded) > f.MaxAge {
+		if reloaded, ok := f.retry(); ok {
+			list = reloaded
+		}
+	}
+
+	return list.Revoked(jti, username, issuedAt)
+}
+
+// retry reloads the list, unless another reload is running or a failed reload is backing off.
+// It returns the list and true if it was reloaded. The list is loaded without holding the lock,
+// so a slow feed does not block requests using the loaded list.
+func (f *RevocationFeed) retry() (*RevocationList, bool) {
+	f.m.Lock()
+	if f.loading || time.Now().Before(f.retryAt) {
+		f.m.Unlock()
+		return nil, false
+	}
+	f.loading = true
+	f.m.Unlock()
+
+	list, err := f.fetch()
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.loading = false
+
+	if err != nil {
+		f.retryAt = time.Now().Add(retryBackoff(revocationFeedRetryInterval, f.MaxAge, f.failures))
+		f.failures++
+		return nil, false
+	}
+
+	f.list = list
+	f.loaded = time.Now()
+	f.failures = 0
+	f.retryAt = time.Time{}
+
+	return list, true
+}
+
+// refresh reloads the list before the feed is shared.
+func (f *RevocationFeed) refresh() error {
+	list, err := f.fetch()
+	if err != nil {
+		return err
+	}
+
+	f.list = list
+	f.loaded = time.Now()
+
+	return nil
+}
+
+// fetch loads and parses the list.
+func (f *RevocationFeed) fetch() (*RevocationList, error) {
+	data, err := f.load()
+	if err != nil {
+		return nil, fmt.Errorf("error loading revocation list: %w", err)
+	}
+
+	list := NewRevocationList()
+	err = json.Unmarshal(data, list)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling revocation list: %w", err)
+	}
+
+	return list, nil
+}
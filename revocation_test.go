@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const REVOCATION_FILE = ".local/revocations.json"
+
+func TestRevocationList_Blacklist(t *testing.T) {
+	c := &clock{now: time.Now().Add(-time.Minute)}
+
+	list := NewRevocationList()
+
+	users := NewRegistry(newMockStorage(), secret, WithRevocationList(list))
+	users.now = c.Now
+	users.Register("user1", "password1")
+	users.Register("user2", "password2")
+	users.SetRoles("user1", "user")
+	users.SetRoles("user2", "user")
+
+	m := NewMiddleware(secret, WithRevocationChecker(list))
+
+	token := loginToken(t, users)
+
+	other, _, err := users.Login("user2", "password2")
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	if code := serveWithToken(m, token); code != http.StatusOK {
+		t.Fatalf("token rejected before revocation, status %d", code)
+	}
+
+	c.Advance(time.Second)
+
+	err = users.Blacklist("user1")
+	if err != nil {
+		t.Fatal("blacklist failed")
+	}
+
+	if code := serveWithToken(m, token); code != http.StatusUnauthorized {
+		t.Error("token of blacklisted user accepted")
+	}
+
+	if code := serveWithToken(m, other); code != http.StatusOK {
+		t.Error("token of another user rejected")
+	}
+
+	c.Advance(5 * time.Second)
+
+	err = users.Unblacklist("user1")
+	if err != nil {
+		t.Fatal("unblacklist failed")
+	}
+
+	if code := serveWithToken(m, loginToken(t, users)); code != http.StatusOK {
+		t.Error("token issued after revocation rejected")
+	}
+}
+
+func TestRevocationList_RevokeAccessToken(t *testing.T) {
+	list := NewRevocationList()
+
+	users := NewRegistry(newMockStorage(), secret, WithRevocationList(list))
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	m := NewMiddleware(secret, WithRevocationChecker(list))
+
+	stolen := loginToken(t, users)
+	token := loginToken(t, users)
+
+	err := users.RevokeAccessToken(stolen)
+	if err != nil {
+		t.Fatalf("revocation failed: %v", err)
+	}
+
+	if code := serveWithToken(m, stolen); code != http.StatusUnauthorized {
+		t.Error("revoked token accepted")
+	}
+
+	if code := serveWithToken(m, token); code != http.StatusOK {
+		t.Error("another token of the same user rejected")
+	}
+
+	forged, err := NewHMACKey("other secret").sign(jwt.MapClaims{"jti": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if users.RevokeAccessToken(forged) == nil {
+		t.Error("token signed with unknown key revoked")
+	}
+
+	if NewRegistry(newMockStorage(), secret).RevokeAccessToken(token) == nil {
+		t.Error("revocation succeeded without revocation list")
+	}
+}
+
+func TestRevocationList_IssuedAtPrecision(t *testing.T) {
+	revokedAt := time.Now().Truncate(time.Second).Add(500 * time.Millisecond)
+
+	list := NewRevocationList()
+	list.RevokeUser("user1", revokedAt, revokedAt.Add(time.Hour))
+
+	for _, test := range []struct {
+		name     string
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{"issued a second before", revokedAt.Add(-time.Second).Truncate(time.Second), true},
+		{"issued within the second", revokedAt.Truncate(time.Second), false},
+		{"issued after", revokedAt.Add(time.Second).Truncate(time.Second), false},
+		{"issued at unknown time", time.Time{}, true},
+	} {
+		if revoked, _ := list.Revoked("", "user1", test.issuedAt); revoked != test.revoked {
+			t.Errorf("%s: expected revoked %v, got %v", test.name, test.revoked, revoked)
+		}
+	}
+}
+
+func TestRevocationList_Prune(t *testing.T) {
+	list := NewRevocationList()
+	now := time.Now()
+
+	list.RevokeToken("t1", now.Add(-time.Second))
+	list.RevokeToken("t2", now.Add(time.Minute))
+	list.RevokeUser("user1", now.Add(-time.Hour), now.Add(-time.Second))
+
+	list.Prune(now)
+
+	if len(list.tokens) != 1 || len(list.users) != 0 {
+		t.Errorf("unexpected list after prune: %d tokens, %d users", len(list.tokens), len(list.users))
+	}
+}
+
+func TestRevocationFeed_URL(t *testing.T) {
+	list := NewRevocationList()
+
+	users := NewRegistry(newMockStorage(), secret, WithRevocationList(list))
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(users.RevocationList())
+	}))
+	defer srv.Close()
+
+	feed, err := NewRevocationListURL(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("error loading revocation list: %v", err)
+	}
+
+	m := NewMiddleware(secret, WithRevocationChecker(feed))
+
+	token := loginToken(t, users)
+
+	if code := serveWithToken(m, token); code != http.StatusOK {
+		t.Fatalf("token rejected before revocation, status %d", code)
+	}
+
+	users.RevokeAccessToken(token)
+
+	if code := serveWithToken(m, token); code != http.StatusOK {
+		t.Error("revocation list reloaded before MaxAge")
+	}
+
+	feed.MaxAge = 0
+
+	if code := serveWithToken(m, token); code != http.StatusUnauthorized {
+		t.Error("revoked token accepted after reload")
+	}
+}
+
+func TestRevocationFeed_File(t *testing.T) {
+	c := &clock{now: time.Now().Add(-time.Minute)}
+
+	list := NewRevocationList()
+
+	users := NewRegistry(newMockStorage(), secret, WithRevocationList(list))
+	users.now = c.Now
+	users.Register("user1", "password1")
+	users.SetRoles("user1", "user")
+
+	token := loginToken(t, users)
+	c.Advance(time.Second)
+	users.LogoutAll("user1")
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(REVOCATION_FILE, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed, err := NewRevocationListFile(REVOCATION_FILE)
+	if err != nil {
+		t.Fatalf("error loading revocation list: %v", err)
+	}
+
+	if code := serveWithToken(NewMiddleware(secret, WithRevocationChecker(feed)), token); code != http.StatusUnauthorized {
+		t.Error("token of logged out user accepted")
+	}
+
+	// the list can not be reloaded, the last loaded one stays in use
+	os.Remove(REVOCATION_FILE)
+	feed.MaxAge = time.Minute
+	feed.loaded = time.Now().Add(-2 * time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if code := serveWithToken(NewMiddleware(secret, WithRevocationChecker(feed)), token); code != http.StatusUnauthorized {
+			t.Errorf("token of logged out user accepted after failed reload, status %d", code)
+		}
+	}
+
+	if feed.failures != 1 || !feed.retryAt.After(time.Now()) {
+		t.Errorf("failed reload not backed off: %d failures, retry at %v", feed.failures, feed.retryAt)
+	}
+
+	os.WriteFile(REVOCATION_FILE, []byte(`{"tokens":[],"users":[]}`), 0600)
+	feed.retryAt = time.Now()
+
+	if code := serveWithToken(NewMiddleware(secret, WithRevocationChecker(feed)), token); code != http.StatusOK {
+		t.Errorf("revocation list not reloaded after recovery, status %d", code)
+	}
+}
+
+func TestRevocationFeed_SlowReload(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	blocking := false
+
+	feed, err := newRevocationFeed(func() ([]byte, error) {
+		if blocking {
+			entered <- struct{}{}
+			<-release
+		}
+		return []byte(`{"tokens":[{"jti":"t1","expires_at":"2100-01-01T00:00:00Z"}],"users":[]}`), nil
+	})
+	if err != nil {
+		t.Fatalf("error loading revocation list: %v", err)
+	}
+
+	blocking = true
+	feed.MaxAge = 0
+
+	go feed.Revoked("t1", "user1", time.Now())
+	<-entered
+
+	// the reload is running, other requests use the loaded list without waiting for it
+	done := make(chan bool)
+	go func() {
+		revoked, _ := feed.Revoked("t1", "user1", time.Now())
+		done <- revoked
+	}()
+
+	select {
+	case revoked := <-done:
+		if !revoked {
+			t.Error("loaded list not used during reload")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request blocked by the reload")
+	}
+
+	close(release)
+}
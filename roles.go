@@ -64,12 +64,17 @@ func (r *roleSet) HasAll(roles ...string) bool {
 func (r *roleSet) String() string {
 	r.m.RLock()
 	defer r.m.RUnlock()
-	return strings.Join(r.List(), ",")
+	return strings.Join(r.list(), ",")
 }
 
 func (r *roleSet) List() []string {
 	r.m.RLock()
 	defer r.m.RUnlock()
+	return r.list()
+}
+
+// list must be called with the lock held: recursive read locking deadlocks with a waiting writer.
+func (r *roleSet) list() []string {
 	result := make([]string, 0, len(r.d))
 	for k, v := range r.d {
 		if !v {
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"sync"
+)
+
+// DefaultMaxPending is the number of requests RequestPasswordResetHandler and RequestEmailVerificationHandler
+// process in the background at once, if their MaxPending is zero.
+const DefaultMaxPending = 16
+
+// background runs functions in the background, at most a limited number at once.
+type background struct {
+	once  sync.Once
+	slots chan struct{}
+}
+
+// run runs f in the background and returns true, unless max functions (DefaultMaxPending if not positive)
+// are running already.
+func (b *background) run(max int, f func()) bool {
+	b.once.Do(func() {
+		if max <= 0 {
+			max = DefaultMaxPending
+		}
+		b.slots = make(chan struct{}, max)
+	})
+
+	select {
+	case b.slots <- struct{}{}:
+	default:
+		return false
+	}
+
+	go func() {
+		defer func() { <-b.slots }()
+		f()
+	}()
+
+	return true
+}
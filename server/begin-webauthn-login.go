@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// BeginWebAuthnLoginHandler starts a login of the user with a passkey.
+// It responds with the options for navigator.credentials.get, for missing users and users without passkeys too
+// (see auth.Registry.BeginWebAuthnLogin), or with 429 Too Many Requests if logins of the user are throttled.
+type BeginWebAuthnLoginHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *BeginWebAuthnLoginHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type BeginWebAuthnLoginRequest struct {
+		Username string `json:"username"`
+	}
+
+	r := &BeginWebAuthnLoginRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Username == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, username required"))
+		return
+	}
+
+	options, err := h.Registry.BeginWebAuthnLoginWithClient(r.Username, clientInfo(request))
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(options)
+}
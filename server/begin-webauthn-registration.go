@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// BeginWebAuthnRegistrationHandler starts the registration of a passkey of the user, who has to send
+// the password. It responds with the options for navigator.credentials.create.
+type BeginWebAuthnRegistrationHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *BeginWebAuthnRegistrationHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type BeginWebAuthnRegistrationRequest struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	r := &BeginWebAuthnRegistrationRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Username == "" || r.Password == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, username and password required"))
+		return
+	}
+
+	options, err := h.Registry.BeginWebAuthnRegistration(r.Username, r.Password)
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(options)
+}
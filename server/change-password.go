@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// ChangePasswordHandler changes the password of the user, who has to send the old one.
+// All other sessions of the user are revoked, and the client receives new tokens (or a challenge token,
+// if the user enabled two-factor authentication).
+type ChangePasswordHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *ChangePasswordHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type ChangePasswordRequest struct {
+		Username    string `json:"username"`
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+
+	r := &ChangePasswordRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Username == "" || r.OldPassword == "" || r.NewPassword == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, username, old and new password required"))
+		return
+	}
+
+	err = h.Registry.ChangePassword(r.Username, r.OldPassword, r.NewPassword)
+	if writePolicyError(writer, err) {
+		return
+	}
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	accessToken, refreshToken, err := h.Registry.LoginWithClient(r.Username, r.NewPassword, clientInfo(request))
+	if writeMFARequired(writer, err) {
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Authorization", "Bearer "+accessToken)
+
+	type ChangePasswordResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(&ChangePasswordResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	})
+}
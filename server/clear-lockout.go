@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// ClearLockoutHandler clears failed logins and the lockout of the user.
+// It is an admin handler and should be protected with auth.Middleware.
+type ClearLockoutHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *ClearLockoutHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type ClearLockoutRequest struct {
+		Username string `json:"username"`
+	}
+
+	r := &ClearLockoutRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Username == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, username required"))
+		return
+	}
+
+	err = h.Registry.ClearLoginLockout(r.Username)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("{}"))
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"github.com/live-labs/auth"
+	"net"
+	"net/http"
+)
+
+// clientInfo describes the client sending the request.
+// The IP address is taken from the connection, proxy headers are only trusted through TrustedProxies,
+// which replaces the address of the connection.
+func clientInfo(request *http.Request) auth.ClientInfo {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+
+	return auth.ClientInfo{
+		IP:        ip,
+		UserAgent: request.UserAgent(),
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// CompletePasswordResetHandler sets a new password of the user, who presents a password reset token
+// (see RequestPasswordResetHandler). All sessions of the user are revoked.
+type CompletePasswordResetHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *CompletePasswordResetHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type CompletePasswordResetRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	r := &CompletePasswordResetRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Token == "" || r.Password == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, token and password required"))
+		return
+	}
+
+	err = h.Registry.CompletePasswordReset(r.Token, r.Password)
+	if writePolicyError(writer, err) {
+		return
+	}
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("{}"))
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// ConfirmTOTPHandler enables two-factor authentication of the user, who has to send a code from
+// the authenticator. It responds with the recovery codes, which are shown only once.
+type ConfirmTOTPHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *ConfirmTOTPHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type ConfirmTOTPRequest struct {
+		Username string `json:"username"`
+		Code     string `json:"code"`
+	}
+
+	r := &ConfirmTOTPRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Username == "" || r.Code == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, username and code required"))
+		return
+	}
+
+	recoveryCodes, err := h.Registry.ConfirmTOTP(r.Username, r.Code)
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+
+	type ConfirmTOTPResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(&ConfirmTOTPResponse{
+		RecoveryCodes: recoveryCodes,
+	})
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// EnrollTOTPHandler starts the TOTP enrollment of the user, who has to send the password.
+// It responds with the secret and the provisioning URI to be shown as a QR code.
+// The enrollment has to be confirmed with ConfirmTOTPHandler.
+type EnrollTOTPHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *EnrollTOTPHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type EnrollTOTPRequest struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	r := &EnrollTOTPRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Username == "" || r.Password == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, username and password required"))
+		return
+	}
+
+	secret, uri, err := h.Registry.EnrollTOTP(r.Username, r.Password)
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusConflict)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+
+	type EnrollTOTPResponse struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(&EnrollTOTPResponse{
+		Secret: secret,
+		URI:    uri,
+	})
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// FinishWebAuthnLoginHandler logs in the user with the assertion returned by navigator.credentials.get.
+// The client sends the assertion serialized with PublicKeyCredential.toJSON.
+type FinishWebAuthnLoginHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *FinishWebAuthnLoginHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	r := &auth.WebAuthnResponse{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.ID == "" || r.Response.ClientDataJSON == "" || r.Response.AuthenticatorData == "" || r.Response.Signature == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, credential id, client data, authenticator data and signature required"))
+		return
+	}
+
+	accessToken, refreshToken, err := h.Registry.FinishWebAuthnLogin(r, clientInfo(request))
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, auth.EmailNotVerifiedError) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Authorization", "Bearer "+accessToken)
+
+	type FinishWebAuthnLoginResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(&FinishWebAuthnLoginResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// FinishWebAuthnRegistrationHandler adds the passkey created by navigator.credentials.create to the user.
+// The client sends the credential serialized with PublicKeyCredential.toJSON.
+type FinishWebAuthnRegistrationHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *FinishWebAuthnRegistrationHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	r := &auth.WebAuthnResponse{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.ID == "" || r.Response.ClientDataJSON == "" || r.Response.AttestationObject == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, credential id, client data and attestation object required"))
+		return
+	}
+
+	err = h.Registry.FinishWebAuthnRegistration(r)
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("{}"))
+}
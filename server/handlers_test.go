@@ -0,0 +1,553 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/live-labs/auth"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRegistry creates a Registry storing users in a temporary directory, and registers user1.
+func newTestRegistry(t *testing.T, opts ...auth.RegistryOption) *auth.Registry {
+	storage, err := auth.NewSimpleFileStorage(filepath.Join(t.TempDir(), "users.dat"), "salt")
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	registry := auth.NewRegistry(storage, SECRET, opts...)
+
+	err = registry.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	return registry
+}
+
+// post serves a JSON request with the handler, and decodes the JSON response into result, if not nil.
+func post(t *testing.T, handler http.Handler, body string, result interface{}) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if result != nil && recorder.Code < 300 {
+		err := json.NewDecoder(recorder.Body).Decode(result)
+		if err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+	}
+
+	return recorder
+}
+
+// chanNotifier passes notifications to a channel.
+type chanNotifier chan *auth.Notification
+
+func (n chanNotifier) Notify(notification *auth.Notification) error {
+	n <- notification
+	return nil
+}
+
+func (n chanNotifier) receive(t *testing.T) *auth.Notification {
+	select {
+	case notification := <-n:
+		return notification
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not sent")
+		return nil
+	}
+}
+
+// totpCode computes the current code of the base32 encoded secret (RFC 6238 with SHA1 and 6 digits).
+func totpCode(t *testing.T, secret string) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("invalid secret %s: %v", secret, err)
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(time.Now().Unix()/30))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+func TestLoginHandler_Throttled(t *testing.T) {
+	registry := newTestRegistry(t, auth.WithLoginLimiter(auth.NewLoginLimiter()))
+	handler := &LoginHandler{Registry: registry}
+
+	for _, test := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"missing password", `{"username":"user1"}`, http.StatusBadRequest},
+		{"wrong password", `{"username":"user1","password":"wrong"}`, http.StatusUnauthorized},
+		{"wrong password", `{"username":"user1","password":"wrong"}`, http.StatusUnauthorized},
+		{"wrong password", `{"username":"user1","password":"wrong"}`, http.StatusUnauthorized},
+		{"wrong password", `{"username":"user1","password":"wrong"}`, http.StatusUnauthorized},
+	} {
+		if code := post(t, handler, test.body, nil).Code; code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+
+	recorder := post(t, handler, `{"username":"user1","password":"password1"}`, nil)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", recorder.Code)
+	}
+
+	if retryAfter, err := strconv.Atoi(recorder.Header().Get("Retry-After")); err != nil || retryAfter < 1 {
+		t.Errorf("invalid Retry-After %q", recorder.Header().Get("Retry-After"))
+	}
+
+	if code := post(t, &ClearLockoutHandler{Registry: registry}, `{"username":"user1"}`, nil).Code; code != http.StatusOK {
+		t.Fatalf("clear lockout: expected 200, got %d", code)
+	}
+
+	// the failures from the IP address are not cleared
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"username":"user1","password":"password1"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.RemoteAddr = "198.51.100.1:1234"
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("login after clearing lockout: expected 200, got %d", recorder.Code)
+	}
+}
+
+func TestPasswordHandlers(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	type tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	_, refreshToken, err := registry.Login("user1", "password1")
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	changePassword := &ChangePasswordHandler{Registry: registry}
+
+	for _, test := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"missing new password", `{"username":"user1","old_password":"password1"}`, http.StatusBadRequest},
+		{"wrong old password", `{"username":"user1","old_password":"wrong","new_password":"password2"}`, http.StatusUnauthorized},
+		{"weak new password", `{"username":"user1","old_password":"password1","new_password":"short"}`, http.StatusUnprocessableEntity},
+	} {
+		if code := post(t, changePassword, test.body, nil).Code; code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+
+	var changed tokens
+	recorder := post(t, changePassword, `{"username":"user1","old_password":"password1","new_password":"password2"}`, &changed)
+	if recorder.Code != http.StatusOK || changed.AccessToken == "" || changed.RefreshToken == "" {
+		t.Fatalf("change password: expected 200 with tokens, got %d", recorder.Code)
+	}
+
+	if _, _, err = registry.Refresh("user1", refreshToken); err == nil {
+		t.Error("session not revoked by password change")
+	}
+
+	for _, test := range []struct {
+		name    string
+		handler http.Handler
+		body    string
+		code    int
+	}{
+		{"reset password", &ResetPasswordHandler{Registry: registry}, `{"username":"user1","password":"password3"}`, http.StatusOK},
+		{"reset password of missing user", &ResetPasswordHandler{Registry: registry}, `{"username":"user2","password":"password3"}`, http.StatusNotFound},
+		{"reset weak password", &ResetPasswordHandler{Registry: registry}, `{"username":"user1","password":"short"}`, http.StatusUnprocessableEntity},
+		{"logout all", &LogoutAllHandler{Registry: registry}, `{"username":"user1"}`, http.StatusOK},
+		{"logout all of missing user", &LogoutAllHandler{Registry: registry}, `{"username":"user2"}`, http.StatusNotFound},
+		{"logout all without username", &LogoutAllHandler{Registry: registry}, `{}`, http.StatusBadRequest},
+	} {
+		if code := post(t, test.handler, test.body, nil).Code; code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+
+	if _, _, err = registry.Refresh("user1", changed.RefreshToken); err == nil {
+		t.Error("session not revoked by logout all")
+	}
+
+	if _, _, err = registry.Login("user1", "password3"); err != nil {
+		t.Errorf("login with reset password failed: %v", err)
+	}
+}
+
+func TestChangePasswordHandler_RevocationList(t *testing.T) {
+	list := auth.NewRevocationList()
+	registry := newTestRegistry(t, auth.WithRevocationList(list))
+	if err := registry.SetRoles("user1", "user"); err != nil {
+		t.Fatalf("error setting roles: %v", err)
+	}
+
+	var changed struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	body := `{"username":"user1","old_password":"password1","new_password":"password2"}`
+	if code := post(t, &ChangePasswordHandler{Registry: registry}, body, &changed).Code; code != http.StatusOK {
+		t.Fatalf("change password: expected 200, got %d", code)
+	}
+
+	// the token of the login after the password change is issued within the second of the revocation
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "Bearer "+changed.AccessToken)
+	recorder := httptest.NewRecorder()
+	auth.NewMiddleware(SECRET, auth.WithRevocationChecker(list)).Wrap(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}), false, "user").ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("token returned by change password rejected with %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestPasswordResetHandlers(t *testing.T) {
+	notifier := make(chanNotifier, 1)
+	registry := newTestRegistry(t, auth.WithNotifier(notifier))
+
+	if code := post(t, &RequestPasswordResetHandler{Registry: registry}, `{"username":"user1"}`, nil).Code; code != http.StatusAccepted {
+		t.Fatalf("request password reset: expected 202, got %d", code)
+	}
+
+	n := notifier.receive(t)
+	if n.Username != "user1" || n.Purpose != auth.TokenPurposePasswordReset {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+
+	handler := &CompletePasswordResetHandler{Registry: registry}
+	body := fmt.Sprintf(`{"token":%q,"password":"password2"}`, n.Token)
+
+	for _, test := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"missing password", fmt.Sprintf(`{"token":%q}`, n.Token), http.StatusBadRequest},
+		{"invalid token", `{"token":"invalid","password":"password2"}`, http.StatusUnauthorized},
+		{"weak password", fmt.Sprintf(`{"token":%q,"password":"short"}`, n.Token), http.StatusUnprocessableEntity},
+		{"reset", body, http.StatusOK},
+		{"token reused", body, http.StatusUnauthorized},
+	} {
+		if code := post(t, handler, test.body, nil).Code; code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+
+	if _, _, err := registry.Login("user1", "password2"); err != nil {
+		t.Errorf("login with new password failed: %v", err)
+	}
+
+	// the notifier blocks until the notification is received
+	notifier = make(chanNotifier)
+	registry = newTestRegistry(t, auth.WithNotifier(notifier))
+	request := &RequestPasswordResetHandler{Registry: registry, MaxPending: 1}
+
+	if code := post(t, request, `{"username":"user1"}`, nil).Code; code != http.StatusAccepted {
+		t.Fatalf("request password reset: expected 202, got %d", code)
+	}
+
+	recorder := post(t, request, `{"username":"user2"}`, nil)
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("request beyond MaxPending: expected 503 with Retry-After, got %d", recorder.Code)
+	}
+
+	notifier.receive(t)
+}
+
+func TestEmailVerificationHandlers(t *testing.T) {
+	notifier := make(chanNotifier, 1)
+	registry := newTestRegistry(t, auth.WithNotifier(notifier), auth.WithUnverifiedEmailPolicy(auth.RefuseUnverifiedEmail))
+
+	recorder := post(t, &RegisterHandler{Registry: registry}, `{"username":"user2","password":"password2","email":"user2@example.com"}`, nil)
+	if recorder.Code != http.StatusAccepted {
+		t.Errorf("register with unverified email: expected 202, got %d", recorder.Code)
+	}
+
+	notifier.receive(t)
+
+	if code := post(t, &LoginHandler{Registry: registry}, `{"username":"user2","password":"password2"}`, nil).Code; code != http.StatusForbidden {
+		t.Errorf("login with unverified email: expected 403, got %d", code)
+	}
+
+	if code := post(t, &RequestEmailVerificationHandler{Registry: registry}, `{"username":"user2"}`, nil).Code; code != http.StatusAccepted {
+		t.Fatalf("request email verification: expected 202, got %d", code)
+	}
+
+	n := notifier.receive(t)
+	if n.Username != "user2" || n.Email != "user2@example.com" || n.Purpose != auth.TokenPurposeEmailVerification {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+
+	handler := &VerifyEmailHandler{Registry: registry}
+	body := fmt.Sprintf(`{"token":%q}`, n.Token)
+
+	for _, test := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"missing token", `{}`, http.StatusBadRequest},
+		{"invalid token", `{"token":"invalid"}`, http.StatusUnauthorized},
+		{"verify", body, http.StatusOK},
+		{"token reused", body, http.StatusUnauthorized},
+	} {
+		if code := post(t, handler, test.body, nil).Code; code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+
+	if code := post(t, &LoginHandler{Registry: registry}, `{"username":"user2","password":"password2"}`, nil).Code; code != http.StatusOK {
+		t.Errorf("login with verified email: expected 200, got %d", code)
+	}
+}
+
+func TestTOTPHandlers(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	enroll := &EnrollTOTPHandler{Registry: registry}
+
+	if code := post(t, enroll, `{"username":"user1","password":"wrong"}`, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("enroll with wrong password: expected 401, got %d", code)
+	}
+
+	recorder := post(t, enroll, `{"username":"user1","password":"password1"}`, &enrollment)
+	if recorder.Code != http.StatusOK || enrollment.Secret == "" || !strings.HasPrefix(enrollment.URI, "otpauth://totp/") {
+		t.Fatalf("enroll: expected 200 with secret, got %d", recorder.Code)
+	}
+
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	confirm := &ConfirmTOTPHandler{Registry: registry}
+
+	if code := post(t, confirm, `{"username":"user1","code":"000000"}`, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("confirm with wrong code: expected 401, got %d", code)
+	}
+
+	recorder = post(t, confirm, fmt.Sprintf(`{"username":"user1","code":%q}`, totpCode(t, enrollment.Secret)), &confirmation)
+	if recorder.Code != http.StatusOK || len(confirmation.RecoveryCodes) < 3 {
+		t.Fatalf("confirm: expected 200 with recovery codes, got %d", recorder.Code)
+	}
+
+	if code := post(t, enroll, `{"username":"user1","password":"password1"}`, nil).Code; code != http.StatusConflict {
+		t.Errorf("enroll twice: expected 409, got %d", code)
+	}
+
+	var challenge struct {
+		MFARequired    bool   `json:"mfa_required"`
+		ChallengeToken string `json:"challenge_token"`
+	}
+
+	recorder = post(t, &LoginHandler{Registry: registry}, `{"username":"user1","password":"password1"}`, &challenge)
+	if recorder.Code != http.StatusAccepted || !challenge.MFARequired || challenge.ChallengeToken == "" {
+		t.Fatalf("login: expected 202 with challenge, got %d", recorder.Code)
+	}
+
+	var tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	login := &TOTPLoginHandler{Registry: registry}
+	body := fmt.Sprintf(`{"challenge_token":%q,"code":%q}`, challenge.ChallengeToken, confirmation.RecoveryCodes[0])
+
+	if code := post(t, login, fmt.Sprintf(`{"challenge_token":%q}`, challenge.ChallengeToken), nil).Code; code != http.StatusBadRequest {
+		t.Errorf("login without code: expected 400, got %d", code)
+	}
+
+	recorder = post(t, login, body, &tokens)
+	if recorder.Code != http.StatusOK || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("login with recovery code: expected 200 with tokens, got %d", recorder.Code)
+	}
+
+	if code := post(t, login, body, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("challenge reused: expected 401, got %d", code)
+	}
+
+	disable := &DisableTOTPHandler{Registry: registry}
+
+	for _, test := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"missing code", `{"username":"user1","password":"password1"}`, http.StatusBadRequest},
+		{"wrong password", fmt.Sprintf(`{"username":"user1","password":"wrong","code":%q}`, confirmation.RecoveryCodes[1]), http.StatusUnauthorized},
+		{"wrong code", `{"username":"user1","password":"password1","code":"000000"}`, http.StatusUnauthorized},
+		{"disable", fmt.Sprintf(`{"username":"user1","password":"password1","code":%q}`, confirmation.RecoveryCodes[1]), http.StatusOK},
+	} {
+		if code := post(t, disable, test.body, nil).Code; code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+
+	if code := post(t, &LoginHandler{Registry: registry}, `{"username":"user1","password":"password1"}`, nil).Code; code != http.StatusOK {
+		t.Errorf("login with disabled TOTP: expected 200, got %d", code)
+	}
+
+	reset := &ResetTOTPHandler{Registry: registry}
+
+	if code := post(t, reset, `{"username":"user1"}`, nil).Code; code != http.StatusOK {
+		t.Errorf("reset TOTP: expected 200, got %d", code)
+	}
+
+	if code := post(t, reset, `{"username":"user2"}`, nil).Code; code != http.StatusNotFound {
+		t.Errorf("reset TOTP of missing user: expected 404, got %d", code)
+	}
+}
+
+func TestWebAuthnHandlers(t *testing.T) {
+	registry := newTestRegistry(t, auth.WithWebAuthn("example.com", "Example"), auth.WithLoginLimiter(auth.NewLoginLimiter()))
+
+	var creation auth.WebAuthnCreationOptions
+
+	begin := &BeginWebAuthnRegistrationHandler{Registry: registry}
+
+	if code := post(t, begin, `{"username":"user1","password":"wrong"}`, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("begin registration with wrong password: expected 401, got %d", code)
+	}
+
+	recorder := post(t, begin, `{"username":"user1","password":"password1"}`, &creation)
+	if recorder.Code != http.StatusOK || creation.Challenge == "" || creation.RP.ID != "example.com" || creation.User.Name != "user1" {
+		t.Fatalf("begin registration: expected 200 with options, got %d", recorder.Code)
+	}
+
+	for _, test := range []struct {
+		name    string
+		handler http.Handler
+		body    string
+		code    int
+	}{
+		{"finish registration without attestation", &FinishWebAuthnRegistrationHandler{Registry: registry},
+			`{"id":"AAAA","type":"public-key","response":{"clientDataJSON":"AAAA"}}`, http.StatusBadRequest},
+		{"finish registration with invalid client data", &FinishWebAuthnRegistrationHandler{Registry: registry},
+			`{"id":"AAAA","type":"public-key","response":{"clientDataJSON":"AAAA","attestationObject":"AAAA"}}`, http.StatusUnauthorized},
+		{"begin login without passkey", &BeginWebAuthnLoginHandler{Registry: registry}, `{"username":"user1"}`, http.StatusOK},
+		{"begin login of missing user", &BeginWebAuthnLoginHandler{Registry: registry}, `{"username":"user2"}`, http.StatusOK},
+		{"begin login without username", &BeginWebAuthnLoginHandler{Registry: registry}, `{}`, http.StatusBadRequest},
+		{"finish login with invalid client data", &FinishWebAuthnLoginHandler{Registry: registry},
+			`{"id":"AAAA","type":"public-key","response":{"clientDataJSON":"AAAA","authenticatorData":"AAAA","signature":"AAAA"}}`, http.StatusUnauthorized},
+	} {
+		if code := post(t, test.handler, test.body, nil).Code; code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+
+	// the wrong passwords of the registrations are limited like logins
+	for i := 0; i < 4; i++ {
+		post(t, begin, `{"username":"user1","password":"wrong"}`, nil)
+	}
+
+	recorder = post(t, begin, `{"username":"user1","password":"password1"}`, nil)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("begin registration after failures: expected 429 with Retry-After, got %d", recorder.Code)
+	}
+
+	recorder = post(t, &BeginWebAuthnLoginHandler{Registry: registry}, `{"username":"user1"}`, nil)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("begin login after failures: expected 429 with Retry-After, got %d", recorder.Code)
+	}
+}
+
+func TestSessionHandlers(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	_, laptop, err := registry.LoginWithClient("user1", "password1", auth.ClientInfo{IP: "192.0.2.1", UserAgent: "laptop"})
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	_, phone, err := registry.LoginWithClient("user1", "password1", auth.ClientInfo{IP: "192.0.2.2", UserAgent: "phone"})
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	type sessions struct {
+		Sessions []struct {
+			ID        string `json:"id"`
+			IP        string `json:"ip"`
+			UserAgent string `json:"user_agent"`
+			Current   bool   `json:"current"`
+		} `json:"sessions"`
+	}
+
+	list := &ListSessionsHandler{Registry: registry}
+
+	if code := post(t, list, `{"username":"user1","refresh_token":"invalid"}`, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("list with invalid token: expected 401, got %d", code)
+	}
+
+	if code := post(t, list, `{"username":"user1"}`, nil).Code; code != http.StatusBadRequest {
+		t.Errorf("list without token: expected 400, got %d", code)
+	}
+
+	var listed sessions
+	recorder := post(t, list, fmt.Sprintf(`{"username":"user1","refresh_token":%q}`, laptop), &listed)
+	if recorder.Code != http.StatusOK || len(listed.Sessions) != 2 {
+		t.Fatalf("list: expected 200 with 2 sessions, got %d", recorder.Code)
+	}
+
+	var phoneSession string
+	for _, s := range listed.Sessions {
+		if s.Current != (s.UserAgent == "laptop") {
+			t.Errorf("unexpected current session %+v", s)
+		}
+		if s.UserAgent == "phone" {
+			phoneSession = s.ID
+		}
+	}
+
+	revoke := &RevokeSessionHandler{Registry: registry}
+	body := fmt.Sprintf(`{"username":"user1","refresh_token":%q,"session_id":%q}`, laptop, phoneSession)
+
+	for _, test := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"revoke with another user's token", fmt.Sprintf(`{"username":"user2","refresh_token":%q,"session_id":%q}`, laptop, phoneSession), http.StatusUnauthorized},
+		{"revoke", body, http.StatusOK},
+		{"revoke again", body, http.StatusNotFound},
+	} {
+		if code := post(t, revoke, test.body, nil).Code; code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+
+	if code := post(t, list, fmt.Sprintf(`{"username":"user1","refresh_token":%q}`, phone), nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("list with revoked token: expected 401, got %d", code)
+	}
+}
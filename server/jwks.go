@@ -0,0 +1,28 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// JWKSHandler publishes the public keys of the Registry as a JSON Web Key Set.
+// Other servers can load it with auth.NewMiddlewareFromJWKS.
+type JWKSHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *JWKSHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed"))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "public, max-age=300")
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(h.Registry.JWKS())
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+	"time"
+)
+
+// ListSessionsHandler lists the sessions of the user, i.e. where the user is logged in.
+// The user has to send a current refresh token, the session of the token is marked as current.
+type ListSessionsHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *ListSessionsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type ListSessionsRequest struct {
+		Username     string `json:"username"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	r := &ListSessionsRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Username == "" || r.RefreshToken == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, username and refresh token required"))
+		return
+	}
+
+	current, err := h.Registry.CurrentSession(r.Username, r.RefreshToken)
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	sessions, err := h.Registry.ListSessions(r.Username)
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	type SessionResponse struct {
+		ID         string     `json:"id"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt time.Time  `json:"last_used_at"`
+		ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+		IP         string     `json:"ip"`
+		UserAgent  string     `json:"user_agent"`
+		Current    bool       `json:"current"`
+	}
+
+	type ListSessionsResponse struct {
+		Sessions []*SessionResponse `json:"sessions"`
+	}
+
+	response := &ListSessionsResponse{
+		Sessions: make([]*SessionResponse, 0, len(sessions)),
+	}
+
+	for _, session := range sessions {
+		s := &SessionResponse{
+			ID:         session.ID,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			IP:         session.Client.IP,
+			UserAgent:  session.Client.UserAgent,
+			Current:    session.ID == current.ID,
+		}
+
+		// sessions without expiration have no expires_at
+		if !session.ExpiresAt.IsZero() {
+			expiresAt := session.ExpiresAt
+			s.ExpiresAt = &expiresAt
+		}
+
+		response.Sessions = append(response.Sessions, s)
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(response)
+}
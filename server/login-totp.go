@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// TOTPLoginHandler completes a login of a user with two-factor authentication. The client sends
+// the challenge token returned by LoginHandler, and a code from the authenticator or a recovery code.
+type TOTPLoginHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *TOTPLoginHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type TOTPLoginRequest struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+
+	r := &TOTPLoginRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.ChallengeToken == "" || r.Code == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, challenge token and code required"))
+		return
+	}
+
+	accessToken, refreshToken, err := h.Registry.CompleteMFALogin(r.ChallengeToken, r.Code, clientInfo(request))
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, auth.UnauthorizedError) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Authorization", "Bearer "+accessToken)
+
+	type TOTPLoginResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(&TOTPLoginResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	})
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/live-labs/auth"
 	"net/http"
 )
@@ -38,7 +39,18 @@ func (h *LoginHandler) ServeHTTP(writer http.ResponseWriter, request *http.Reque
 		return
 	}
 
-	accessToken, refreshToken, err := h.Registry.Login(r.Username, r.Password)
+	accessToken, refreshToken, err := h.Registry.LoginWithClient(r.Username, r.Password, clientInfo(request))
+	if writeMFARequired(writer, err) {
+		return
+	}
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, auth.EmailNotVerifiedError) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte(err.Error()))
+		return
+	}
 	if err != nil {
 		writer.WriteHeader(http.StatusUnauthorized)
 		writer.Write([]byte(err.Error()))
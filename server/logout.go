@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"github.com/live-labs/auth"
 	"net/http"
+	"strings"
 )
 
 type LogoutHandler struct {
@@ -46,6 +47,11 @@ func (h *LogoutHandler) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 		return
 	}
 
+	// revoke the access token too, if the client sent it and the registry has a revocation list
+	if accessToken, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); ok && h.Registry.RevocationList() != nil {
+		h.Registry.RevokeAccessToken(accessToken)
+	}
+
 	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
 	writer.Write([]byte("{}"))
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+	"time"
+)
+
+// writeMFARequired writes a 202 response with the challenge token, if err is an *auth.MFARequiredError.
+// The client completes the login with the token and a code (see TOTPLoginHandler).
+// It returns false and writes nothing for other errors.
+func writeMFARequired(writer http.ResponseWriter, err error) bool {
+	var mfaErr *auth.MFARequiredError
+	if !errors.As(err, &mfaErr) {
+		return false
+	}
+
+	type MFARequiredResponse struct {
+		MFARequired    bool      `json:"mfa_required"`
+		ChallengeToken string    `json:"challenge_token"`
+		ExpiresAt      time.Time `json:"expires_at"`
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+
+	json.NewEncoder(writer).Encode(&MFARequiredResponse{
+		MFARequired:    true,
+		ChallengeToken: mfaErr.ChallengeToken,
+		ExpiresAt:      mfaErr.ExpiresAt,
+	})
+
+	return true
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// writePolicyError writes a 422 response listing the violated rules, if err is an *auth.PolicyError.
+// It returns false and writes nothing for other errors.
+func writePolicyError(writer http.ResponseWriter, err error) bool {
+	var policyErr *auth.PolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+
+	type PolicyErrorResponse struct {
+		Error   string                 `json:"error"`
+		Field   string                 `json:"field"`
+		Reasons []auth.PolicyViolation `json:"reasons"`
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusUnprocessableEntity)
+
+	json.NewEncoder(writer).Encode(&PolicyErrorResponse{
+		Error:   policyErr.Error(),
+		Field:   policyErr.Field,
+		Reasons: policyErr.Violations,
+	})
+
+	return true
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies takes the IP address of the client from the X-Forwarded-For header of requests sent by
+// trusted proxies, e.g. a load balancer. The handlers use it for the client info of sessions and the login
+// limiter, and KeyByIP for rate limits. Without it, the address of the connection is used, so all clients
+// behind a proxy share the address of the proxy.
+// The header is only trusted from the configured proxies, since clients can send any header.
+type TrustedProxies struct {
+	networks []*net.IPNet
+}
+
+// NewTrustedProxies creates TrustedProxies trusting the given IP addresses or CIDR networks,
+// e.g. "10.0.0.0/8" or "192.0.2.1".
+func NewTrustedProxies(proxies ...string) (*TrustedProxies, error) {
+	p := &TrustedProxies{}
+
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address: %s", proxy)
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxy = fmt.Sprintf("%s/%d", proxy, bits)
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy network: %w", err)
+		}
+
+		p.networks = append(p.networks, network)
+	}
+
+	return p, nil
+}
+
+// Wrap wraps the next handler, replacing the remote address of requests from trusted proxies
+// with the address of the client.
+func (p *TrustedProxies) Wrap(next http.Handler) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if ip := p.clientIP(request); ip != "" {
+			request = request.WithContext(request.Context())
+			request.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+
+		next.ServeHTTP(writer, request)
+	}
+}
+
+// clientIP returns the address of the client of a request sent by a trusted proxy, or an empty string
+// if the request was not sent by a trusted proxy or has no X-Forwarded-For header.
+// Every proxy appends the address it received the request from, so the header is read from the right,
+// and the first untrusted address is the client.
+func (p *TrustedProxies) clientIP(request *http.Request) string {
+	if !p.trusted(clientInfo(request).IP) {
+		return ""
+	}
+
+	var forwarded []string
+	for _, header := range request.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(ip))
+		}
+	}
+
+	client := ""
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			break
+		}
+
+		client = forwarded[i]
+		if !p.trusted(client) {
+			break
+		}
+	}
+
+	return client
+}
+
+// trusted checks if the IP address belongs to a trusted proxy.
+func (p *TrustedProxies) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range p.networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	if _, err := NewTrustedProxies("invalid"); err == nil {
+		t.Error("invalid proxy accepted")
+	}
+
+	proxies, err := NewTrustedProxies("10.0.0.0/8", "192.0.2.1", "2001:db8::1")
+	if err != nil {
+		t.Fatalf("error creating trusted proxies: %v", err)
+	}
+
+	var ip string
+	handler := proxies.Wrap(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ip = clientInfo(request).IP
+	}))
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		ip         string
+	}{
+		{"untrusted connection", "198.51.100.1:1234", []string{"203.0.113.1"}, "198.51.100.1"},
+		{"trusted proxy", "192.0.2.1:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"proxy without header", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"spoofed header", "10.0.0.1:1234", []string{"198.51.100.9, 203.0.113.1"}, "203.0.113.1"},
+		{"chain of proxies", "10.0.0.1:1234", []string{"203.0.113.1, 10.0.0.2", "10.0.0.3"}, "203.0.113.1"},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"invalid address", "10.0.0.1:1234", []string{"unknown"}, "10.0.0.1"},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/login", nil)
+		request.RemoteAddr = test.remoteAddr
+		for _, header := range test.forwarded {
+			request.Header.Add("X-Forwarded-For", header)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		if ip != test.ip {
+			t.Errorf("%s: expected %s, got %s", test.name, test.ip, ip)
+		}
+	}
+}
+
+func TestRouter_TrustedProxies(t *testing.T) {
+	proxies, err := NewTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("error creating trusted proxies: %v", err)
+	}
+
+	limiter := NewRateLimiter(RateLimit{Requests: 1, Period: time.Hour}, KeyByIP)
+	router := NewRouter(newTestRegistry(t), nil, WithTrustedProxies(proxies), WithRateLimiter(PathLogin, limiter))
+
+	serve := func(client string) int {
+		request := httptest.NewRequest(http.MethodPost, "/login", nil)
+		request.RemoteAddr = "10.0.0.1:1234"
+		request.Header.Set("X-Forwarded-For", client)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// clients behind the load balancer have their own buckets
+	for _, client := range []string{"203.0.113.1", "203.0.113.2"} {
+		if code := serve(client); code == http.StatusTooManyRequests {
+			t.Errorf("%s: first request rate limited", client)
+		}
+	}
+
+	if code := serve("203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Errorf("second request: expected 429, got %d", code)
+	}
+}
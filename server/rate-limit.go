@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/live-labs/auth"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Requests requests per Period, with bursts of up to Requests requests.
+// It is a token bucket holding Requests tokens, refilled evenly over Period. Both must be positive.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// RateLimitResult is the state of a bucket after taking a token.
+type RateLimitResult struct {
+	// Allowed is set if a token was taken, so the request is allowed.
+	Allowed bool
+	// Remaining is the number of requests allowed right now.
+	Remaining int
+	// RetryAfter is the time until the next request is allowed, if the request is not allowed.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+}
+
+// RateLimitBackend stores the token buckets of a RateLimiter. MemoryRateLimitBackend keeps them in memory,
+// implement the interface to share the limits between several instances of the server.
+type RateLimitBackend interface {
+	// Take takes a token from the bucket of the key, if there is one.
+	Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// RateLimitKeyFunc returns the key of the bucket limiting the request.
+type RateLimitKeyFunc func(request *http.Request) string
+
+// KeyByIP limits requests per IP address of the client.
+func KeyByIP(request *http.Request) string {
+	return clientInfo(request).IP
+}
+
+// maxKeyBodySize limits the part of the request body read by KeyByUsername.
+const maxKeyBodySize = 64 << 10
+
+// KeyByUsername limits requests per user, taken from the "username" field of the JSON request body,
+// as sent to LoginHandler, RegisterHandler, RefreshHandler and the admin handlers.
+// Usernames are normalized like in the registry (see auth.Registry.NormalizeUsername), so every spelling
+// of a username shares its bucket. The body is left intact for the wrapped handler.
+// Requests without a username are limited per IP address instead (see KeyByIP), so anonymous or malformed
+// requests do not use up a bucket shared by everyone.
+func KeyByUsername(registry *auth.Registry) RateLimitKeyFunc {
+	return func(request *http.Request) string {
+		if request.Body == nil {
+			return keyByIPFallback(request)
+		}
+
+		body, _ := io.ReadAll(io.LimitReader(request.Body, maxKeyBodySize))
+		request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), request.Body), request.Body}
+
+		r := struct {
+			Username string `json:"username"`
+		}{}
+		json.Unmarshal(body, &r)
+
+		if r.Username == "" {
+			return keyByIPFallback(request)
+		}
+
+		return registry.NormalizeUsername(r.Username)
+	}
+}
+
+// keyByIPFallback returns the IP key of a request without a username. The key is prefixed,
+// so it does not share the bucket of a user named like the address.
+func keyByIPFallback(request *http.Request) string {
+	return "ip:" + KeyByIP(request)
+}
+
+// RateLimiter limits the rate of requests to wrapped handlers, e.g. to RegisterHandler per IP address,
+// or to LoginHandler per username. Requests over the limit are rejected with 429 Too Many Requests and
+// a Retry-After header. All responses carry the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+// RateLimit-Policy headers (see draft-ietf-httpapi-ratelimit-headers).
+// Handlers wrapped by the same RateLimiter share the buckets.
+type RateLimiter struct {
+	Limit   RateLimit
+	Key     RateLimitKeyFunc
+	Backend RateLimitBackend
+
+	now func() time.Time
+}
+
+// NewRateLimiter creates a RateLimiter keeping the buckets in memory.
+// key selects the bucket of a request, e.g. KeyByIP or KeyByUsername.
+func NewRateLimiter(limit RateLimit, key RateLimitKeyFunc) *RateLimiter {
+	return NewRateLimiterWithBackend(limit, key, NewMemoryRateLimitBackend())
+}
+
+// NewRateLimiterWithBackend creates a RateLimiter keeping the buckets in backend.
+func NewRateLimiterWithBackend(limit RateLimit, key RateLimitKeyFunc, backend RateLimitBackend) *RateLimiter {
+	return &RateLimiter{
+		Limit:   limit,
+		Key:     key,
+		Backend: backend,
+		now:     time.Now,
+	}
+}
+
+// Wrap wraps the next handler and rejects requests over the limit.
+func (l *RateLimiter) Wrap(next http.Handler) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		result, err := l.Backend.Take(l.Key(request), l.Limit, l.now())
+		if err != nil {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			writer.Write([]byte("Service unavailable, could not check rate limit"))
+			return
+		}
+
+		writer.Header().Set("RateLimit-Limit", strconv.Itoa(l.Limit.Requests))
+		writer.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		writer.Header().Set("RateLimit-Reset", seconds(result.Reset))
+		writer.Header().Set("RateLimit-Policy", strconv.Itoa(l.Limit.Requests)+";w="+seconds(l.Limit.Period))
+
+		if !result.Allowed {
+			writer.Header().Set("Retry-After", seconds(result.RetryAfter))
+			writer.WriteHeader(http.StatusTooManyRequests)
+			writer.Write([]byte("Too many requests"))
+			return
+		}
+
+		next.ServeHTTP(writer, request)
+	}
+}
+
+// seconds formats the duration in whole seconds, rounded up.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// MemoryRateLimitBackend keeps token buckets in memory. It is safe for concurrent use.
+// Several RateLimiters can share a backend only if their keys differ.
+type MemoryRateLimitBackend struct {
+	m         sync.Mutex
+	buckets   map[string]*rateLimitBucket
+	lastPrune time.Time
+}
+
+// rateLimitBucket is a token bucket, updated when a token is taken.
+type rateLimitBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+func NewMemoryRateLimitBackend() *MemoryRateLimitBackend {
+	return &MemoryRateLimitBackend{
+		buckets: make(map[string]*rateLimitBucket),
+	}
+}
+
+func (b *MemoryRateLimitBackend) Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	// full buckets are the same as no buckets, remove them once per period
+	if now.Sub(b.lastPrune) >= limit.Period {
+		for k, bucket := range b.buckets {
+			if bucket.refill(now) >= float64(bucket.limit.Requests) {
+				delete(b.buckets, k)
+			}
+		}
+		b.lastPrune = now
+	}
+
+	bucket, ok := b.buckets[key]
+	if !ok || bucket.limit != limit {
+		bucket = &rateLimitBucket{limit: limit, tokens: float64(limit.Requests), updated: now}
+		b.buckets[key] = bucket
+	}
+
+	bucket.tokens = bucket.refill(now)
+	bucket.updated = now
+
+	// time to add one token
+	interval := limit.Period / time.Duration(limit.Requests)
+
+	result := RateLimitResult{}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.tokens) * float64(interval))
+	}
+
+	result.Remaining = int(bucket.tokens)
+	result.Reset = time.Duration((float64(limit.Requests) - bucket.tokens) * float64(interval))
+
+	return result, nil
+}
+
+// refill returns the tokens of the bucket at the given time.
+func (bucket *rateLimitBucket) refill(now time.Time) float64 {
+	elapsed := now.Sub(bucket.updated)
+	if elapsed <= 0 {
+		return bucket.tokens
+	}
+	refilled := float64(elapsed) / float64(bucket.limit.Period) * float64(bucket.limit.Requests)
+	return math.Min(float64(bucket.limit.Requests), bucket.tokens+refilled)
+}
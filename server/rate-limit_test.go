@@ -0,0 +1,110 @@
+package server
+
+import (
+	"github.com/live-labs/auth"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(RateLimit{Requests: 2, Period: 10 * time.Second}, KeyByIP)
+	l.now = func() time.Time { return now }
+
+	handler := l.Wrap(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(ip string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/register", nil)
+		request.RemoteAddr = ip + ":1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		r := serve("192.0.2.1")
+		if r.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i+1, r.Code)
+		}
+		if r.Header().Get("RateLimit-Limit") != "2" || r.Header().Get("RateLimit-Remaining") != remaining ||
+			r.Header().Get("RateLimit-Policy") != "2;w=10" {
+			t.Errorf("request %d: unexpected headers %v", i+1, r.Header())
+		}
+	}
+
+	r := serve("192.0.2.1")
+	if r.Code != http.StatusTooManyRequests || r.Header().Get("Retry-After") != "5" || r.Header().Get("RateLimit-Reset") != "10" {
+		t.Fatalf("expected 429 with Retry-After 5, got %d %v", r.Code, r.Header())
+	}
+
+	if serve("192.0.2.2").Code != http.StatusOK {
+		t.Error("other IP address limited")
+	}
+
+	// one token is refilled every 5 seconds
+	now = now.Add(5 * time.Second)
+	if serve("192.0.2.1").Code != http.StatusOK {
+		t.Error("request limited after refill")
+	}
+	if serve("192.0.2.1").Code != http.StatusTooManyRequests {
+		t.Error("request allowed before refill")
+	}
+
+	// buckets do not hold more than the limit
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		serve("192.0.2.1")
+	}
+	if serve("192.0.2.1").Code != http.StatusTooManyRequests {
+		t.Error("burst exceeded the limit")
+	}
+
+	// full buckets are pruned
+	now = now.Add(time.Hour)
+	serve("192.0.2.3")
+	if n := len(l.Backend.(*MemoryRateLimitBackend).buckets); n != 1 {
+		t.Errorf("expected 1 bucket, got %d", n)
+	}
+}
+
+func TestKeyByUsername(t *testing.T) {
+	registry := auth.NewRegistry(nil, SECRET, auth.WithUsernamePolicy(auth.DefaultUsernamePolicy()))
+	key := KeyByUsername(registry)
+
+	body := `{"username":"Ａlice","password":"password1"}`
+	request := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+
+	if k := key(request); k != "alice" {
+		t.Errorf("expected key alice, got %q", k)
+	}
+
+	b, err := io.ReadAll(request.Body)
+	if err != nil || string(b) != body {
+		t.Errorf("body not restored: %q", b)
+	}
+
+	// requests without a username are limited per IP address
+	request = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("invalid"))
+	request.RemoteAddr = "192.0.2.1:1234"
+	if k := key(request); k != "ip:192.0.2.1" {
+		t.Errorf("expected IP key, got %q", k)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"password":"password1"}`))
+	request.RemoteAddr = "192.0.2.2:1234"
+	if k := key(request); k != "ip:192.0.2.2" {
+		t.Errorf("expected IP key, got %q", k)
+	}
+
+	// usernames are case-sensitive without a username policy
+	request = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+	if k := KeyByUsername(auth.NewRegistry(nil, SECRET))(request); k != "Ａlice" {
+		t.Errorf("expected key Ａlice, got %q", k)
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/live-labs/auth"
 	"net/http"
 )
@@ -38,7 +39,13 @@ func (h *RefreshHandler) ServeHTTP(writer http.ResponseWriter, request *http.Req
 		return
 	}
 
-	token, err := h.Registry.Refresh(r.Username, r.RefreshToken)
+	token, refreshToken, err := h.Registry.RefreshWithClient(r.Username, r.RefreshToken, clientInfo(request))
+
+	if errors.Is(err, auth.EmailNotVerifiedError) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte(err.Error()))
+		return
+	}
 
 	if err != nil {
 		writer.WriteHeader(http.StatusUnauthorized)
@@ -50,6 +57,15 @@ func (h *RefreshHandler) ServeHTTP(writer http.ResponseWriter, request *http.Req
 	writer.Header().Set("Content-Type", "application/json")
 	writer.Header().Set("Authorization", "Bearer "+token)
 
+	type RefreshResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
 	writer.WriteHeader(http.StatusOK)
-	writer.Write([]byte("{}"))
+
+	json.NewEncoder(writer).Encode(&RefreshResponse{
+		AccessToken:  token,
+		RefreshToken: refreshToken, // the refresh token from the request is no longer valid
+	})
 }
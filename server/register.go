@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/live-labs/auth"
 	"net/http"
 )
@@ -21,6 +22,7 @@ func (h *RegisterHandler) ServeHTTP(writer http.ResponseWriter, request *http.Re
 	type RegisterRequest struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Email    string `json:"email"`
 	}
 
 	r := &RegisterRequest{}
@@ -38,14 +40,24 @@ func (h *RegisterHandler) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		return
 	}
 
-	err = h.Registry.Register(r.Username, r.Password)
+	err = h.Registry.RegisterWithEmail(r.Username, r.Password, r.Email)
+	if writePolicyError(writer, err) {
+		return
+	}
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
 		writer.Write([]byte(err.Error()))
 		return
 	}
 
-	accessToken, refreshToken, err := h.Registry.Login(r.Username, r.Password)
+	accessToken, refreshToken, err := h.Registry.LoginWithClient(r.Username, r.Password, clientInfo(request))
+	if errors.Is(err, auth.EmailNotVerifiedError) {
+		// registered, but the user has to verify the email address before login
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusAccepted)
+		writer.Write([]byte("{}"))
+		return
+	}
 	if err != nil {
 		writer.WriteHeader(http.StatusUnauthorized)
 		writer.Write([]byte(err.Error()))
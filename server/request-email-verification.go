@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// RequestEmailVerificationHandler sends a new verification token to the email address of the user.
+// It responds with 202 Accepted, and sends the token in the background, so neither the response
+// nor its timing reveal whether the user exists. If MaxPending requests are processed in the background
+// already, it responds with 503 Service Unavailable.
+type RequestEmailVerificationHandler struct {
+	Registry *auth.Registry
+	// MaxPending limits the requests processed in the background at once (DefaultMaxPending if zero).
+	MaxPending int
+
+	background background
+}
+
+func (h *RequestEmailVerificationHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type RequestEmailVerificationRequest struct {
+		Username string `json:"username"`
+	}
+
+	r := &RequestEmailVerificationRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Username == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, username required"))
+		return
+	}
+
+	// errors can not be reported without revealing that the user exists
+	if !h.background.run(h.MaxPending, func() { h.Registry.RequestEmailVerification(r.Username) }) {
+		writer.Header().Set("Retry-After", "1")
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		writer.Write([]byte("Too many pending requests"))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	writer.Write([]byte("{}"))
+}
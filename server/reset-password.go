@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// ResetPasswordHandler sets a new password of the user and revokes all their sessions.
+// It is an admin handler and should be protected with auth.Middleware.
+type ResetPasswordHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *ResetPasswordHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type ResetPasswordRequest struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	r := &ResetPasswordRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.Username == "" || r.Password == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, username and password required"))
+		return
+	}
+
+	err = h.Registry.ResetPassword(r.Username, r.Password)
+	if writePolicyError(writer, err) {
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("{}"))
+}
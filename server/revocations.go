@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// RevocationListHandler publishes the revocation list of the Registry.
+// Other servers can load it with auth.NewRevocationListURL.
+type RevocationListHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *RevocationListHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed"))
+		return
+	}
+
+	list := h.Registry.RevocationList()
+	if list == nil {
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte("Revocation list not configured"))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(writer).Encode(list)
+}
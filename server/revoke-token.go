@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// RevokeTokenHandler revokes a single access token, e.g. a stolen one.
+// It is an admin handler and should be protected with auth.Middleware.
+type RevokeTokenHandler struct {
+	Registry *auth.Registry
+}
+
+func (h *RevokeTokenHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, expected json"))
+		return
+	}
+
+	type RevokeTokenRequest struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	r := &RevokeTokenRequest{}
+
+	err := json.NewDecoder(request.Body).Decode(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, could not decode body"))
+		return
+	}
+
+	if r.AccessToken == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Bad request, access token required"))
+		return
+	}
+
+	err = h.Registry.RevokeAccessToken(r.AccessToken)
+
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("{}"))
+}
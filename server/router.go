@@ -0,0 +1,239 @@
+package server
+
+import (
+	"github.com/live-labs/auth"
+	"net/http"
+	"strings"
+)
+
+// Default paths of the handlers mounted by NewRouter. They match the default URIs of client.js.
+const (
+	PathRegister                   = "/register"
+	PathLogin                      = "/login"
+	PathLoginTOTP                  = "/login-totp"
+	PathRefresh                    = "/refresh"
+	PathLogout                     = "/logout"
+	PathChangePassword             = "/change-password"
+	PathRequestPasswordReset       = "/request-password-reset"
+	PathCompletePasswordReset      = "/complete-password-reset"
+	PathRequestEmailVerification   = "/request-email-verification"
+	PathVerifyEmail                = "/verify-email"
+	PathEnrollTOTP                 = "/enroll-totp"
+	PathConfirmTOTP                = "/confirm-totp"
+	PathDisableTOTP                = "/disable-totp"
+	PathBeginWebAuthnRegistration  = "/begin-webauthn-registration"
+	PathFinishWebAuthnRegistration = "/finish-webauthn-registration"
+	PathBeginWebAuthnLogin         = "/begin-webauthn-login"
+	PathFinishWebAuthnLogin        = "/finish-webauthn-login"
+	PathListSessions               = "/list-sessions"
+	PathRevokeSession              = "/revoke-session"
+	PathJWKS                       = "/.well-known/jwks.json"
+	PathRevocations                = "/revocations"
+
+	// admin handlers
+	PathSetRoles      = "/set-roles"
+	PathBlacklist     = "/blacklist"
+	PathUnblacklist   = "/unblacklist"
+	PathLogoutAll     = "/logout-all"
+	PathResetPassword = "/reset-password"
+	PathResetTOTP     = "/reset-totp"
+	PathClearLockout  = "/clear-lockout"
+	PathRevokeToken   = "/revoke-token"
+)
+
+// RouterOption configures NewRouter.
+type RouterOption func(r *router)
+
+// WithPrefix prepends the prefix to the paths of all handlers, e.g. "/auth".
+func WithPrefix(prefix string) RouterOption {
+	return func(r *router) {
+		r.prefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithPath mounts the handler with the default path (e.g. PathLogin) at another path.
+// Empty path does not mount the handler.
+func WithPath(defaultPath string, path string) RouterOption {
+	return func(r *router) {
+		r.paths[defaultPath] = path
+	}
+}
+
+// WithAdminRoles allows users with any of the roles to call the admin handlers.
+// Users with auth.RoleAdmin are always allowed (see auth.Middleware).
+func WithAdminRoles(roles ...string) RouterOption {
+	return func(r *router) {
+		r.adminRoles = roles
+	}
+}
+
+// WithUnprotectedAdminHandlers mounts the admin handlers without the middleware,
+// e.g. on a router only reachable from an internal network.
+func WithUnprotectedAdminHandlers() RouterOption {
+	return func(r *router) {
+		r.unprotectedAdmin = true
+	}
+}
+
+// WithRateLimiter limits the rate of requests to the handler with the default path (e.g. PathLogin).
+// The same limiter can be passed for several handlers, to share the buckets.
+func WithRateLimiter(defaultPath string, limiter *RateLimiter) RouterOption {
+	return func(r *router) {
+		r.rateLimiters[defaultPath] = limiter
+	}
+}
+
+// WithTrustedProxies takes the IP address of the client from the X-Forwarded-For header of requests sent
+// by the proxies, see TrustedProxies. It applies before the rate limiters, so KeyByIP limits the clients.
+func WithTrustedProxies(proxies *TrustedProxies) RouterOption {
+	return func(r *router) {
+		r.proxies = proxies
+	}
+}
+
+// WithRevocationListHandler mounts RevocationListHandler at PathRevocations, wrapped by wrap, which should
+// allow only the servers loading the list, e.g. by a shared secret or a client certificate. The list reveals
+// usernames, so it is not mounted without the option.
+func WithRevocationListHandler(wrap func(http.Handler) http.Handler) RouterOption {
+	return func(r *router) {
+		r.revocationList = wrap
+	}
+}
+
+// router collects the configuration of NewRouter.
+type router struct {
+	prefix           string
+	paths            map[string]string
+	adminRoles       []string
+	unprotectedAdmin bool
+	rateLimiters     map[string]*RateLimiter
+	revocationList   func(http.Handler) http.Handler
+	proxies          *TrustedProxies
+}
+
+// NewRouter creates a ServeMux serving all handlers of the package at their default paths (see PathLogin etc.),
+// or at the paths configured with WithPrefix and WithPath.
+// JWKSHandler and RevocationListHandler accept GET and HEAD requests, all other handlers only POST requests,
+// other methods are rejected with 405 Method Not Allowed.
+// RevocationListHandler is only mounted with WithRevocationListHandler.
+// Admin handlers (SetRolesHandler, BlacklistHandler, UnblacklistHandler, LogoutAllHandler, ResetPasswordHandler,
+// ResetTOTPHandler, ClearLockoutHandler and RevokeTokenHandler) are protected with the middleware, so only
+// users with auth.RoleAdmin (or the roles of WithAdminRoles) can call them. They are not mounted if the middleware
+// is nil, unless WithUnprotectedAdminHandlers is passed.
+// More handlers can be added to the returned ServeMux.
+func NewRouter(registry *auth.Registry, middleware *auth.Middleware, opts ...RouterOption) *http.ServeMux {
+	r := &router{
+		paths:        make(map[string]string),
+		rateLimiters: make(map[string]*RateLimiter),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	mux := http.NewServeMux()
+
+	post := []string{http.MethodPost}
+	get := []string{http.MethodGet, http.MethodHead}
+
+	for _, route := range []struct {
+		path    string
+		handler http.Handler
+		methods []string
+	}{
+		{PathRegister, &RegisterHandler{Registry: registry}, post},
+		{PathLogin, &LoginHandler{Registry: registry}, post},
+		{PathLoginTOTP, &TOTPLoginHandler{Registry: registry}, post},
+		{PathRefresh, &RefreshHandler{Registry: registry}, post},
+		{PathLogout, &LogoutHandler{Registry: registry}, post},
+		{PathChangePassword, &ChangePasswordHandler{Registry: registry}, post},
+		{PathRequestPasswordReset, &RequestPasswordResetHandler{Registry: registry}, post},
+		{PathCompletePasswordReset, &CompletePasswordResetHandler{Registry: registry}, post},
+		{PathRequestEmailVerification, &RequestEmailVerificationHandler{Registry: registry}, post},
+		{PathVerifyEmail, &VerifyEmailHandler{Registry: registry}, post},
+		{PathEnrollTOTP, &EnrollTOTPHandler{Registry: registry}, post},
+		{PathConfirmTOTP, &ConfirmTOTPHandler{Registry: registry}, post},
+		{PathDisableTOTP, &DisableTOTPHandler{Registry: registry}, post},
+		{PathBeginWebAuthnRegistration, &BeginWebAuthnRegistrationHandler{Registry: registry}, post},
+		{PathFinishWebAuthnRegistration, &FinishWebAuthnRegistrationHandler{Registry: registry}, post},
+		{PathBeginWebAuthnLogin, &BeginWebAuthnLoginHandler{Registry: registry}, post},
+		{PathFinishWebAuthnLogin, &FinishWebAuthnLoginHandler{Registry: registry}, post},
+		{PathListSessions, &ListSessionsHandler{Registry: registry}, post},
+		{PathRevokeSession, &RevokeSessionHandler{Registry: registry}, post},
+		{PathJWKS, &JWKSHandler{Registry: registry}, get},
+	} {
+		r.handle(mux, route.path, route.handler, route.methods...)
+	}
+
+	if r.revocationList != nil {
+		r.handle(mux, PathRevocations, r.revocationList(&RevocationListHandler{Registry: registry}), get...)
+	}
+
+	if middleware == nil && !r.unprotectedAdmin {
+		return mux
+	}
+
+	for _, route := range []struct {
+		path    string
+		handler http.Handler
+	}{
+		{PathSetRoles, &SetRolesHandler{Registry: registry}},
+		{PathBlacklist, &BlacklistHandler{Registry: registry}},
+		{PathUnblacklist, &UnblacklistHandler{Registry: registry}},
+		{PathLogoutAll, &LogoutAllHandler{Registry: registry}},
+		{PathResetPassword, &ResetPasswordHandler{Registry: registry}},
+		{PathResetTOTP, &ResetTOTPHandler{Registry: registry}},
+		{PathClearLockout, &ClearLockoutHandler{Registry: registry}},
+		{PathRevokeToken, &RevokeTokenHandler{Registry: registry}},
+	} {
+		handler := route.handler
+		if !r.unprotectedAdmin {
+			handler = middleware.Wrap(handler, false, r.adminRoles...)
+		}
+
+		r.handle(mux, route.path, handler, post...)
+	}
+
+	return mux
+}
+
+// handle mounts the handler at its configured path, rate limited if configured.
+func (r *router) handle(mux *http.ServeMux, defaultPath string, handler http.Handler, methods ...string) {
+	path, ok := r.paths[defaultPath]
+	if !ok {
+		path = defaultPath
+	}
+
+	if path == "" {
+		return
+	}
+
+	// the rate limit applies before the middleware, so guessing access tokens is limited too
+	if limiter, ok := r.rateLimiters[defaultPath]; ok {
+		handler = limiter.Wrap(handler)
+	}
+
+	if r.proxies != nil {
+		handler = r.proxies.Wrap(handler)
+	}
+
+	mux.Handle(r.prefix+path, allowMethods(handler, methods...))
+}
+
+// allowMethods rejects requests with other methods with 405 Method Not Allowed.
+func allowMethods(next http.Handler, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		for _, method := range methods {
+			if request.Method == method {
+				next.ServeHTTP(writer, request)
+				return
+			}
+		}
+
+		writer.Header().Set("Allow", allow)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed"))
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"github.com/live-labs/auth"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const SECRET = "secret"
+
+func TestNewRouter(t *testing.T) {
+	storage, err := auth.NewSimpleFileStorage(filepath.Join(t.TempDir(), "users.dat"), "salt")
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	registry := auth.NewRegistry(storage, SECRET)
+	registry.Register("admin", "password1")
+	registry.SetRoles("admin", auth.RoleAdmin)
+	registry.Register("user1", "password1")
+
+	adminToken, _, err := registry.Login("admin", "password1")
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	userToken, _, err := registry.Login("user1", "password1")
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	serve := func(router http.Handler, method string, path string, token string, body string) int {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	router := NewRouter(registry, auth.NewMiddleware(SECRET))
+
+	for _, test := range []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		code   int
+	}{
+		{"login", http.MethodPost, "/login", "", `{"username":"user1","password":"password1"}`, http.StatusOK},
+		{"login with GET", http.MethodGet, "/login", "", "", http.StatusMethodNotAllowed},
+		{"jwks", http.MethodGet, "/.well-known/jwks.json", "", "", http.StatusOK},
+		{"jwks with POST", http.MethodPost, "/.well-known/jwks.json", "", "", http.StatusMethodNotAllowed},
+		{"revocations not mounted", http.MethodGet, "/revocations", adminToken, "", http.StatusNotFound},
+		{"unknown path", http.MethodPost, "/unknown", "", "", http.StatusNotFound},
+		{"admin without token", http.MethodPost, "/blacklist", "", `{"username":"user1"}`, http.StatusUnauthorized},
+		{"admin as user", http.MethodPost, "/blacklist", userToken, `{"username":"user1"}`, http.StatusUnauthorized},
+		{"admin", http.MethodPost, "/blacklist", adminToken, `{"username":"user1"}`, http.StatusOK},
+		{"admin with GET", http.MethodGet, "/unblacklist", adminToken, "", http.StatusMethodNotAllowed},
+	} {
+		if code := serve(router, test.method, test.path, test.token, test.body); code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+
+	router = NewRouter(registry, nil, WithPrefix("/auth/"), WithPath(PathLogin, "/sign-in"), WithPath(PathRegister, ""))
+
+	if code := serve(router, http.MethodPost, "/auth/sign-in", "", `{"username":"admin","password":"password1"}`); code != http.StatusOK {
+		t.Errorf("custom path: expected 200, got %d", code)
+	}
+
+	for _, path := range []string{"/login", "/auth/login", "/auth/register", "/auth/unblacklist"} {
+		if code := serve(router, http.MethodPost, path, adminToken, `{"username":"user1"}`); code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, code)
+		}
+	}
+
+	requireSecret := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if request.Header.Get("Authorization") != "Bearer revocations-secret" {
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+
+	router = NewRouter(auth.NewRegistry(storage, SECRET, auth.WithRevocationList(auth.NewRevocationList())), nil,
+		WithRevocationListHandler(requireSecret))
+
+	if code := serve(router, http.MethodGet, "/revocations", "", ""); code != http.StatusForbidden {
+		t.Errorf("revocations without secret: expected 403, got %d", code)
+	}
+
+	if code := serve(router, http.MethodGet, "/revocations", "revocations-secret", ""); code != http.StatusOK {
+		t.Errorf("revocations: expected 200, got %d", code)
+	}
+
+	limiter := NewRateLimiter(RateLimit{Requests: 1, Period: time.Minute}, KeyByIP)
+	router = NewRouter(registry, nil, WithUnprotectedAdminHandlers(), WithRateLimiter(PathUnblacklist, limiter))
+
+	if code := serve(router, http.MethodPost, "/unblacklist", "", `{"username":"user1"}`); code != http.StatusOK {
+		t.Errorf("unprotected admin handler: expected 200, got %d", code)
+	}
+
+	if code := serve(router, http.MethodPost, "/unblacklist", "", `{"username":"user1"}`); code != http.StatusTooManyRequests {
+		t.Errorf("rate limited handler: expected 429, got %d", code)
+	}
+}
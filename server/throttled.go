@@ -0,0 +1,22 @@
+package server
+
+import (
+	"errors"
+	"github.com/live-labs/auth"
+	"net/http"
+)
+
+// writeLoginThrottled writes a 429 response with a Retry-After header, if err is an *auth.LoginThrottledError.
+// It returns false and writes nothing for other errors.
+func writeLoginThrottled(writer http.ResponseWriter, err error) bool {
+	var throttled *auth.LoginThrottledError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+
+	writer.Header().Set("Retry-After", seconds(throttled.RetryAfter))
+	writer.WriteHeader(http.StatusTooManyRequests)
+	writer.Write([]byte(err.Error()))
+
+	return true
+}
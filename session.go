@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SessionNotFoundError is returned by RevokeSession, if the user has no session with the given ID.
+var SessionNotFoundError = errors.New("session not found")
+
+// Session is a login session of a user on one client. It starts with a login, and lives as long as
+// its refresh token is refreshed in time. Every refresh token of the session belongs to its family.
+type Session struct {
+	// ID identifies the session. It is the Family of its refresh tokens.
+	ID string
+	// CreatedAt is the time the user logged in and the session started.
+	CreatedAt time.Time
+	// LastUsedAt is the time of the last refresh, or of the login if the session was never refreshed.
+	LastUsedAt time.Time
+	// ExpiresAt is the time the session expires, unless it is refreshed before.
+	// Zero value means the session does not expire.
+	ExpiresAt time.Time
+	// Client describes the client of the session, as of the last refresh.
+	Client ClientInfo
+}
+
+// ListSessions lists the active sessions of the user, most recently used first,
+// e.g. to show the user where they are logged in.
+func (u *Registry) ListSessions(username string) ([]*Session, error) {
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return nil, fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil {
+		return nil, UnauthorizedError
+	}
+
+	tokens, err := u.refreshTokens.LoadUser(username)
+	if err != nil {
+		return nil, fmt.Errorf("error loading refresh tokens: %w", err)
+	}
+
+	now := u.now()
+
+	// one entry per session, even if the store returns several current tokens of a family
+	sessions := make(map[string]*Session)
+	for _, rt := range tokens {
+		session := u.session(rt, now)
+		if session == nil {
+			continue
+		}
+
+		if s, ok := sessions[session.ID]; !ok || s.LastUsedAt.Before(session.LastUsedAt) {
+			sessions[session.ID] = session
+		}
+	}
+
+	result := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, session)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].LastUsedAt.Equal(result[j].LastUsedAt) {
+			return result[i].LastUsedAt.After(result[j].LastUsedAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+
+	return result, nil
+}
+
+// CurrentSession returns the session of a current refresh token of the user, e.g. to mark
+// the session of the client in ListSessions, or to check that the client may list and revoke sessions.
+// It returns UnauthorizedError if the token is unknown, replaced, expired, or issued to another user.
+func (u *Registry) CurrentSession(username string, refreshToken string) (*Session, error) {
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	rt, err := u.refreshTokens.Load(refreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("error loading refresh token: %w", err)
+	}
+
+	if rt == nil || rt.Username != username {
+		return nil, UnauthorizedError
+	}
+
+	session := u.session(rt, u.now())
+	if session == nil {
+		return nil, UnauthorizedError
+	}
+
+	return session, nil
+}
+
+// RevokeSession logs the user out of one session by revoking all its refresh tokens, e.g. on a lost device.
+// Access tokens already issued in the session stay valid until they expire.
+// It returns SessionNotFoundError if the user has no session with the ID.
+func (u *Registry) RevokeSession(username string, sessionID string) error {
+	username = u.normalizeUsername(username)
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	// a concurrent refresh must not add a token to the revoked session
+	u.refreshLock.Lock()
+	defer u.refreshLock.Unlock()
+
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil {
+		return UnauthorizedError
+	}
+
+	tokens, err := u.refreshTokens.LoadUser(username)
+	if err != nil {
+		return fmt.Errorf("error loading refresh tokens: %w", err)
+	}
+
+	for _, rt := range tokens {
+		if rt.Family == sessionID {
+			return u.refreshTokens.DeleteFamily(sessionID)
+		}
+	}
+
+	return SessionNotFoundError
+}
+
+// session describes the session of the refresh token, if the token is current at the given time.
+// It returns nil for replaced and expired tokens.
+func (u *Registry) session(rt *RefreshToken, now time.Time) *Session {
+	if !rt.RotatedAt.IsZero() {
+		return nil
+	}
+
+	// the settings might have changed since the token was issued, see Refresh
+	expiresAt := rt.ExpiresAt
+	if limit := u.refreshTokenExpiry(rt.AuthenticatedAt, rt.CreatedAt); !limit.IsZero() && (expiresAt.IsZero() || limit.Before(expiresAt)) {
+		expiresAt = limit
+	}
+
+	if !expiresAt.IsZero() && !now.Before(expiresAt) {
+		return nil
+	}
+
+	createdAt := rt.AuthenticatedAt
+	if createdAt.IsZero() {
+		createdAt = rt.CreatedAt
+	}
+
+	return &Session{
+		ID:         rt.Family,
+		CreatedAt:  createdAt,
+		LastUsedAt: rt.CreatedAt,
+		ExpiresAt:  expiresAt,
+		Client:     rt.Client,
+	}
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegistry_Sessions(t *testing.T) {
+	c := &clock{now: time.Now()}
+	users := NewRegistry(newMockStorage(), secret, WithRefreshTokenIdleTimeout(time.Hour), WithSessionLifetime(24*time.Hour))
+	users.now = c.Now
+
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	started := c.Now()
+	_, laptop, err := users.LoginWithClient("user1", "password1", ClientInfo{IP: "192.0.2.1", UserAgent: "laptop"})
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	c.Advance(time.Minute)
+	_, phone, err := users.LoginWithClient("user1", "password1", ClientInfo{IP: "192.0.2.2", UserAgent: "phone"})
+	if err != nil {
+		t.Fatalf("error logging in: %v", err)
+	}
+
+	// the phone moved to another network, the laptop keeps its client
+	c.Advance(time.Minute)
+	_, phone, err = users.RefreshWithClient("user1", phone, ClientInfo{IP: "198.51.100.1", UserAgent: "phone"})
+	if err != nil {
+		t.Fatalf("error refreshing: %v", err)
+	}
+
+	c.Advance(time.Minute)
+	_, laptop, err = users.Refresh("user1", laptop)
+	if err != nil {
+		t.Fatalf("error refreshing: %v", err)
+	}
+
+	sessions, err := users.ListSessions("user1")
+	if err != nil {
+		t.Fatalf("error listing sessions: %v", err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+
+	if s := sessions[0]; s.Client.UserAgent != "laptop" || s.Client.IP != "192.0.2.1" || !s.CreatedAt.Equal(started) ||
+		!s.LastUsedAt.Equal(c.Now()) || !s.ExpiresAt.Equal(c.Now().Add(time.Hour)) {
+		t.Errorf("unexpected laptop session %+v", s)
+	}
+
+	if s := sessions[1]; s.Client.UserAgent != "phone" || s.Client.IP != "198.51.100.1" ||
+		!s.LastUsedAt.Equal(c.Now().Add(-time.Minute)) {
+		t.Errorf("unexpected phone session %+v", s)
+	}
+
+	current, err := users.CurrentSession("user1", phone)
+	if err != nil || current.ID != sessions[1].ID {
+		t.Fatalf("unexpected current session %+v: %v", current, err)
+	}
+
+	// the phone is lost
+	err = users.RevokeSession("user1", current.ID)
+	if err != nil {
+		t.Fatalf("error revoking session: %v", err)
+	}
+
+	if _, _, err = users.Refresh("user1", phone); !errors.Is(err, UnauthorizedError) {
+		t.Errorf("refreshed revoked session: %v", err)
+	}
+
+	if _, err = users.CurrentSession("user1", phone); !errors.Is(err, UnauthorizedError) {
+		t.Errorf("revoked session is current: %v", err)
+	}
+
+	if err = users.RevokeSession("user1", current.ID); !errors.Is(err, SessionNotFoundError) {
+		t.Errorf("expected session not found, got %v", err)
+	}
+
+	// sessions of other users can not be revoked
+	users.Register("user2", "password2")
+	if err = users.RevokeSession("user2", sessions[0].ID); !errors.Is(err, SessionNotFoundError) {
+		t.Errorf("expected session not found, got %v", err)
+	}
+
+	if _, err = users.CurrentSession("user2", laptop); !errors.Is(err, UnauthorizedError) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+
+	// idle sessions expire
+	c.Advance(time.Hour)
+	sessions, err = users.ListSessions("user1")
+	if err != nil || len(sessions) != 0 {
+		t.Errorf("expected no sessions, got %d: %v", len(sessions), err)
+	}
+
+	if _, err = users.ListSessions("unknown"); !errors.Is(err, UnauthorizedError) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+}
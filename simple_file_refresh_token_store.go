@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SimpleFileRefreshTokenStore is a simple file-based RefreshTokenStore implementation.
+// Tokens survive restarts of the server. Only SHA-256 hashes of the token values are
+// written to the file, so a leaked file can not be used to refresh sessions.
+// The file format is:
+// +unix_timestamp_nano:token_hash:{json encoded token data}
+// -unix_timestamp_nano:token_hash
+// file is append-only, so if a token is deleted, the line is added with -token_hash
+// There should be only one instance of SimpleFileRefreshTokenStore for a file.
+type SimpleFileRefreshTokenStore struct {
+	path      string
+	stateLock sync.Mutex
+
+	state map[string]*RefreshToken // token hash -> token
+}
+
+// refreshTokenRecord is the json encoded token data stored in the file.
+type refreshTokenRecord struct {
+	Username        string     `json:"username"`
+	Family          string     `json:"family"`
+	AuthenticatedAt time.Time  `json:"authenticated_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	Client          ClientInfo `json:"client"`
+	RotatedAt       time.Time  `json:"rotated_at"`
+}
+
+func newRefreshTokenRecord(t *RefreshToken) *refreshTokenRecord {
+	return &refreshTokenRecord{
+		Username:        t.Username,
+		Family:          t.Family,
+		AuthenticatedAt: t.AuthenticatedAt,
+		CreatedAt:       t.CreatedAt,
+		ExpiresAt:       t.ExpiresAt,
+		Client:          t.Client,
+		RotatedAt:       t.RotatedAt,
+	}
+}
+
+func NewSimpleFileRefreshTokenStore(path string) (*SimpleFileRefreshTokenStore, error) {
+
+	s := &SimpleFileRefreshTokenStore{
+		path:  path,
+		state: make(map[string]*RefreshToken),
+	}
+
+	err := s.loadState()
+	if err != nil {
+		return nil, fmt.Errorf("error loading state: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *SimpleFileRefreshTokenStore) open() (*os.File, error) {
+	return os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+func (s *SimpleFileRefreshTokenStore) loadState() error {
+	f, err := s.open()
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxRecordSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line[1:], ":", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("invalid line in file: %s", line)
+		}
+		hash := parts[1]
+
+		switch line[0] {
+		case '+':
+			if len(parts) != 3 {
+				return fmt.Errorf("invalid line in file: %s", line)
+			}
+
+			r := &refreshTokenRecord{}
+			err := json.Unmarshal([]byte(parts[2]), r)
+			if err != nil {
+				return fmt.Errorf("error unmarshaling refresh token: %w", err)
+			}
+
+			s.state[hash] = &RefreshToken{
+				Username:        r.Username,
+				Family:          r.Family,
+				AuthenticatedAt: r.AuthenticatedAt,
+				CreatedAt:       r.CreatedAt,
+				ExpiresAt:       r.ExpiresAt,
+				Client:          r.Client,
+				RotatedAt:       r.RotatedAt,
+			}
+		case '-':
+			delete(s.state, hash)
+		default:
+			return fmt.Errorf("invalid line in file: %s", line)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *SimpleFileRefreshTokenStore) Save(t *RefreshToken) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	f, err := s.open()
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(newRefreshTokenRecord(t))
+	if err != nil {
+		return fmt.Errorf("error marshaling refresh token: %w", err)
+	}
+
+	hash := hashToken(t.Token)
+
+	_, err = f.WriteString(fmt.Sprintf("+%d:%s:%s\n", time.Now().UnixNano(), hash, data))
+	if err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+
+	stored := *t
+	stored.Token = ""
+	s.state[hash] = &stored
+
+	return nil
+}
+
+func (s *SimpleFileRefreshTokenStore) Load(token string) (*RefreshToken, error) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	t, ok := s.state[hashToken(token)]
+	if !ok {
+		return nil, nil
+	}
+
+	result := *t
+	result.Token = token
+	return &result, nil
+}
+
+// LoadUser loads all tokens of the user. The Token values are empty, only their hashes are known.
+func (s *SimpleFileRefreshTokenStore) LoadUser(username string) ([]*RefreshToken, error) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	tokens := make([]*RefreshToken, 0)
+	for _, t := range s.state {
+		if t.Username == username {
+			result := *t
+			tokens = append(tokens, &result)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *SimpleFileRefreshTokenStore) Delete(token string) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	hash := hashToken(token)
+
+	if _, ok := s.state[hash]; !ok {
+		return nil
+	}
+
+	return s.delete(hash)
+}
+
+func (s *SimpleFileRefreshTokenStore) DeleteFamily(family string) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	hashes := make([]string, 0)
+	for hash, t := range s.state {
+		if t.Family == family {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return s.delete(hashes...)
+}
+
+func (s *SimpleFileRefreshTokenStore) DeleteUser(username string) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	hashes := make([]string, 0)
+	for hash, t := range s.state {
+		if t.Username == username {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return s.delete(hashes...)
+}
+
+// DeleteExpired deletes expired tokens and compacts the file, so it does not grow without bound.
+func (s *SimpleFileRefreshTokenStore) DeleteExpired(now time.Time) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	for hash, t := range s.state {
+		if t.Expired(now) {
+			delete(s.state, hash)
+		}
+	}
+
+	return s.compact()
+}
+
+// compact rewrites the file with the current state only. Must be called with the lock held.
+func (s *SimpleFileRefreshTokenStore) compact() error {
+	tmp := s.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	ts := time.Now().UnixNano()
+
+	for hash, t := range s.state {
+		data, err := json.Marshal(newRefreshTokenRecord(t))
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("error marshaling refresh token: %w", err)
+		}
+
+		_, err = fmt.Fprintf(w, "+%d:%s:%s\n", ts, hash, data)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("error writing to file: %w", err)
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// delete removes tokens by their hashes. Must be called with the lock held.
+func (s *SimpleFileRefreshTokenStore) delete(hashes ...string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	f, err := s.open()
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer f.Close()
+
+	ts := time.Now().UnixNano()
+
+	for _, hash := range hashes {
+		_, err = f.WriteString(fmt.Sprintf("-%d:%s\n", ts, hash))
+		if err != nil {
+			return fmt.Errorf("error writing to file: %w", err)
+		}
+
+		delete(s.state, hash)
+	}
+
+	return nil
+}
+
+// hashToken hashes a token value, so it can be stored without revealing the token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
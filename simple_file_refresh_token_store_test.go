@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const REFRESH_TOKEN_FILE = ".local/refresh_tokens.dat"
+
+func TestSimpleFileRefreshTokenStore_SaveLoad(t *testing.T) {
+	os.Remove(REFRESH_TOKEN_FILE)
+	store, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	created := time.Now().Truncate(time.Second)
+
+	err = store.Save(&RefreshToken{
+		Token:     "token1",
+		Username:  "test",
+		CreatedAt: created,
+		ExpiresAt: created.Add(time.Hour),
+		Client:    ClientInfo{IP: "127.0.0.1", UserAgent: "test-agent"},
+	})
+	if err != nil {
+		t.Errorf("error saving token: %v", err)
+	}
+
+	store2, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	rt, err := store2.Load("token1")
+	if err != nil {
+		t.Errorf("error loading token: %v", err)
+	}
+
+	if rt == nil {
+		t.Fatal("token is nil")
+	}
+
+	if rt.Token != "token1" || rt.Username != "test" {
+		t.Errorf("unexpected token %s of user %s", rt.Token, rt.Username)
+	}
+
+	if !rt.CreatedAt.Equal(created) || !rt.ExpiresAt.Equal(created.Add(time.Hour)) {
+		t.Errorf("unexpected token times %v, %v", rt.CreatedAt, rt.ExpiresAt)
+	}
+
+	if rt.Client.IP != "127.0.0.1" || rt.Client.UserAgent != "test-agent" {
+		t.Errorf("unexpected client %+v", rt.Client)
+	}
+
+	rt, err = store2.Load("token2")
+	if err != nil {
+		t.Errorf("error loading token: %v", err)
+	}
+
+	if rt != nil {
+		t.Error("unknown token loaded")
+	}
+
+	data, err := os.ReadFile(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), "token1") {
+		t.Error("token value written to file")
+	}
+}
+
+func TestSimpleFileRefreshTokenStore_Delete(t *testing.T) {
+	os.Remove(REFRESH_TOKEN_FILE)
+	store, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	err = store.Save(&RefreshToken{Token: "token1", Username: "test", CreatedAt: time.Now()})
+	if err != nil {
+		t.Errorf("error saving token: %v", err)
+	}
+
+	err = store.Delete("token1")
+	if err != nil {
+		t.Errorf("error deleting token: %v", err)
+	}
+
+	err = store.Delete("token1")
+	if err != nil {
+		t.Errorf("deleting missing token failed: %v", err)
+	}
+
+	store2, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	rt, err := store2.Load("token1")
+	if err != nil {
+		t.Errorf("error loading token: %v", err)
+	}
+
+	if rt != nil {
+		t.Error("deleted token loaded")
+	}
+}
+
+func TestSimpleFileRefreshTokenStore_Registry(t *testing.T) {
+	os.Remove(REFRESH_TOKEN_FILE)
+	store, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	ms := newMockStorage()
+
+	users := NewRegistry(ms, secret, WithRefreshTokenStore(store))
+	users.Register("user1", "password1")
+
+	_, refreshToken, err := users.LoginWithClient("user1", "password1", ClientInfo{IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	// restart of the server
+	store, err = NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	users = NewRegistry(ms, secret, WithRefreshTokenStore(store))
+
+	_, _, err = users.Refresh("user1", refreshToken)
+	if err != nil {
+		t.Errorf("refresh after restart failed: %v", err)
+	}
+
+	rt, _ := store.Load(refreshToken)
+	if rt == nil || rt.Client.IP != "10.0.0.1" {
+		t.Error("client metadata not stored")
+	}
+
+	// the client controls the User-Agent, it must not prevent the restart
+	_, refreshToken, err = users.LoginWithClient("user1", "password1", ClientInfo{UserAgent: strings.Repeat("x", 100<<10)})
+	if err != nil {
+		t.Fatal("login failed")
+	}
+
+	store, err = NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	rt, _ = store.Load(refreshToken)
+	if rt == nil || len(rt.Client.UserAgent) != maxClientUserAgentLength {
+		t.Error("User-Agent not truncated")
+	}
+}
+
+func TestSimpleFileRefreshTokenStore_DeleteFamily(t *testing.T) {
+	os.Remove(REFRESH_TOKEN_FILE)
+	store, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	store.Save(&RefreshToken{Token: "token1", Username: "test", Family: "f1", RotatedAt: time.Now()})
+	store.Save(&RefreshToken{Token: "token2", Username: "test", Family: "f1"})
+	store.Save(&RefreshToken{Token: "token3", Username: "test", Family: "f2"})
+
+	err = store.DeleteFamily("f1")
+	if err != nil {
+		t.Errorf("error deleting family: %v", err)
+	}
+
+	store2, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	for token, exists := range map[string]bool{"token1": false, "token2": false, "token3": true} {
+		rt, err := store2.Load(token)
+		if err != nil {
+			t.Errorf("error loading token: %v", err)
+		}
+
+		if (rt != nil) != exists {
+			t.Errorf("%s: expected exists=%v", token, exists)
+		}
+	}
+}
+
+func TestSimpleFileRefreshTokenStore_LoadUser(t *testing.T) {
+	os.Remove(REFRESH_TOKEN_FILE)
+	store, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	store.Save(&RefreshToken{Token: "token1", Username: "test", Family: "f1", RotatedAt: time.Now()})
+	store.Save(&RefreshToken{Token: "token2", Username: "test", Family: "f1"})
+	store.Save(&RefreshToken{Token: "token3", Username: "other", Family: "f2"})
+
+	store2, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	tokens, err := store2.LoadUser("test")
+	if err != nil {
+		t.Fatalf("error loading tokens: %v", err)
+	}
+
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(tokens))
+	}
+
+	for _, rt := range tokens {
+		if rt.Username != "test" || rt.Family != "f1" || rt.Token != "" {
+			t.Errorf("unexpected token %+v", rt)
+		}
+	}
+}
+
+func TestSimpleFileRefreshTokenStore_DeleteExpired(t *testing.T) {
+	os.Remove(REFRESH_TOKEN_FILE)
+	store, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	now := time.Now()
+
+	store.Save(&RefreshToken{Token: "expired", Username: "test", ExpiresAt: now.Add(-time.Minute)})
+	store.Save(&RefreshToken{Token: "active", Username: "test", ExpiresAt: now.Add(time.Minute)})
+	store.Save(&RefreshToken{Token: "forever", Username: "test"})
+	store.Delete("forever")
+
+	err = store.DeleteExpired(now)
+	if err != nil {
+		t.Fatalf("error deleting expired tokens: %v", err)
+	}
+
+	data, err := os.ReadFile(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("expected compacted file with 1 line, got %d", lines)
+	}
+
+	store2, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	if rt, _ := store2.Load("expired"); rt != nil {
+		t.Error("expired token loaded")
+	}
+
+	if rt, _ := store2.Load("active"); rt == nil {
+		t.Error("active token deleted")
+	}
+}
+
+func TestSimpleFileRefreshTokenStore_DeleteUser(t *testing.T) {
+	os.Remove(REFRESH_TOKEN_FILE)
+	store, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	store.Save(&RefreshToken{Token: "token1", Username: "test", Family: "f1"})
+	store.Save(&RefreshToken{Token: "token2", Username: "test", Family: "f2"})
+	store.Save(&RefreshToken{Token: "token3", Username: "other", Family: "f3"})
+
+	err = store.DeleteUser("test")
+	if err != nil {
+		t.Errorf("error deleting user tokens: %v", err)
+	}
+
+	store2, err := NewSimpleFileRefreshTokenStore(REFRESH_TOKEN_FILE)
+	if err != nil {
+		t.Fatalf("error initializing store: %v", err)
+	}
+
+	for token, exists := range map[string]bool{"token1": false, "token2": false, "token3": true} {
+		rt, err := store2.Load(token)
+		if err != nil {
+			t.Errorf("error loading token: %v", err)
+		}
+
+		if (rt != nil) != exists {
+			t.Errorf("%s: expected exists=%v", token, exists)
+		}
+	}
+}
@@ -2,10 +2,14 @@ package auth
 
 import (
 	"bufio"
+	"bytes"
 	"crypto"
+	_ "crypto/sha256" // legacy password hashes
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,16 +21,32 @@ import (
 // +unix_timestamp_nano:username:password_hash:role1,role2,role3:0|1:{json encoded user data}
 // -unix_timestamp_nano:username
 // file is append-only, so if a user is deleted, the line is added with -username
+// User fields without a column (e.g. Email) are stored in the json encoded user data with "auth." prefixed keys.
+// Passwords are hashed with a PasswordHasher, argon2id by default.
 // There should be only one instance of SimpleFileStorage for a file.
 type SimpleFileStorage struct {
 	path      string
-	salt      string
+	salt      string // only used to verify legacy password hashes
+	hasher    PasswordHasher
 	stateLock sync.Mutex
 
+	dummyHashOnce sync.Once
+	dummyHash     string
+
 	state          map[string]*User
 	passwordHashes map[string]string
+	totp           map[string]*TOTP
+	webAuthn       map[string][]*WebAuthnCredential
+
+	// upgradedHashes counts the legacy password hashes upgraded since the last compaction,
+	// whose records are still in the file
+	upgradedHashes int
 }
 
+// compactAfterUpgrades is the number of upgraded legacy password hashes, after which the file is compacted
+// without waiting for Compact.
+const compactAfterUpgrades = 100
+
 func (s *SimpleFileStorage) open() (*os.File, error) {
 	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
@@ -35,13 +55,26 @@ func (s *SimpleFileStorage) open() (*os.File, error) {
 	return f, nil
 }
 
+// NewSimpleFileStorage creates a storage in the file at path, hashing passwords with argon2id.
+// salt is the global salt of password hashes written by previous versions. Such hashes are
+// replaced with argon2id hashes when the user logs in next time (see ValidatePassword).
 func NewSimpleFileStorage(path, salt string) (*SimpleFileStorage, error) {
+	return NewSimpleFileStorageWithHasher(path, salt, NewArgon2idHasher())
+}
+
+// NewSimpleFileStorageWithHasher creates a storage in the file at path, hashing passwords with hasher.
+// Hashes written with other parameters or algorithms are still verified, and can be upgraded
+// by the Registry (see WithPasswordHasher).
+func NewSimpleFileStorageWithHasher(path, salt string, hasher PasswordHasher) (*SimpleFileStorage, error) {
 
 	sfs := &SimpleFileStorage{
 		path:           path,
 		state:          make(map[string]*User),
 		passwordHashes: make(map[string]string),
+		totp:           make(map[string]*TOTP),
+		webAuthn:       make(map[string][]*WebAuthnCredential),
 		salt:           salt,
+		hasher:         hasher,
 	}
 
 	err := sfs.loadState()
@@ -53,6 +86,10 @@ func NewSimpleFileStorage(path, salt string) (*SimpleFileStorage, error) {
 
 }
 
+// maxRecordSize limits the size of a record in the files of SimpleFileStorage (a user record including second
+// factors and passkeys) and SimpleFileRefreshTokenStore.
+const maxRecordSize = 16 << 20
+
 func (s *SimpleFileStorage) loadState() error {
 	f, err := s.open()
 	if err != nil {
@@ -61,10 +98,17 @@ func (s *SimpleFileStorage) loadState() error {
 	defer f.Close()
 
 	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxRecordSize)
 	for scanner.Scan() {
 		line := scanner.Text()
+		if line == "" {
+			continue
+		}
 
 		parts := strings.SplitN(line[1:], ":", 6)
+		if len(parts) < 2 || (line[0] == '+' && len(parts) < 6) {
+			return fmt.Errorf("invalid line in file: %s", line)
+		}
 		//timestamp := parts[0]
 		username := parts[1]
 
@@ -85,54 +129,134 @@ func (s *SimpleFileStorage) loadState() error {
 			rl.LoadFrom(roles)
 
 			// add user
-			s.state[username] = &User{
+			user := &User{
 				Username:    username,
 				Roles:       rl,
 				Blacklisted: banned,
 				Options:     userOptions,
 			}
+			err = s.decodeCredentials(username, userOptions)
+			if err != nil {
+				return fmt.Errorf("error unmarshaling credentials of %s: %w", username, err)
+			}
+			decodeUserOptions(user)
+
+			s.state[username] = user
 			s.passwordHashes[username] = passwordHash
 		case '-':
 			delete(s.state, username)
 			delete(s.passwordHashes, username)
+			delete(s.totp, username)
+			delete(s.webAuthn, username)
 		default:
 			return fmt.Errorf("invalid line in file: %s", line)
 		}
 	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+
 	return nil
 }
 
 func (s *SimpleFileStorage) Save(u *User) error {
+	err := checkStorableUsername(u.Username)
+	if err != nil {
+		return err
+	}
+
 	s.stateLock.Lock()
 	defer s.stateLock.Unlock()
 
+	err = s.write(u, s.passwordHashes[u.Username])
+	if err != nil {
+		return err
+	}
+
+	s.state[u.Username] = u
+
+	return nil
+}
+
+// write appends the user record to the file. Must be called with the lock held.
+func (s *SimpleFileStorage) write(u *User, passwordHash string) error {
+	record, err := s.record(u, passwordHash, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
 	f, err := s.open()
 	if err != nil {
 		return fmt.Errorf("error opening file: %w", err)
 	}
 	defer f.Close()
 
+	_, err = f.WriteString(record)
+	if err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+
+	return nil
+}
+
+// compact rewrites the file with the current state only, so previous records of the users
+// (e.g. with legacy password hashes) are removed. Must be called with the lock held.
+func (s *SimpleFileStorage) compact() error {
+	tmp := s.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
 	ts := time.Now().UnixNano()
 
+	for username, u := range s.state {
+		record, err := s.record(u, s.passwordHashes[username], ts)
+		if err == nil {
+			_, err = w.WriteString(record)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("error writing to file: %w", err)
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// record formats the user record of the file. Must be called with the lock held.
+func (s *SimpleFileStorage) record(u *User, passwordHash string, ts int64) (string, error) {
 	bl := 0
 	if u.Blacklisted {
 		bl = 1
 	}
 
-	options, err := json.Marshal(u.Options)
+	userOptions, err := s.encodeCredentials(u.Username, encodeUserOptions(u))
 	if err != nil {
-		return fmt.Errorf("error marshaling user options: %w", err)
+		return "", err
 	}
 
-	// write user to file
-	_, err = f.WriteString(fmt.Sprintf("+%d:%s:%s:%s:%d:%s\n", ts, u.Username, s.passwordHashes[u.Username], u.Roles.String(), bl, options))
+	options, err := json.Marshal(userOptions)
 	if err != nil {
-		return fmt.Errorf("error writing to file: %w", err)
+		return "", fmt.Errorf("error marshaling user options: %w", err)
 	}
 
-	s.state[u.Username] = u
-
-	return nil
+	return fmt.Sprintf("+%d:%s:%s:%s:%d:%s\n", ts, u.Username, passwordHash, u.Roles.String(), bl, options), nil
 }
 
 func (s *SimpleFileStorage) Load(username string) (*User, error) {
@@ -147,6 +271,10 @@ func (s *SimpleFileStorage) Load(username string) (*User, error) {
 }
 
 func (s *SimpleFileStorage) Delete(username string) error {
+	if checkStorableUsername(username) != nil {
+		return nil // such a user can not exist, and writing the name would corrupt the file
+	}
+
 	s.stateLock.Lock()
 	defer s.stateLock.Unlock()
 
@@ -166,65 +294,383 @@ func (s *SimpleFileStorage) Delete(username string) error {
 
 	delete(s.state, username)
 	delete(s.passwordHashes, username)
+	delete(s.totp, username)
+	delete(s.webAuthn, username)
 
 	return nil
 }
 
+// SetPassword hashes the password and sets it. The password is hashed without holding the lock,
+// so other operations do not wait for it.
 func (s *SimpleFileStorage) SetPassword(username string, password string) error {
-	s.stateLock.Lock()
-	defer s.stateLock.Unlock()
-
-	f, err := s.open()
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
+		return err
 	}
-	defer f.Close()
+
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
 
 	user, ok := s.state[username]
 	if !ok {
 		return fmt.Errorf("user not found")
 	}
 
-	ts := time.Now().UnixNano()
-	bl := 0
-	if user.Blacklisted {
-		bl = 1
+	err = s.write(user, hash)
+	if err != nil {
+		return err
 	}
 
-	options, err := json.Marshal(user.Options)
+	s.passwordHashes[username] = hash
+
+	return nil
+}
+
+// ValidatePassword validates the password of the user. A legacy password hash is replaced
+// with a hash of the storage's hasher on successful validation. The file keeps the legacy hash
+// until it is compacted (see Compact).
+// Validation takes the same time whether the user exists or not, and whether its hash is a legacy one.
+// The password is hashed without holding the lock, so validations do not wait for each other.
+func (s *SimpleFileStorage) ValidatePassword(username string, password string) (bool, error) {
+	s.stateLock.Lock()
+	_, ok := s.state[username]
+	hash, hasHash := s.passwordHashes[username]
+	s.stateLock.Unlock()
+
+	if !ok || !hasHash || hash == "" {
+		s.verifyDummyPassword(password)
+		return false, nil
+	}
+
+	if !isLegacyPasswordHash(hash) {
+		return s.hasher.Verify(hash, password)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(s.legacyHashPassword(password))) != 1 {
+		// a wrong password must take as long as for other users, not to reveal users with a legacy hash
+		s.verifyDummyPassword(password)
+		return false, nil
+	}
+
+	upgraded, err := s.hasher.Hash(password)
 	if err != nil {
-		return fmt.Errorf("error marshaling user options: %w", err)
+		return false, err
 	}
 
-	// write user to file
-	_, err = f.WriteString(fmt.Sprintf("+%d:%s:%s:%s:%d:%s\n", ts, username, s.hashPassword(password), s.state[username].Roles.String(), bl, options))
+	err = s.upgradePasswordHash(username, hash, upgraded)
 	if err != nil {
-		return fmt.Errorf("error writing to file: %w", err)
+		return false, fmt.Errorf("error upgrading password hash: %w", err)
 	}
 
-	s.passwordHashes[username] = s.hashPassword(password)
+	return true, nil
+}
+
+// upgradePasswordHash replaces the legacy password hash of the user, unless the password changed meanwhile.
+// The file is compacted after compactAfterUpgrades upgrades, so migrating many users does not rewrite
+// the file on every login.
+func (s *SimpleFileStorage) upgradePasswordHash(username string, legacy string, hash string) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	user, ok := s.state[username]
+	if !ok || s.passwordHashes[username] != legacy {
+		return nil
+	}
+
+	err := s.write(user, hash)
+	if err != nil {
+		return err
+	}
+
+	s.passwordHashes[username] = hash
+	s.upgradedHashes++
+
+	if s.upgradedHashes >= compactAfterUpgrades {
+		// the hash is upgraded already, a failed compaction is retried by the next upgrade or Compact
+		s.compactUpgraded()
+	}
 
 	return nil
 }
 
-func (s *SimpleFileStorage) ValidatePassword(username string, password string) (bool, error) {
+// Compact rewrites the file without the legacy password hashes upgraded since the last compaction
+// (see ValidatePassword). It does nothing if no hashes were upgraded. Registry.Sweep calls it.
+func (s *SimpleFileStorage) Compact() error {
 	s.stateLock.Lock()
 	defer s.stateLock.Unlock()
 
-	_, ok := s.state[username]
+	if s.upgradedHashes == 0 {
+		return nil
+	}
+
+	return s.compactUpgraded()
+}
+
+// compactUpgraded compacts the file and resets the count of upgraded hashes. Must be called with the lock held.
+func (s *SimpleFileStorage) compactUpgraded() error {
+	err := s.compact()
+	if err != nil {
+		return err
+	}
+
+	s.upgradedHashes = 0
+
+	return nil
+}
+
+// PasswordHash returns the password hash of the user, or an empty string if the user has no password.
+func (s *SimpleFileStorage) PasswordHash(username string) (string, error) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	return s.passwordHashes[username], nil
+}
+
+// SaveTOTP saves the TOTP enrollment of the user in the user options. Nil removes the enrollment.
+func (s *SimpleFileStorage) SaveTOTP(username string, t *TOTP) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	user, ok := s.state[username]
 	if !ok {
-		return false, nil
+		return fmt.Errorf("user not found")
+	}
+
+	previous := s.totp[username]
+	s.setTOTP(username, t)
+
+	err := s.write(user, s.passwordHashes[username])
+	if err != nil {
+		s.setTOTP(username, previous)
+		return err
 	}
 
-	hash, ok := s.passwordHashes[username]
+	return nil
+}
+
+// LoadTOTP loads the TOTP enrollment of the user. Returns nil if the user is not enrolled.
+func (s *SimpleFileStorage) LoadTOTP(username string) (*TOTP, error) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	return copyTOTP(s.totp[username]), nil
+}
+
+// setTOTP keeps a copy of the TOTP enrollment, so that callers can not modify it without saving.
+// Must be called with the lock held.
+func (s *SimpleFileStorage) setTOTP(username string, t *TOTP) {
+	if t == nil {
+		delete(s.totp, username)
+		return
+	}
+	s.totp[username] = copyTOTP(t)
+}
+
+// SaveWebAuthnCredential adds the credential of the user in the user options, or replaces the credential
+// with the same ID.
+func (s *SimpleFileStorage) SaveWebAuthnCredential(username string, c *WebAuthnCredential) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	user, ok := s.state[username]
 	if !ok {
-		return false, nil
+		return fmt.Errorf("user not found")
+	}
+
+	previous := s.webAuthn[username]
+
+	credentials := make([]*WebAuthnCredential, 0, len(previous)+1)
+	for _, existing := range previous {
+		if !bytes.Equal(existing.ID, c.ID) {
+			credentials = append(credentials, existing)
+		}
+	}
+	s.webAuthn[username] = append(credentials, copyWebAuthnCredential(c))
+
+	err := s.write(user, s.passwordHashes[username])
+	if err != nil {
+		s.webAuthn[username] = previous
+		return err
+	}
+
+	return nil
+}
+
+// LoadWebAuthnCredentials loads the credentials of the user.
+func (s *SimpleFileStorage) LoadWebAuthnCredentials(username string) ([]*WebAuthnCredential, error) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	credentials := make([]*WebAuthnCredential, len(s.webAuthn[username]))
+	for i, c := range s.webAuthn[username] {
+		credentials[i] = copyWebAuthnCredential(c)
+	}
+	return credentials, nil
+}
+
+// WebAuthnCredentialUser returns the username of the user having the credential with the ID.
+func (s *SimpleFileStorage) WebAuthnCredentialUser(id []byte) (string, error) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	for username, credentials := range s.webAuthn {
+		for _, c := range credentials {
+			if bytes.Equal(c.ID, id) {
+				return username, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// verifyDummyPassword verifies the password against a hash of a dummy password,
+// so that validation takes the same time for users without a password hash.
+func (s *SimpleFileStorage) verifyDummyPassword(password string) {
+	s.dummyHashOnce.Do(func() {
+		s.dummyHash, _ = s.hasher.Hash("dummy password")
+	})
+	s.hasher.Verify(s.dummyHash, password)
+}
+
+// Keys of the user fields stored in the user options.
+const (
+	optionPrefix            = "auth."
+	optionEmail             = "auth.email"
+	optionEmailVerified     = "auth.email_verified"
+	optionLastLoginAt       = "auth.last_login_at"
+	optionLastLoginIP       = "auth.last_login_ip"
+	optionFailedLogins      = "auth.failed_logins"
+	optionLastFailedLoginAt = "auth.last_failed_login_at"
+	optionTOTP              = "auth.totp"
+	optionWebAuthn          = "auth.webauthn"
+)
+
+// encodeUserOptions returns the options of the user, with the user fields stored in the options added.
+// Options of the user with the reserved "auth." prefix are dropped, so they cannot be read back as user fields
+// or credentials, e.g. if the application stores user-controlled data in the options.
+func encodeUserOptions(u *User) map[string]string {
+	options := make(map[string]string, len(u.Options)+6)
+	for k, v := range u.Options {
+		if strings.HasPrefix(k, optionPrefix) {
+			continue
+		}
+		options[k] = v
+	}
+
+	if u.Email != "" {
+		options[optionEmail] = u.Email
+	}
+
+	if u.EmailVerified {
+		options[optionEmailVerified] = "1"
+	}
+
+	if !u.LastLoginAt.IsZero() {
+		options[optionLastLoginAt] = u.LastLoginAt.Format(time.RFC3339Nano)
 	}
 
-	return hash == s.hashPassword(password), nil
+	if u.LastLoginIP != "" {
+		options[optionLastLoginIP] = u.LastLoginIP
+	}
+
+	if u.FailedLogins != 0 {
+		options[optionFailedLogins] = strconv.Itoa(u.FailedLogins)
+	}
+
+	if !u.LastFailedLoginAt.IsZero() {
+		options[optionLastFailedLoginAt] = u.LastFailedLoginAt.Format(time.RFC3339Nano)
+	}
+
+	return options
+}
+
+// decodeUserOptions moves the user fields stored in the options to the user.
+func decodeUserOptions(u *User) {
+	u.Email = u.Options[optionEmail]
+	u.EmailVerified = u.Options[optionEmailVerified] == "1"
+	// malformed values are ignored, the activity is informational
+	u.LastLoginAt, _ = time.Parse(time.RFC3339Nano, u.Options[optionLastLoginAt])
+	u.LastLoginIP = u.Options[optionLastLoginIP]
+	u.FailedLogins, _ = strconv.Atoi(u.Options[optionFailedLogins])
+	u.LastFailedLoginAt, _ = time.Parse(time.RFC3339Nano, u.Options[optionLastFailedLoginAt])
+
+	for _, key := range []string{optionEmail, optionEmailVerified, optionLastLoginAt, optionLastLoginIP,
+		optionFailedLogins, optionLastFailedLoginAt} {
+		delete(u.Options, key)
+	}
+}
+
+// encodeCredentials adds the second factors and passkeys of the user to the options.
+// Must be called with the lock held.
+func (s *SimpleFileStorage) encodeCredentials(username string, options map[string]string) (map[string]string, error) {
+	if t := s.totp[username]; t != nil {
+		totp, err := json.Marshal(t)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling TOTP: %w", err)
+		}
+		options[optionTOTP] = string(totp)
+	}
+
+	if credentials := s.webAuthn[username]; len(credentials) > 0 {
+		webAuthn, err := json.Marshal(credentials)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling WebAuthn credentials: %w", err)
+		}
+		options[optionWebAuthn] = string(webAuthn)
+	}
+
+	return options, nil
+}
+
+// decodeCredentials moves the second factors and passkeys stored in the options to the storage.
+// Must be called with the lock held.
+func (s *SimpleFileStorage) decodeCredentials(username string, options map[string]string) error {
+	var totp *TOTP
+	if value, ok := options[optionTOTP]; ok {
+		totp = &TOTP{}
+		err := json.Unmarshal([]byte(value), totp)
+		if err != nil {
+			return err
+		}
+	}
+	s.setTOTP(username, totp)
+
+	var credentials []*WebAuthnCredential
+	if value, ok := options[optionWebAuthn]; ok {
+		err := json.Unmarshal([]byte(value), &credentials)
+		if err != nil {
+			return err
+		}
+	}
+	if len(credentials) > 0 {
+		s.webAuthn[username] = credentials
+	} else {
+		delete(s.webAuthn, username)
+	}
+
+	delete(options, optionTOTP)
+	delete(options, optionWebAuthn)
+
+	return nil
+}
+
+// checkStorableUsername checks that the username does not contain characters of the file format:
+// the field separator ":" and line breaks.
+func checkStorableUsername(username string) error {
+	if username == "" || strings.ContainsAny(username, ":\r\n") {
+		return fmt.Errorf("invalid username %q: must not be empty or contain ':' or line breaks", username)
+	}
+	return nil
+}
+
+// isLegacyPasswordHash checks if the hash was written by a previous version, which did not use PHC format.
+func isLegacyPasswordHash(hash string) bool {
+	return !strings.HasPrefix(hash, "$")
 }
 
-func (s *SimpleFileStorage) hashPassword(password string) string {
+// legacyHashPassword computes password hashes of previous versions.
+// Note that it does not hash the password, but appends the hash of nothing to it.
+func (s *SimpleFileStorage) legacyHashPassword(password string) string {
 	hash := crypto.SHA256.New().Sum([]byte(password + s.salt))
 	return fmt.Sprintf("%x", hash)
 }
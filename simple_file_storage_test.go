@@ -1,8 +1,12 @@
 package auth
 
 import (
+	"crypto"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 const STORAGE_FILE = ".local/storage.dat"
@@ -115,6 +119,121 @@ func TestSimpleFileStorage_Save_Load_Auth(t *testing.T) {
 
 }
 
+func TestSimpleFileStorage_Email(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	err = storage.Save(&User{
+		Username:      "test",
+		Roles:         NewRoleSet(),
+		Email:         "test@example.com",
+		EmailVerified: true,
+		Options:       map[string]string{"theme": "dark"},
+	})
+	if err != nil {
+		t.Fatalf("error saving user: %v", err)
+	}
+
+	storage2, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	user, _ := storage2.Load("test")
+	if user == nil || user.Email != "test@example.com" || !user.EmailVerified {
+		t.Fatalf("email not persisted: %+v", user)
+	}
+
+	if len(user.Options) != 1 || user.Options["theme"] != "dark" {
+		t.Errorf("unexpected options %v", user.Options)
+	}
+}
+
+func TestSimpleFileStorage_ReservedOptions(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	err = storage.Save(&User{
+		Username: "test",
+		Roles:    NewRoleSet(),
+		Options: map[string]string{
+			"theme":              "dark",
+			optionEmailVerified:  "1",
+			optionTOTP:           `{"secret":"JBSWY3DPEHPK3PXP"}`,
+			optionWebAuthn:       `[{"id":"AQ=="}]`,
+			optionPrefix + "new": "value",
+		},
+	})
+	if err != nil {
+		t.Fatalf("error saving user: %v", err)
+	}
+
+	storage2, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	user, _ := storage2.Load("test")
+	if user == nil || user.EmailVerified {
+		t.Fatalf("reserved option loaded as user field: %+v", user)
+	}
+
+	if len(user.Options) != 1 || user.Options["theme"] != "dark" {
+		t.Errorf("unexpected options %v", user.Options)
+	}
+
+	totp, _ := storage2.LoadTOTP("test")
+	credentials, _ := storage2.LoadWebAuthnCredentials("test")
+	if totp != nil || len(credentials) != 0 {
+		t.Errorf("reserved options loaded as credentials: %v %v", totp, credentials)
+	}
+}
+
+func TestSimpleFileStorage_LoginActivity(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	lastLogin := time.Date(2024, 5, 1, 12, 0, 0, 123, time.UTC)
+	lastFailure := lastLogin.Add(time.Hour)
+
+	err = storage.Save(&User{
+		Username:          "test",
+		Roles:             NewRoleSet(),
+		LastLoginAt:       lastLogin,
+		LastLoginIP:       "2001:db8::1",
+		FailedLogins:      3,
+		LastFailedLoginAt: lastFailure,
+		Options:           map[string]string{},
+	})
+	if err != nil {
+		t.Fatalf("error saving user: %v", err)
+	}
+
+	storage2, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	user, _ := storage2.Load("test")
+	if user == nil || !user.LastLoginAt.Equal(lastLogin) || user.LastLoginIP != "2001:db8::1" ||
+		user.FailedLogins != 3 || !user.LastFailedLoginAt.Equal(lastFailure) {
+		t.Fatalf("login activity not persisted: %+v", user)
+	}
+
+	if len(user.Options) != 0 {
+		t.Errorf("unexpected options %v", user.Options)
+	}
+}
+
 func TestSimpleFileStorage_Delete(t *testing.T) {
 	os.Remove(STORAGE_FILE)
 	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
@@ -170,3 +289,245 @@ func TestSimpleFileStorage_Delete(t *testing.T) {
 	}
 
 }
+
+func TestSimpleFileStorage_PasswordHash(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	for _, username := range []string{"test1", "test2"} {
+		err = storage.Save(&User{Username: username, Roles: NewRoleSet()})
+		if err != nil {
+			t.Errorf("error saving user: %v", err)
+		}
+
+		err = storage.SetPassword(username, "same password")
+		if err != nil {
+			t.Errorf("error setting password: %v", err)
+		}
+	}
+
+	hash1 := storage.passwordHashes["test1"]
+	hash2 := storage.passwordHashes["test2"]
+
+	if !strings.HasPrefix(hash1, "$argon2id$v=19$") {
+		t.Errorf("unexpected password hash format: %s", hash1)
+	}
+
+	if hash1 == hash2 {
+		t.Error("same password hashed with the same salt")
+	}
+
+	v, err := storage.ValidatePassword("test1", "other password")
+	if err != nil {
+		t.Errorf("error validating password: %v", err)
+	}
+
+	if v {
+		t.Error("password validation should fail")
+	}
+}
+
+func TestSimpleFileStorage_LegacyPasswordUpgrade(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+
+	// a user written by a previous version
+	legacy := fmt.Sprintf("%x", crypto.SHA256.New().Sum([]byte("test"+SALT)))
+	err := os.WriteFile(STORAGE_FILE, []byte(fmt.Sprintf("+1:test:%s:test_role:0:{}\n", legacy)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	v, err := storage.ValidatePassword("test", "wrong")
+	if err != nil {
+		t.Errorf("error validating password: %v", err)
+	}
+
+	if v {
+		t.Error("password validation should fail")
+	}
+
+	if storage.passwordHashes["test"] != legacy {
+		t.Error("password hash upgraded after failed validation")
+	}
+
+	v, err = storage.ValidatePassword("test", "test")
+	if err != nil {
+		t.Errorf("error validating password: %v", err)
+	}
+
+	if !v {
+		t.Error("legacy password validation should succeed")
+	}
+
+	// the upgraded hash is appended, the legacy one is removed by the compaction in Sweep
+	if storage.upgradedHashes != 1 {
+		t.Errorf("expected 1 upgraded hash, got %d", storage.upgradedHashes)
+	}
+
+	err = NewRegistry(storage, secret).Sweep()
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+
+	data, err := os.ReadFile(STORAGE_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), legacy) || storage.upgradedHashes != 0 {
+		t.Error("legacy password hash kept in file")
+	}
+
+	storage2, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	if !strings.HasPrefix(storage2.passwordHashes["test"], "$argon2id$") {
+		t.Errorf("legacy password hash not upgraded: %s", storage2.passwordHashes["test"])
+	}
+
+	v, err = storage2.ValidatePassword("test", "test")
+	if err != nil {
+		t.Errorf("error validating password: %v", err)
+	}
+
+	if !v {
+		t.Error("upgraded password validation should succeed")
+	}
+
+	user, _ := storage2.Load("test")
+	if user == nil || !user.Roles.HasAll("test_role") {
+		t.Error("user data lost on upgrade")
+	}
+}
+
+func TestSimpleFileStorage_ValidatePasswordMissingUser(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	storage.Save(&User{Username: "test", Roles: NewRoleSet()})
+	storage.SetPassword("test", "test")
+	storage.Save(&User{Username: "nopassword", Roles: NewRoleSet()})
+	storage.Save(&User{Username: "legacy", Roles: NewRoleSet()})
+	storage.passwordHashes["legacy"] = storage.legacyHashPassword("test")
+
+	measure := func(username string) time.Duration {
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			v, err := storage.ValidatePassword(username, "wrong")
+			if err != nil || v {
+				t.Errorf("%s: password validation should fail", username)
+			}
+		}
+		return time.Since(start)
+	}
+
+	measure("missing") // compute the dummy hash
+
+	existing := measure("test")
+
+	// the hash function dominates the time, so a missing hash must not be orders of magnitude faster
+	for _, username := range []string{"missing", "nopassword", "legacy"} {
+		if d := measure(username); d < existing/3 {
+			t.Errorf("%s: validation took %v, existing user %v", username, d, existing)
+		}
+	}
+}
+
+// blockingHasher blocks hashing and verifying passwords until released, like a slow hasher.
+type blockingHasher struct {
+	PasswordHasher
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHasher) Verify(hash string, password string) (bool, error) {
+	h.entered <- struct{}{}
+	<-h.release
+	return h.PasswordHasher.Verify(hash, password)
+}
+
+func TestSimpleFileStorage_HashingWithoutLock(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	hasher := &blockingHasher{PasswordHasher: &BcryptHasher{Cost: 4}, entered: make(chan struct{}), release: make(chan struct{})}
+	storage, err := NewSimpleFileStorageWithHasher(STORAGE_FILE, SALT, hasher)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	storage.Save(&User{Username: "test", Roles: NewRoleSet()})
+	storage.SetPassword("test", "test")
+
+	validated := make(chan bool)
+	go func() {
+		v, _ := storage.ValidatePassword("test", "test")
+		validated <- v
+	}()
+	<-hasher.entered
+
+	// other operations do not wait for the validation
+	done := make(chan struct{})
+	go func() {
+		storage.Save(&User{Username: "other", Roles: NewRoleSet()})
+		storage.Load("test")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("storage locked while validating password")
+	}
+
+	close(hasher.release)
+	if !<-validated {
+		t.Error("password validation failed")
+	}
+}
+
+func TestSimpleFileStorage_LongRecord(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	// longer than the default limit of bufio.Scanner
+	long := strings.Repeat("x", 100<<10)
+
+	storage.Save(&User{Username: "long", Roles: NewRoleSet(), Options: map[string]string{"long": long}})
+	storage.Save(&User{Username: "test", Roles: NewRoleSet(), Options: map[string]string{}})
+
+	storage2, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	if user, _ := storage2.Load("long"); user == nil || user.Options["long"] != long {
+		t.Error("long record not loaded")
+	}
+
+	if user, _ := storage2.Load("test"); user == nil {
+		t.Error("record after long record not loaded")
+	}
+
+	// records over the limit fail loading, instead of being silently skipped
+	storage2.Save(&User{Username: "huge", Roles: NewRoleSet(), Options: map[string]string{"huge": strings.Repeat("x", maxRecordSize)}})
+
+	_, err = NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err == nil {
+		t.Error("loaded file with record over the limit")
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 // Storage is an interface for user storage. It is used by Registry.
 // It should be implemented by the user of the library.
+// Implementations must be safe for concurrent use.
 type Storage interface {
 	// Save saves a new user or updates an existing one.
 	Save(u *User) error
@@ -13,7 +14,22 @@ type Storage interface {
 	// SetPassword sets a password for a user. Missing user should not return error.
 	SetPassword(username string, password string) error
 	// ValidatePassword validates a password for a user. Missing user should not return error,
-	// but should return false.
+	// but should return false. Hashes must be compared in constant time, and a missing user should
+	// take as long as a wrong password, so the response time does not reveal which users exist.
 	ValidatePassword(username string, password string) (bool, error) // should return false if user not found
 
 }
+
+// CompactingStorage is an optional interface of a Storage, which is compacted by Registry.Sweep.
+type CompactingStorage interface {
+	// Compact removes data not needed anymore, e.g. replaced records of users.
+	Compact() error
+}
+
+// PasswordHashStorage is an optional interface of a Storage, which hashes passwords with a PasswordHasher.
+// It allows the Registry to upgrade outdated password hashes on login (see WithPasswordHasher).
+type PasswordHashStorage interface {
+	// PasswordHash returns the password hash of the user. Missing user should not return error,
+	// but an empty hash.
+	PasswordHash(username string) (string, error)
+}
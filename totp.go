@@ -0,0 +1,436 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod    = 30 // seconds
+	totpDigits    = 6
+	totpSkew      = 1 // steps accepted before and after the current one, to allow for clock drift
+	totpSecretLen = 20
+
+	recoveryCodeCount = 10
+)
+
+var totpBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP is the enrollment of a user in time-based one-time password authentication (RFC 6238),
+// with HMAC-SHA1, 6 digits and 30 second steps, as supported by common authenticator apps.
+type TOTP struct {
+	// Secret is the shared secret. It must be kept as confidential as the password.
+	Secret []byte `json:"secret"`
+	// Confirmed is set once the user proved to have set up the authenticator (see Registry.ConfirmTOTP).
+	// Unconfirmed enrollments are not required at login.
+	Confirmed bool `json:"confirmed"`
+	// LastStep is the time step of the last accepted code, so that a code can not be used twice.
+	LastStep int64 `json:"last_step"`
+	// RecoveryCodes are hashes of the unused recovery codes.
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// TOTPStorage is an optional interface of a Storage, which stores TOTP enrollments of users.
+// Registry requires it for two-factor authentication (see Registry.EnrollTOTP).
+// Storage.Delete must delete the enrollment of the user too.
+type TOTPStorage interface {
+	// SaveTOTP saves the TOTP enrollment of the user. Nil removes the enrollment.
+	SaveTOTP(username string, t *TOTP) error
+	// LoadTOTP loads the TOTP enrollment of the user. Returns nil if the user is not enrolled.
+	LoadTOTP(username string) (*TOTP, error)
+}
+
+// copyTOTP returns a deep copy of the enrollment, or nil.
+func copyTOTP(t *TOTP) *TOTP {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	c.Secret = append([]byte(nil), t.Secret...)
+	c.RecoveryCodes = append([]string(nil), t.RecoveryCodes...)
+	return &c
+}
+
+// MFARequiredError is returned by Login if the password is correct, but the user has to confirm the login
+// with a second factor (see Registry.CompleteMFALogin).
+type MFARequiredError struct {
+	// ChallengeToken identifies the login attempt. It can be used once.
+	ChallengeToken string
+	// ExpiresAt is the time the challenge token expires.
+	ExpiresAt time.Time
+}
+
+func (e *MFARequiredError) Error() string {
+	return "second factor required"
+}
+
+// totpStep returns the time step of the time.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode computes the code of the time step (HOTP, RFC 4226, with the step as counter).
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// validate checks the code at the given time, and returns its time step.
+// Codes of the last accepted step or earlier are rejected.
+func (t *TOTP) validate(code string, now time.Time) (int64, bool) {
+	current := totpStep(now)
+
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(t.Secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// useRecoveryCode removes the recovery code from the enrollment, and reports whether it was valid.
+func (t *TOTP) useRecoveryCode(code string) bool {
+	hash := hashToken(normalizeRecoveryCode(code))
+
+	for i, c := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(hash)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i:i], t.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// generateRecoveryCodes generates recovery codes, and returns them with their hashes.
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error generating recovery code: %w", err)
+		}
+
+		code := strings.ToLower(totpBase32.EncodeToString(b))
+		code = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes of recovery codes typed by users.
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// totpURI returns the provisioning URI of the secret, which authenticator apps read from a QR code.
+// See https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpURI(issuer string, username string, secret []byte) string {
+	label := url.PathEscape(username)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+
+	params := url.Values{}
+	params.Set("secret", totpBase32.EncodeToString(secret))
+	if issuer != "" {
+		params.Set("issuer", issuer)
+	}
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpStorage returns the storage of TOTP enrollments.
+func (u *Registry) totpStorage() (TOTPStorage, error) {
+	storage, ok := u.storage.(TOTPStorage)
+	if !ok {
+		return nil, errors.New("storage does not support TOTP")
+	}
+	return storage, nil
+}
+
+// EnrollTOTP starts the TOTP enrollment of the user, who has to present the password.
+// It returns the secret (base32 encoded) and its provisioning URI, which is usually shown as a QR code.
+// The enrollment takes effect once it is confirmed with a code from the authenticator (see ConfirmTOTP).
+// The issuer of the Registry (see WithIssuer) is shown by authenticator apps.
+func (u *Registry) EnrollTOTP(username string, password string) (secret string, uri string, err error) {
+	username = u.normalizeUsername(username)
+
+	storage, err := u.totpStorage()
+	if err != nil {
+		return "", "", err
+	}
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	defer u.lockUser(username)()
+
+	user, err := u.authenticate(username, password, ClientInfo{})
+	if err != nil {
+		return "", "", err
+	}
+
+	t, err := storage.LoadTOTP(username)
+	if err != nil {
+		return "", "", fmt.Errorf("error loading TOTP: %w", err)
+	}
+
+	if t != nil && t.Confirmed {
+		return "", "", errors.New("TOTP already enabled")
+	}
+
+	u.passwordSucceeded(user)
+
+	t = &TOTP{Secret: make([]byte, totpSecretLen)}
+	_, err = rand.Read(t.Secret)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating secret: %w", err)
+	}
+
+	err = storage.SaveTOTP(username, t)
+	if err != nil {
+		return "", "", fmt.Errorf("error saving TOTP: %w", err)
+	}
+
+	return totpBase32.EncodeToString(t.Secret), totpURI(u.issuer, username, t.Secret), nil
+}
+
+// ConfirmTOTP confirms the TOTP enrollment of the user with a code from the authenticator, and enables
+// two-factor authentication. It returns recovery codes, which the user should keep in a safe place: each
+// of them can be used once instead of a code, e.g. when the authenticator is lost.
+func (u *Registry) ConfirmTOTP(username string, code string) (recoveryCodes []string, err error) {
+	username = u.normalizeUsername(username)
+
+	storage, err := u.totpStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return nil, fmt.Errorf("error loading user: %w", err)
+	}
+
+	// codes are guessed like passwords, so they are limited alike
+	err = u.checkLoginLimiter(username, user, ClientInfo{})
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := storage.LoadTOTP(username)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TOTP: %w", err)
+	}
+
+	if t == nil || t.Confirmed {
+		return nil, UnauthorizedError
+	}
+
+	step, ok := t.validate(code, u.now())
+	if !ok {
+		u.loginFailed(username, user, ClientInfo{})
+		return nil, UnauthorizedError
+	}
+
+	recoveryCodes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	t.Confirmed = true
+	t.LastStep = step
+	t.RecoveryCodes = hashes
+
+	err = storage.SaveTOTP(username, t)
+	if err != nil {
+		return nil, fmt.Errorf("error saving TOTP: %w", err)
+	}
+
+	return recoveryCodes, nil
+}
+
+// DisableTOTP disables two-factor authentication of the user, who has to present the password and a code
+// (or a recovery code).
+func (u *Registry) DisableTOTP(username string, password string, code string) error {
+	username = u.normalizeUsername(username)
+
+	storage, err := u.totpStorage()
+	if err != nil {
+		return err
+	}
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	defer u.lockUser(username)()
+
+	user, err := u.authenticate(username, password, ClientInfo{})
+	if err != nil {
+		return err
+	}
+
+	t, err := storage.LoadTOTP(username)
+	if err != nil {
+		return fmt.Errorf("error loading TOTP: %w", err)
+	}
+
+	if t == nil || !t.Confirmed {
+		return UnauthorizedError
+	}
+
+	_, ok := t.validate(code, u.now())
+	if !ok && !t.useRecoveryCode(code) {
+		u.loginFailed(username, user, ClientInfo{})
+		return UnauthorizedError
+	}
+
+	u.resetLoginFailures(user)
+
+	return storage.SaveTOTP(username, nil)
+}
+
+// ResetTOTP disables two-factor authentication of the user without a code, e.g. by an admin
+// when the user lost the authenticator and the recovery codes.
+func (u *Registry) ResetTOTP(username string) error {
+	username = u.normalizeUsername(username)
+
+	storage, err := u.totpStorage()
+	if err != nil {
+		return err
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil {
+		return UnauthorizedError
+	}
+
+	return storage.SaveTOTP(username, nil)
+}
+
+// CompleteMFALogin completes a login, which returned *MFARequiredError, with a TOTP code or a recovery code.
+// The challenge token can be used only once, so a wrong code requires to login with the password again.
+// A wrong code counts as a failed login (see WithLoginLimiter).
+func (u *Registry) CompleteMFALogin(challengeToken string, code string, client ClientInfo) (token string, refreshToken string, err error) {
+	storage, err := u.totpStorage()
+	if err != nil {
+		return "", "", err
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	challenge, err := u.loadOneTimeToken(challengeToken, TokenPurposeMFAChallenge)
+	if err != nil {
+		return "", "", err
+	}
+
+	user, err := u.storage.Load(challenge.Username)
+	if err != nil {
+		return "", "", fmt.Errorf("error loading user: %w", err)
+	}
+
+	// the challenge stays valid during the delay, so the code can be retried
+	err = u.checkLoginLimiter(challenge.Username, user, client)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = u.oneTimeTokens.Delete(challenge.Token)
+	if err != nil {
+		return "", "", fmt.Errorf("error deleting challenge token: %w", err)
+	}
+
+	if user == nil || user.Blacklisted {
+		return "", "", UnauthorizedError
+	}
+
+	t, err := storage.LoadTOTP(user.Username)
+	if err != nil {
+		return "", "", fmt.Errorf("error loading TOTP: %w", err)
+	}
+
+	if t == nil || !t.Confirmed {
+		return "", "", UnauthorizedError
+	}
+
+	step, ok := t.validate(code, u.now())
+	if ok {
+		t.LastStep = step
+	} else if !t.useRecoveryCode(code) {
+		u.loginFailed(user.Username, user, client)
+		return "", "", UnauthorizedError
+	}
+
+	err = storage.SaveTOTP(user.Username, t)
+	if err != nil {
+		return "", "", fmt.Errorf("error saving TOTP: %w", err)
+	}
+
+	u.loginSucceeded(user, client)
+
+	return u.startSession(user, client)
+}
+
+// requireSecondFactor returns *MFARequiredError with a new challenge token, if the user enabled
+// two-factor authentication.
+func (u *Registry) requireSecondFactor(user *User) error {
+	storage, ok := u.storage.(TOTPStorage)
+	if !ok {
+		return nil
+	}
+
+	t, err := storage.LoadTOTP(user.Username)
+	if err != nil {
+		return fmt.Errorf("error loading TOTP: %w", err)
+	}
+
+	if t == nil || !t.Confirmed {
+		return nil
+	}
+
+	token, expiresAt, err := u.issueOneTimeToken(user, TokenPurposeMFAChallenge, u.mfaChallengeTTL)
+	if err != nil {
+		return err
+	}
+
+	return &MFARequiredError{ChallengeToken: token, ExpiresAt: expiresAt}
+}
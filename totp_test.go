@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of RFC 6238, appendix B (SHA1, last 6 of 8 digits)
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code := totpCode(secret, totpStep(time.Unix(test.time, 0)))
+		if code != test.code {
+			t.Errorf("time %d: expected %s, got %s", test.time, test.code, code)
+		}
+	}
+}
+
+func TestTOTP_Validate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	totp := &TOTP{Secret: []byte("12345678901234567890")}
+
+	if _, ok := totp.validate("000000", now); ok {
+		t.Error("wrong code accepted")
+	}
+
+	previous := totpCode(totp.Secret, totpStep(now)-1)
+	step, ok := totp.validate(previous, now)
+	if !ok || step != totpStep(now)-1 {
+		t.Error("code of the previous step rejected")
+	}
+
+	if _, ok := totp.validate(totpCode(totp.Secret, totpStep(now)-2), now); ok {
+		t.Error("code outside of the skew accepted")
+	}
+
+	totp.LastStep = step
+	if _, ok := totp.validate(previous, now); ok {
+		t.Error("code replayed")
+	}
+
+	if _, ok := totp.validate(totpCode(totp.Secret, totpStep(now)), now); !ok {
+		t.Error("code of the current step rejected")
+	}
+}
+
+// enrollTOTP registers user1, enables TOTP, and returns the secret and the recovery codes.
+func enrollTOTP(t *testing.T, users *Registry) ([]byte, []string) {
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	secret, uri, err := users.EnrollTOTP("user1", "password1")
+	if err != nil {
+		t.Fatalf("error enrolling TOTP: %v", err)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "otpauth" || u.Host != "totp" || u.Query().Get("secret") != secret {
+		t.Errorf("invalid provisioning URI %s", uri)
+	}
+
+	key, err := totpBase32.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("invalid secret %s: %v", secret, err)
+	}
+
+	// not enabled until confirmed
+	_, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Errorf("unconfirmed TOTP required: %v", err)
+	}
+
+	_, err = users.ConfirmTOTP("user1", "000000")
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("wrong confirmation code accepted: %v", err)
+	}
+
+	recoveryCodes, err := users.ConfirmTOTP("user1", totpCode(key, totpStep(users.now())))
+	if err != nil {
+		t.Fatalf("error confirming TOTP: %v", err)
+	}
+
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %d", recoveryCodeCount, len(recoveryCodes))
+	}
+
+	return key, recoveryCodes
+}
+
+// loginChallenge logs in user1 with the password and returns the challenge token.
+func loginChallenge(t *testing.T, users *Registry) string {
+	_, _, err := users.Login("user1", "password1")
+
+	var mfa *MFARequiredError
+	if !errors.As(err, &mfa) {
+		t.Fatalf("expected second factor required, got %v", err)
+	}
+
+	return mfa.ChallengeToken
+}
+
+func TestRegistry_TOTPLogin(t *testing.T) {
+	c := &clock{now: time.Now()}
+	users := NewRegistry(newMockStorage(), secret)
+	users.now = c.Now
+
+	key, _ := enrollTOTP(t, users)
+
+	_, _, err := users.EnrollTOTP("user1", "password1")
+	if err == nil {
+		t.Error("enrolled TOTP twice")
+	}
+
+	// the confirmation code can not be used for login
+	challenge := loginChallenge(t, users)
+	_, _, err = users.CompleteMFALogin(challenge, totpCode(key, totpStep(c.Now())), ClientInfo{})
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("replayed code accepted: %v", err)
+	}
+
+	// the challenge is consumed by the failed attempt
+	c.Advance(totpPeriod * time.Second)
+	code := totpCode(key, totpStep(c.Now()))
+	_, _, err = users.CompleteMFALogin(challenge, code, ClientInfo{})
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("challenge token reused: %v", err)
+	}
+
+	challenge = loginChallenge(t, users)
+	token, refreshToken, err := users.CompleteMFALogin(challenge, code, ClientInfo{})
+	if err != nil {
+		t.Fatalf("error completing login: %v", err)
+	}
+
+	if token == "" || refreshToken == "" {
+		t.Error("tokens not issued")
+	}
+
+	_, _, err = users.Refresh("user1", refreshToken)
+	if err != nil {
+		t.Errorf("error refreshing session: %v", err)
+	}
+
+	// challenge expires
+	challenge = loginChallenge(t, users)
+	c.Advance(DefaultMFAChallengeTTL + totpPeriod*time.Second)
+	_, _, err = users.CompleteMFALogin(challenge, totpCode(key, totpStep(c.Now())), ClientInfo{})
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("expired challenge accepted: %v", err)
+	}
+
+	// other one-time tokens are not challenges
+	_, _, err = users.CompleteMFALogin("invalid", totpCode(key, totpStep(c.Now())), ClientInfo{})
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("invalid challenge accepted: %v", err)
+	}
+}
+
+func TestRegistry_TOTPLoginLimiter(t *testing.T) {
+	c := &clock{now: time.Now()}
+	limiter := NewLoginLimiter()
+	users := NewRegistry(newMockStorage(), secret, WithLoginLimiter(limiter))
+	users.now = c.Now
+
+	// the wrong confirmation code is the first failure
+	key, _ := enrollTOTP(t, users)
+
+	// the correct password does not reset the failures of wrong codes
+	for i := 0; i < 3; i++ {
+		challenge := loginChallenge(t, users)
+		_, _, err := users.CompleteMFALogin(challenge, "000000", ClientInfo{})
+		if !errors.Is(err, UnauthorizedError) {
+			t.Fatalf("expected unauthorized, got %v", err)
+		}
+	}
+
+	var throttled *LoginThrottledError
+	_, _, err := users.Login("user1", "password1")
+	if !errors.As(err, &throttled) {
+		t.Fatalf("expected throttled login, got %v", err)
+	}
+
+	c.Advance(totpPeriod * time.Second)
+	challenge := loginChallenge(t, users)
+	_, _, err = users.CompleteMFALogin(challenge, totpCode(key, totpStep(c.Now())), ClientInfo{})
+	if err != nil {
+		t.Fatalf("error completing login: %v", err)
+	}
+
+	if f := limiter.users["user1"]; f != nil {
+		t.Errorf("complete login did not reset %d failures", f.count)
+	}
+}
+
+func TestRegistry_TOTPRecoveryCode(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	_, recoveryCodes := enrollTOTP(t, users)
+
+	challenge := loginChallenge(t, users)
+	_, _, err := users.CompleteMFALogin(challenge, " "+recoveryCodes[0]+" ", ClientInfo{})
+	if err != nil {
+		t.Fatalf("recovery code rejected: %v", err)
+	}
+
+	challenge = loginChallenge(t, users)
+	_, _, err = users.CompleteMFALogin(challenge, recoveryCodes[0], ClientInfo{})
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("recovery code used twice: %v", err)
+	}
+
+	err = users.DisableTOTP("user1", "password1", "000000")
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("TOTP disabled with a wrong code: %v", err)
+	}
+
+	err = users.DisableTOTP("user1", "password2", recoveryCodes[1])
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("TOTP disabled with a wrong password: %v", err)
+	}
+
+	err = users.DisableTOTP("user1", "password1", recoveryCodes[1])
+	if err != nil {
+		t.Fatalf("error disabling TOTP: %v", err)
+	}
+
+	_, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Errorf("disabled TOTP required: %v", err)
+	}
+}
+
+func TestRegistry_ResetTOTP(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret)
+
+	enrollTOTP(t, users)
+
+	err := users.ResetTOTP("user1")
+	if err != nil {
+		t.Fatalf("error resetting TOTP: %v", err)
+	}
+
+	_, _, err = users.Login("user1", "password1")
+	if err != nil {
+		t.Errorf("reset TOTP required: %v", err)
+	}
+
+	if users.ResetTOTP("user2") == nil {
+		t.Error("reset TOTP of missing user")
+	}
+}
+
+func TestSimpleFileStorage_TOTP(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	err = storage.Save(&User{Username: "test", Roles: NewRoleSet(), Options: map[string]string{}})
+	if err != nil {
+		t.Fatalf("error saving user: %v", err)
+	}
+
+	totp := &TOTP{Secret: []byte("secret"), Confirmed: true, LastStep: 42, RecoveryCodes: []string{"code"}}
+	err = storage.SaveTOTP("test", totp)
+	if err != nil {
+		t.Fatalf("error saving TOTP: %v", err)
+	}
+
+	totp.RecoveryCodes[0] = "modified"
+
+	storage2, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	loaded, _ := storage2.LoadTOTP("test")
+	if loaded == nil || string(loaded.Secret) != "secret" || !loaded.Confirmed || loaded.LastStep != 42 ||
+		len(loaded.RecoveryCodes) != 1 || loaded.RecoveryCodes[0] != "code" {
+		t.Fatalf("TOTP not persisted: %+v", loaded)
+	}
+
+	user, _ := storage2.Load("test")
+	if len(user.Options) != 0 {
+		t.Errorf("TOTP left in options %v", user.Options)
+	}
+
+	// saving the user keeps the enrollment
+	err = storage2.Save(user)
+	if err != nil {
+		t.Fatalf("error saving user: %v", err)
+	}
+
+	err = storage2.Delete("test")
+	if err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+
+	if loaded, _ := storage2.LoadTOTP("test"); loaded != nil {
+		t.Error("TOTP of deleted user kept")
+	}
+
+	storage3, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	if loaded, _ := storage3.LoadTOTP("test"); loaded != nil {
+		t.Error("TOTP of deleted user loaded")
+	}
+
+	if storage3.SaveTOTP("test", totp) == nil {
+		t.Error("saved TOTP of missing user")
+	}
+}
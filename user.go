@@ -1,5 +1,7 @@
 package auth
 
+import "time"
+
 type User struct {
 	// Username is a unique identifier of the user. It is used as a key in the storage.
 	// Password is not stored in the User struct. It is stored in the storage.
@@ -9,7 +11,20 @@ type User struct {
 	// Blacklisted is a flag that indicates that the user is blacklisted and should
 	// not be allowed to login.
 	Blacklisted bool
+	// Email is the email address of the user, empty if unknown.
+	Email string
+	// EmailVerified is a flag that indicates that the user proved to own the Email address
+	// (see Registry.VerifyEmail). It is reset when the address changes.
+	EmailVerified bool
+	// LastLoginAt is the time of the last successful login, zero if the user never logged in.
+	LastLoginAt time.Time
+	// LastLoginIP is the IP address of the client of the last successful login, empty if unknown.
+	LastLoginIP string
+	// FailedLogins is the number of failed logins since the last successful login.
+	FailedLogins int
+	// LastFailedLoginAt is the time of the last failed login.
+	LastFailedLoginAt time.Time
 	// Options is a map of user options. It can be used to store additional information
-	// about the user.
+	// about the user. Keys with the "auth." prefix are reserved and not stored.
 	Options map[string]string
 }
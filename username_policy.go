@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"fmt"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// UsernamePolicy defines how usernames are normalized, and which usernames can be registered.
+// Lengths are counted in characters of the normalized username. Zero values disable the rules.
+type UsernamePolicy struct {
+	MinLength int
+	MaxLength int
+
+	// AllowedSymbols are the characters allowed in usernames besides letters and digits.
+	// Control characters are never allowed. Note that SimpleFileStorage can not store usernames containing ":".
+	AllowedSymbols string
+
+	// CaseSensitive disables case folding, so "Alice" and "alice" are different users.
+	CaseSensitive bool
+}
+
+// DefaultUsernamePolicy returns the recommended policy for new deployments (see WithUsernamePolicy):
+// 3 to 64 letters, digits and ".", "_", "-", "@", "+" (so email addresses can be used), compared ignoring case.
+func DefaultUsernamePolicy() *UsernamePolicy {
+	return &UsernamePolicy{
+		MinLength:      3,
+		MaxLength:      64,
+		AllowedSymbols: "._-@+",
+	}
+}
+
+// Normalize returns the canonical form of the username: Unicode NFKC normalized, so that e.g. full-width
+// and ligature characters match their plain counterparts, and case folded unless the policy is case-sensitive.
+// Registry normalizes usernames with its policy in all operations, and stores users by their normalized username.
+func (p *UsernamePolicy) Normalize(username string) string {
+	username = norm.NFKC.String(username)
+	if !p.CaseSensitive {
+		// case folding can produce characters that are not NFKC normalized
+		username = norm.NFKC.String(cases.Fold().String(username))
+	}
+	return username
+}
+
+// Validate checks the normalized username against the policy.
+// It returns a *PolicyError listing all violated rules, or nil if the username is acceptable.
+func (p *UsernamePolicy) Validate(username string) error {
+	var violations []PolicyViolation
+
+	violate := func(code string, message string) {
+		violations = append(violations, PolicyViolation{Code: code, Message: message})
+	}
+
+	length := utf8.RuneCountInString(username)
+
+	if length == 0 {
+		violate("empty", "must not be empty")
+	} else if length < p.MinLength {
+		violate("too_short", fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violate("too_long", fmt.Sprintf("must be at most %d characters long", p.MaxLength))
+	}
+
+	if !utf8.ValidString(username) {
+		violate("invalid_encoding", "must be valid UTF-8")
+	}
+
+	for _, r := range username {
+		if unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r) {
+			continue
+		}
+		if !unicode.IsControl(r) && strings.ContainsRune(p.AllowedSymbols, r) {
+			continue
+		}
+		violate("invalid_character", fmt.Sprintf("must contain only letters, digits and %q", p.AllowedSymbols))
+		break
+	}
+
+	if violations != nil {
+		return &PolicyError{Field: "username", Violations: violations}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+	"os"
+	"testing"
+)
+
+func TestUsernamePolicy_Normalize(t *testing.T) {
+	policy := DefaultUsernamePolicy()
+
+	tests := map[string]string{
+		"alice":      "alice",
+		"Alice":      "alice",
+		"ALICE":      "alice",
+		"ａｌｉｃｅ":      "alice", // full-width
+		"Straße":     "strasse",
+		"ﬁnn":        "finn", // ligature
+		"Ä":          "ä",
+		"A\u0308":    "ä", // decomposed
+		"Bob@Ex.com": "bob@ex.com",
+	}
+
+	for username, expected := range tests {
+		if normalized := policy.Normalize(username); normalized != expected {
+			t.Errorf("%q: expected %q, got %q", username, expected, normalized)
+		}
+	}
+
+	policy.CaseSensitive = true
+
+	if normalized := policy.Normalize("Ａlice"); normalized != "Alice" {
+		t.Errorf("case-sensitive normalization failed, got %q", normalized)
+	}
+}
+
+func TestUsernamePolicy_Validate(t *testing.T) {
+	policy := DefaultUsernamePolicy()
+
+	tests := []struct {
+		username   string
+		violations []string
+	}{
+		{"alice", nil},
+		{"alice.smith-1@example.com", nil},
+		{"jürgen", nil},
+		{"", []string{"empty"}},
+		{"al", []string{"too_short"}},
+		{"a1234567890123456789012345678901234567890123456789012345678901234", []string{"too_long"}},
+		{"alice:admin", []string{"invalid_character"}},
+		{"alice\nbob", []string{"invalid_character"}},
+		{"alice smith", []string{"invalid_character"}},
+		{"\xff\xfe\xfd", []string{"invalid_encoding", "invalid_character"}},
+	}
+
+	for _, test := range tests {
+		violations := policyViolations(policy.Validate(test.username))
+		if len(violations) != len(test.violations) {
+			t.Errorf("%q: expected violations %v, got %v", test.username, test.violations, violations)
+			continue
+		}
+		for i := range violations {
+			if violations[i] != test.violations[i] {
+				t.Errorf("%q: expected violations %v, got %v", test.username, test.violations, violations)
+				break
+			}
+		}
+	}
+}
+
+func TestRegistry_UsernameNormalization(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret, WithUsernamePolicy(DefaultUsernamePolicy()))
+
+	err := users.Register("Alice", "password1")
+	if err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	if users.Register("alice", "password2") == nil {
+		t.Error("registered the same username with different case")
+	}
+
+	if users.Register("ＡＬＩＣＥ", "password2") == nil {
+		t.Error("registered the same username with full-width characters")
+	}
+
+	if v := policyViolations(users.Register("bob:admin", "password1")); len(v) != 1 || v[0] != "invalid_character" {
+		t.Errorf("expected invalid username, got %v", v)
+	}
+
+	err = users.SetRoles("ALICE", "user")
+	if err != nil {
+		t.Fatalf("set roles failed: %v", err)
+	}
+
+	token, refreshToken, err := users.Login("aLiCe", "password1")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	})
+	if err != nil {
+		t.Fatalf("error parsing token: %v", err)
+	}
+
+	if claims["username"] != "alice" {
+		t.Errorf("expected normalized username in token, got %v", claims["username"])
+	}
+
+	_, _, err = users.Refresh("Alice", refreshToken)
+	if err != nil {
+		t.Errorf("refresh failed: %v", err)
+	}
+
+	err = users.Blacklist("ALICE")
+	if err != nil {
+		t.Fatalf("blacklist failed: %v", err)
+	}
+
+	if _, _, err = users.Login("alice", "password1"); err == nil {
+		t.Error("blacklisted user logged in")
+	}
+}
+
+func TestRegistry_UsernameStoredWithoutPolicy(t *testing.T) {
+	storage := newMockStorage()
+
+	// registered by a version without username policies
+	err := NewRegistry(storage, secret, WithUsernamePolicy(nil)).Register("Alice", "password1")
+	if err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	users := NewRegistry(storage, secret)
+
+	if _, _, err = users.Login("Alice", "password1"); err != nil {
+		t.Errorf("login of existing user failed: %v", err)
+	}
+
+	if _, _, err = users.Login("alice", "password1"); err == nil {
+		t.Error("logged in with different case without username policy")
+	}
+}
+
+func TestSimpleFileStorage_InvalidUsername(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	for _, username := range []string{"", "alice:admin", "alice\n+1:admin"} {
+		if storage.Save(&User{Username: username, Roles: NewRoleSet()}) == nil {
+			t.Errorf("%q: user with invalid username saved", username)
+		}
+
+		if storage.Delete(username) != nil {
+			t.Errorf("%q: deleting missing user failed", username)
+		}
+	}
+
+	_, err = NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Errorf("error reloading storage: %v", err)
+	}
+}
@@ -0,0 +1,633 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// webAuthnTimeout is the time to complete a WebAuthn ceremony.
+const webAuthnTimeout = 5 * time.Minute
+
+// Flags of authenticator data.
+const (
+	authenticatorFlagUserPresent        = 0x01
+	authenticatorFlagUserVerified       = 0x04
+	authenticatorFlagAttestedCredential = 0x40
+)
+
+var webAuthnBase64 = base64.RawURLEncoding
+
+// WebAuthnCredential is a public key credential (passkey) of a user.
+type WebAuthnCredential struct {
+	// ID is the credential ID chosen by the authenticator.
+	ID []byte `json:"id"`
+	// PublicKey is the COSE encoded public key.
+	PublicKey []byte `json:"public_key"`
+	// SignCount is the signature counter of the authenticator, used to detect cloned authenticators.
+	SignCount uint32    `json:"sign_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebAuthnStorage is an optional interface of a Storage, which stores WebAuthn credentials of users.
+// Registry requires it for passkeys (see WithWebAuthn).
+// Storage.Delete must delete the credentials of the user too.
+type WebAuthnStorage interface {
+	// SaveWebAuthnCredential adds the credential of the user, or replaces the credential with the same ID.
+	SaveWebAuthnCredential(username string, c *WebAuthnCredential) error
+	// LoadWebAuthnCredentials loads the credentials of the user.
+	LoadWebAuthnCredentials(username string) ([]*WebAuthnCredential, error)
+	// WebAuthnCredentialUser returns the username of the user having the credential with the ID.
+	// Unknown credential should not return error, but an empty username.
+	WebAuthnCredentialUser(id []byte) (string, error)
+}
+
+// WebAuthnCreationOptions are the options of a registration ceremony, in the JSON format accepted by
+// PublicKeyCredential.parseCreationOptionsFromJSON in the browser (binary values are base64url encoded).
+type WebAuthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUser                   `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParameters `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+// WebAuthnRequestOptions are the options of an authentication ceremony, in the JSON format accepted by
+// PublicKeyCredential.parseRequestOptionsFromJSON in the browser (binary values are base64url encoded).
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	Timeout          int64                          `json:"timeout"`
+	RPID             string                         `json:"rpId"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebAuthnCredentialParameters struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnResponse is the credential returned by the authenticator, as serialized by PublicKeyCredential.toJSON
+// in the browser (binary values are base64url encoded).
+type WebAuthnResponse struct {
+	ID       string                        `json:"id"`
+	Type     string                        `json:"type"`
+	Response WebAuthnAuthenticatorResponse `json:"response"`
+}
+
+// WebAuthnAuthenticatorResponse contains the attestation object of a registration ceremony,
+// or the authenticator data and the signature of an authentication ceremony.
+type WebAuthnAuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// webAuthnConfig is the relying party configuration (see WithWebAuthn).
+type webAuthnConfig struct {
+	rpID    string
+	rpName  string
+	origins []string
+	// decoyKey derives the decoy credentials of users without passkeys, see decoyCredentials
+	decoyKey []byte
+}
+
+func newWebAuthnConfig(rpID string, rpName string, origins []string) *webAuthnConfig {
+	decoyKey := make([]byte, 32)
+	rand.Read(decoyKey)
+
+	return &webAuthnConfig{rpID: rpID, rpName: rpName, origins: origins, decoyKey: decoyKey}
+}
+
+// authenticatorData is the parsed authenticator data of a WebAuthn response.
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData parses authenticator data, including the attested credential data if present.
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+
+	a := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if a.flags&authenticatorFlagAttestedCredential == 0 {
+		return a, nil
+	}
+
+	// aaguid (16 bytes), credential ID length (2 bytes), credential ID, public key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data too short")
+	}
+
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen > 1023 || len(rest) < idLen {
+		return nil, errors.New("invalid credential ID length")
+	}
+	a.credentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	_, extensions, err := parseCOSEKey(rest)
+	if err != nil {
+		return nil, err
+	}
+	a.publicKey = rest[:len(rest)-len(extensions)]
+
+	return a, nil
+}
+
+// webAuthnUserID returns the user handle of the user, which identifies the user to authenticators
+// without revealing the username.
+func webAuthnUserID(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return webAuthnBase64.EncodeToString(sum[:])
+}
+
+// webAuthnStorage returns the storage of WebAuthn credentials.
+func (u *Registry) webAuthnStorage() (WebAuthnStorage, error) {
+	if u.webAuthn == nil {
+		return nil, errors.New("WebAuthn not configured")
+	}
+
+	storage, ok := u.storage.(WebAuthnStorage)
+	if !ok {
+		return nil, errors.New("storage does not support WebAuthn")
+	}
+	return storage, nil
+}
+
+// BeginWebAuthnRegistration starts the registration of a passkey of the user, who has to present the password.
+// The returned options are passed to navigator.credentials.create in the browser, and the created credential
+// to FinishWebAuthnRegistration.
+func (u *Registry) BeginWebAuthnRegistration(username string, password string) (*WebAuthnCreationOptions, error) {
+	username = u.normalizeUsername(username)
+
+	storage, err := u.webAuthnStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	user, err := u.authenticate(username, password, ClientInfo{})
+	if err != nil {
+		return nil, err
+	}
+
+	u.passwordSucceeded(user)
+
+	credentials, err := storage.LoadWebAuthnCredentials(username)
+	if err != nil {
+		return nil, fmt.Errorf("error loading credentials: %w", err)
+	}
+
+	challenge, err := u.issueWebAuthnChallenge(user, TokenPurposeWebAuthnRegistration)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP: WebAuthnRelyingParty{
+			ID:   u.webAuthn.rpID,
+			Name: u.webAuthn.rpName,
+		},
+		User: WebAuthnUser{
+			ID:          webAuthnUserID(username),
+			Name:        username,
+			DisplayName: username,
+		},
+		PubKeyCredParams: []WebAuthnCredentialParameters{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            webAuthnTimeout.Milliseconds(),
+		ExcludeCredentials: credentialDescriptors(credentials),
+		AuthenticatorSelection: WebAuthnAuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "required",
+		},
+		Attestation: "none",
+	}, nil
+}
+
+// FinishWebAuthnRegistration verifies the credential created by the authenticator, and adds it to the user
+// who started the registration. Attestation statements are not verified, any authenticator is accepted.
+func (u *Registry) FinishWebAuthnRegistration(response *WebAuthnResponse) error {
+	storage, err := u.webAuthnStorage()
+	if err != nil {
+		return err
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	challenge, _, err := u.verifyClientData(response, "webauthn.create", TokenPurposeWebAuthnRegistration)
+	if err != nil {
+		return err
+	}
+
+	user, err := u.storage.Load(challenge.Username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	if user == nil || user.Blacklisted {
+		return UnauthorizedError
+	}
+
+	raw, err := webAuthnBase64.DecodeString(response.Response.AttestationObject)
+	if err != nil {
+		return fmt.Errorf("invalid attestation object: %w", err)
+	}
+
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return fmt.Errorf("invalid attestation object: %w", err)
+	}
+
+	attestation, _ := v.(map[interface{}]interface{})
+	data, ok := attestation["authData"].([]byte)
+	if !ok {
+		return errors.New("invalid attestation object: missing authenticator data")
+	}
+
+	auth, err := u.verifyAuthenticatorData(data)
+	if err != nil {
+		return err
+	}
+
+	if auth.credentialID == nil {
+		return errors.New("invalid authenticator data: missing credential")
+	}
+
+	if response.ID != webAuthnBase64.EncodeToString(auth.credentialID) {
+		return errors.New("credential ID does not match authenticator data")
+	}
+
+	// a credential ID must identify one credential, the login would find the credential of another user
+	owner, err := storage.WebAuthnCredentialUser(auth.credentialID)
+	if err != nil {
+		return fmt.Errorf("error loading credential: %w", err)
+	}
+
+	if owner != "" {
+		return errors.New("credential already registered")
+	}
+
+	err = storage.SaveWebAuthnCredential(user.Username, &WebAuthnCredential{
+		ID:        auth.credentialID,
+		PublicKey: auth.publicKey,
+		SignCount: auth.signCount,
+		CreatedAt: u.now(),
+	})
+	if err != nil {
+		return fmt.Errorf("error saving credential: %w", err)
+	}
+
+	return nil
+}
+
+// BeginWebAuthnLogin starts a login of the user with a passkey. The returned options are passed to
+// navigator.credentials.get in the browser, and the assertion to FinishWebAuthnLogin.
+// To not reveal which users exist or have passkeys, missing and blacklisted users and users without passkeys
+// get options too, listing a decoy credential, and their login fails in FinishWebAuthnLogin.
+func (u *Registry) BeginWebAuthnLogin(username string) (*WebAuthnRequestOptions, error) {
+	return u.BeginWebAuthnLoginWithClient(username, ClientInfo{})
+}
+
+// BeginWebAuthnLoginWithClient starts a login like BeginWebAuthnLogin, and returns *LoginThrottledError
+// if logins of the user or from the client are throttled (see WithLoginLimiter).
+func (u *Registry) BeginWebAuthnLoginWithClient(username string, client ClientInfo) (*WebAuthnRequestOptions, error) {
+	username = u.normalizeUsername(username)
+
+	storage, err := u.webAuthnStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	u.m.RLock()
+	defer u.m.RUnlock()
+
+	user, err := u.storage.Load(username)
+	if err != nil {
+		return nil, fmt.Errorf("error loading user: %w", err)
+	}
+
+	err = u.checkLoginLimiter(username, user, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials []*WebAuthnCredential
+	if user != nil && !user.Blacklisted {
+		credentials, err = storage.LoadWebAuthnCredentials(username)
+		if err != nil {
+			return nil, fmt.Errorf("error loading credentials: %w", err)
+		}
+	}
+
+	allowCredentials := credentialDescriptors(credentials)
+	if len(allowCredentials) == 0 {
+		allowCredentials = u.decoyCredentials(username)
+	}
+
+	// the challenge of a decoy is stored too, so it takes the same time
+	challenge, err := u.issueWebAuthnChallenge(&User{Username: username}, TokenPurposeWebAuthnLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          webAuthnTimeout.Milliseconds(),
+		RPID:             u.webAuthn.rpID,
+		AllowCredentials: allowCredentials,
+		UserVerification: "required",
+	}, nil
+}
+
+// decoyCredentials returns a credential descriptor for a user without passkeys. Its ID is derived from
+// the username, so repeated logins of the user list the same credential, like for a user with a passkey.
+func (u *Registry) decoyCredentials(username string) []WebAuthnCredentialDescriptor {
+	mac := hmac.New(sha256.New, u.webAuthn.decoyKey)
+	mac.Write([]byte(username))
+
+	return []WebAuthnCredentialDescriptor{{Type: "public-key", ID: webAuthnBase64.EncodeToString(mac.Sum(nil))}}
+}
+
+// FinishWebAuthnLogin verifies the assertion of the authenticator, and logs in the user who started the login.
+// A passkey verifies the user, so no second factor is required.
+// The login fails if the signature counter did not increase, since the authenticator was most likely cloned.
+func (u *Registry) FinishWebAuthnLogin(response *WebAuthnResponse, client ClientInfo) (token string, refreshToken string, err error) {
+	storage, err := u.webAuthnStorage()
+	if err != nil {
+		return "", "", err
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	challenge, clientData, err := u.verifyClientData(response, "webauthn.get", TokenPurposeWebAuthnLogin)
+	if err != nil {
+		return "", "", err
+	}
+
+	user, err := u.storage.Load(challenge.Username)
+	if err != nil {
+		return "", "", fmt.Errorf("error loading user: %w", err)
+	}
+
+	err = u.checkLoginLimiter(challenge.Username, user, client)
+	if err != nil {
+		return "", "", err
+	}
+
+	if user == nil || user.Blacklisted {
+		return "", "", UnauthorizedError
+	}
+
+	credentials, err := storage.LoadWebAuthnCredentials(user.Username)
+	if err != nil {
+		return "", "", fmt.Errorf("error loading credentials: %w", err)
+	}
+
+	credential, auth, err := u.verifyAssertion(credentials, response, clientData)
+	if errors.Is(err, UnauthorizedError) {
+		u.loginFailed(user.Username, user, client)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	if u.unverifiedEmail == RefuseUnverifiedEmail && !user.EmailVerified {
+		return "", "", EmailNotVerifiedError
+	}
+
+	credential.SignCount = auth.signCount
+	err = storage.SaveWebAuthnCredential(user.Username, credential)
+	if err != nil {
+		return "", "", fmt.Errorf("error saving credential: %w", err)
+	}
+
+	u.loginSucceeded(user, client)
+
+	return u.startSession(user, client)
+}
+
+// verifyAssertion verifies the assertion of the authenticator with one of the credentials of the user.
+// It returns the credential and the authenticator data, or UnauthorizedError if the assertion is invalid.
+func (u *Registry) verifyAssertion(credentials []*WebAuthnCredential, response *WebAuthnResponse, clientData []byte) (*WebAuthnCredential, *authenticatorData, error) {
+	id, err := webAuthnBase64.DecodeString(response.ID)
+	if err != nil {
+		return nil, nil, UnauthorizedError
+	}
+
+	var credential *WebAuthnCredential
+	for _, c := range credentials {
+		if bytes.Equal(c.ID, id) {
+			credential = c
+			break
+		}
+	}
+
+	if credential == nil {
+		return nil, nil, UnauthorizedError
+	}
+
+	data, err := webAuthnBase64.DecodeString(response.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, UnauthorizedError
+	}
+
+	auth, err := u.verifyAuthenticatorData(data)
+	if err != nil {
+		return nil, nil, UnauthorizedError
+	}
+
+	signature, err := webAuthnBase64.DecodeString(response.Response.Signature)
+	if err != nil {
+		return nil, nil, UnauthorizedError
+	}
+
+	key, _, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing credential public key: %w", err)
+	}
+
+	clientDataHash := sha256.Sum256(clientData)
+	err = key.verify(append(data[:len(data):len(data)], clientDataHash[:]...), signature)
+	if err != nil {
+		return nil, nil, UnauthorizedError
+	}
+
+	// authenticators without a counter always report zero
+	if (auth.signCount != 0 || credential.SignCount != 0) && auth.signCount <= credential.SignCount {
+		return nil, nil, UnauthorizedError
+	}
+
+	return credential, auth, nil
+}
+
+// issueWebAuthnChallenge issues a random challenge of a WebAuthn ceremony. It is stored as a one-time token,
+// the challenge being the token.
+func (u *Registry) issueWebAuthnChallenge(user *User, purpose string) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("error generating challenge: %w", err)
+	}
+
+	challenge := webAuthnBase64.EncodeToString(b)
+
+	err = u.oneTimeTokens.Save(&OneTimeToken{
+		Token:     hashToken(challenge),
+		Purpose:   purpose,
+		Username:  user.Username,
+		ExpiresAt: u.now().Add(webAuthnTimeout),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error saving challenge: %w", err)
+	}
+
+	return challenge, nil
+}
+
+// verifyClientData verifies the type, origin and challenge of the client data of the response,
+// and consumes the challenge. It returns the challenge and the raw client data.
+// Must be called with the write lock held.
+func (u *Registry) verifyClientData(response *WebAuthnResponse, ceremony string, purpose string) (*OneTimeToken, []byte, error) {
+	if response == nil || response.Type != "public-key" {
+		return nil, nil, UnauthorizedError
+	}
+
+	raw, err := webAuthnBase64.DecodeString(response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, UnauthorizedError
+	}
+
+	clientData := struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}{}
+
+	err = json.Unmarshal(raw, &clientData)
+	if err != nil || clientData.Type != ceremony || clientData.Challenge == "" {
+		return nil, nil, UnauthorizedError
+	}
+
+	challenge, err := u.loadOneTimeToken(clientData.Challenge, purpose)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = u.oneTimeTokens.Delete(challenge.Token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error deleting challenge: %w", err)
+	}
+
+	if !u.webAuthnOrigin(clientData.Origin) {
+		return nil, nil, UnauthorizedError
+	}
+
+	return challenge, raw, nil
+}
+
+// webAuthnOrigin checks if the origin is allowed. By default only https://{rpID} is allowed.
+func (u *Registry) webAuthnOrigin(origin string) bool {
+	if len(u.webAuthn.origins) == 0 {
+		return origin == "https://"+u.webAuthn.rpID
+	}
+
+	for _, o := range u.webAuthn.origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyAuthenticatorData parses the authenticator data and checks that it was created for this relying party,
+// with the user present and verified.
+func (u *Registry) verifyAuthenticatorData(data []byte) (*authenticatorData, error) {
+	auth, err := parseAuthenticatorData(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authenticator data: %w", err)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(u.webAuthn.rpID))
+	if !bytes.Equal(auth.rpIDHash, rpIDHash[:]) {
+		return nil, errors.New("invalid authenticator data: relying party ID mismatch")
+	}
+
+	if auth.flags&authenticatorFlagUserPresent == 0 || auth.flags&authenticatorFlagUserVerified == 0 {
+		return nil, errors.New("invalid authenticator data: user not verified")
+	}
+
+	return auth, nil
+}
+
+// credentialDescriptors returns the descriptors of the credentials, which tell the browser the credentials
+// to use or to exclude.
+func credentialDescriptors(credentials []*WebAuthnCredential) []WebAuthnCredentialDescriptor {
+	descriptors := make([]WebAuthnCredentialDescriptor, len(credentials))
+	for i, c := range credentials {
+		descriptors[i] = WebAuthnCredentialDescriptor{Type: "public-key", ID: webAuthnBase64.EncodeToString(c.ID)}
+	}
+	return descriptors
+}
+
+// copyWebAuthnCredential returns a deep copy of the credential.
+func copyWebAuthnCredential(c *WebAuthnCredential) *WebAuthnCredential {
+	copied := *c
+	copied.ID = append([]byte(nil), c.ID...)
+	copied.PublicKey = append([]byte(nil), c.PublicKey...)
+	return &copied
+}
@@ -0,0 +1,504 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+)
+
+const (
+	RP_ID     = "example.com"
+	RP_ORIGIN = "https://example.com"
+)
+
+// encodeCBOR encodes the subset of CBOR decoded by decodeCBOR.
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		case n <= 0xffffffff:
+			return []byte{major<<5 | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+		}
+		b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[1:], n)
+		return b
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		b := head(4, uint64(len(v)))
+		for _, item := range v {
+			b = append(b, encodeCBOR(item)...)
+		}
+		return b
+	case map[interface{}]interface{}:
+		keys := make([][]byte, 0, len(v))
+		values := make(map[string][]byte, len(v))
+		for k, item := range v {
+			key := encodeCBOR(k)
+			keys = append(keys, key)
+			values[string(key)] = encodeCBOR(item)
+		}
+		sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+
+		b := head(5, uint64(len(v)))
+		for _, key := range keys {
+			b = append(b, key...)
+			b = append(b, values[string(key)]...)
+		}
+		return b
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	}
+	panic(fmt.Sprintf("unsupported type %T", v))
+}
+
+// softAuthenticator is a WebAuthn authenticator with an ES256 key, for tests.
+type softAuthenticator struct {
+	id        []byte
+	key       *ecdsa.PrivateKey
+	rpID      string
+	origin    string
+	signCount uint32
+	flags     byte
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &softAuthenticator{
+		id:     id,
+		key:    key,
+		rpID:   RP_ID,
+		origin: RP_ORIGIN,
+		flags:  authenticatorFlagUserPresent | authenticatorFlagUserVerified,
+	}
+}
+
+func (a *softAuthenticator) publicKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+
+	return encodeCBOR(map[interface{}]interface{}{
+		coseLabelKty: coseKtyEC2,
+		coseLabelAlg: coseAlgES256,
+		coseLabelCrv: coseCrvP256,
+		coseLabelX:   x,
+		coseLabelY:   y,
+	})
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+
+	data := append(rpIDHash[:], flags)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    a.origin,
+	})
+	return data
+}
+
+// create creates a credential, like navigator.credentials.create.
+func (a *softAuthenticator) create(options *WebAuthnCreationOptions) *WebAuthnResponse {
+	attested := make([]byte, 16) // aaguid
+	attested = append(attested, byte(len(a.id)>>8), byte(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, a.publicKey()...)
+
+	attestation := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authenticatorData(a.flags|authenticatorFlagAttestedCredential, attested),
+	})
+
+	return &WebAuthnResponse{
+		ID:   webAuthnBase64.EncodeToString(a.id),
+		Type: "public-key",
+		Response: WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    webAuthnBase64.EncodeToString(a.clientData("webauthn.create", options.Challenge)),
+			AttestationObject: webAuthnBase64.EncodeToString(attestation),
+		},
+	}
+}
+
+// get creates an assertion, like navigator.credentials.get.
+func (a *softAuthenticator) get(options *WebAuthnRequestOptions) *WebAuthnResponse {
+	a.signCount++
+
+	data := a.authenticatorData(a.flags, nil)
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+
+	digest := sha256.Sum256(append(data[:len(data):len(data)], clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return &WebAuthnResponse{
+		ID:   webAuthnBase64.EncodeToString(a.id),
+		Type: "public-key",
+		Response: WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    webAuthnBase64.EncodeToString(clientData),
+			AuthenticatorData: webAuthnBase64.EncodeToString(data),
+			Signature:         webAuthnBase64.EncodeToString(signature),
+		},
+	}
+}
+
+// registerPasskey registers user1 with a passkey of the authenticator.
+func registerPasskey(t *testing.T, users *Registry, a *softAuthenticator) {
+	err := users.Register("user1", "password1")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	options, err := users.BeginWebAuthnRegistration("user1", "password1")
+	if err != nil {
+		t.Fatalf("error starting registration: %v", err)
+	}
+
+	if options.RP.ID != RP_ID || options.User.Name != "user1" || len(options.ExcludeCredentials) != 0 {
+		t.Errorf("unexpected creation options %+v", options)
+	}
+
+	err = users.FinishWebAuthnRegistration(a.create(options))
+	if err != nil {
+		t.Fatalf("error finishing registration: %v", err)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	data := encodeCBOR(map[interface{}]interface{}{
+		"a": []interface{}{1, -1, 1000000, []byte{1, 2}, true, nil},
+		-3:  "text",
+	})
+
+	v, rest, err := decodeCBOR(append(data, 0xff))
+	if err != nil {
+		t.Fatalf("error decoding: %v", err)
+	}
+
+	if len(rest) != 1 || rest[0] != 0xff {
+		t.Errorf("unexpected remaining bytes %x", rest)
+	}
+
+	m := v.(map[interface{}]interface{})
+	a := m["a"].([]interface{})
+	if a[0] != int64(1) || a[1] != int64(-1) || a[2] != int64(1000000) || string(a[3].([]byte)) != "\x01\x02" || a[4] != true || a[5] != nil {
+		t.Errorf("unexpected array %v", a)
+	}
+	if m[int64(-3)] != "text" {
+		t.Errorf("unexpected map %v", m)
+	}
+
+	invalid := [][]byte{
+		{},
+		{0x5f},       // indefinite length
+		{0x44, 1, 2}, // truncated byte string
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // huge array
+		{0xa2, 0x01, 0x01, 0x01, 0x01},                         // duplicate key
+		{0xc1, 0x00},                                           // tag
+	}
+	for _, data := range invalid {
+		if _, _, err := decodeCBOR(data); err == nil {
+			t.Errorf("%x: expected error", data)
+		}
+	}
+}
+
+func TestRegistry_WebAuthn(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret, WithWebAuthn(RP_ID, "Example"))
+	a := newSoftAuthenticator(t)
+
+	registerPasskey(t, users, a)
+
+	options, err := users.BeginWebAuthnLogin("user1")
+	if err != nil {
+		t.Fatalf("error starting login: %v", err)
+	}
+
+	if len(options.AllowCredentials) != 1 || options.AllowCredentials[0].ID != webAuthnBase64.EncodeToString(a.id) {
+		t.Errorf("unexpected request options %+v", options)
+	}
+
+	response := a.get(options)
+
+	token, refreshToken, err := users.FinishWebAuthnLogin(response, ClientInfo{})
+	if err != nil {
+		t.Fatalf("error finishing login: %v", err)
+	}
+
+	if token == "" || refreshToken == "" {
+		t.Error("tokens not issued")
+	}
+
+	// the challenge can be used once
+	_, _, err = users.FinishWebAuthnLogin(response, ClientInfo{})
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("replayed assertion accepted: %v", err)
+	}
+
+	// registering the same credential again fails
+	creation, err := users.BeginWebAuthnRegistration("user1", "password1")
+	if err != nil {
+		t.Fatalf("error starting registration: %v", err)
+	}
+
+	if len(creation.ExcludeCredentials) != 1 {
+		t.Errorf("registered credential not excluded: %+v", creation.ExcludeCredentials)
+	}
+
+	if users.FinishWebAuthnRegistration(a.create(creation)) == nil {
+		t.Error("registered credential twice")
+	}
+
+	// the credential ID identifies the user, so it can not be registered for another user
+	err = users.Register("user2", "password2")
+	if err != nil {
+		t.Fatalf("error registering user: %v", err)
+	}
+
+	creation, err = users.BeginWebAuthnRegistration("user2", "password2")
+	if err != nil {
+		t.Fatalf("error starting registration: %v", err)
+	}
+
+	if users.FinishWebAuthnRegistration(a.create(creation)) == nil {
+		t.Error("registered credential of another user")
+	}
+
+	_, err = users.BeginWebAuthnRegistration("user1", "password2")
+	if !errors.Is(err, UnauthorizedError) {
+		t.Errorf("registration started with a wrong password: %v", err)
+	}
+
+	// users without passkeys and missing users get decoy options, which do not change between logins
+	for _, username := range []string{"user2", "missing"} {
+		options, err := users.BeginWebAuthnLogin(username)
+		if err != nil || len(options.AllowCredentials) != 1 || options.Challenge == "" {
+			t.Fatalf("%s: expected decoy options, got %+v, %v", username, options, err)
+		}
+
+		again, _ := users.BeginWebAuthnLogin(username)
+		if again.AllowCredentials[0] != options.AllowCredentials[0] {
+			t.Errorf("%s: decoy credential changed", username)
+		}
+
+		_, _, err = users.FinishWebAuthnLogin(a.get(options), ClientInfo{})
+		if !errors.Is(err, UnauthorizedError) {
+			t.Errorf("%s: login with decoy options succeeded: %v", username, err)
+		}
+	}
+}
+
+func TestRegistry_WebAuthnInvalidAssertion(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret, WithWebAuthn(RP_ID, "Example"))
+	a := newSoftAuthenticator(t)
+
+	registerPasskey(t, users, a)
+
+	login := func(a *softAuthenticator, modify func(r *WebAuthnResponse)) error {
+		options, err := users.BeginWebAuthnLogin("user1")
+		if err != nil {
+			t.Fatalf("error starting login: %v", err)
+		}
+
+		response := a.get(options)
+		if modify != nil {
+			modify(response)
+		}
+
+		_, _, err = users.FinishWebAuthnLogin(response, ClientInfo{})
+		return err
+	}
+
+	err := login(a, nil)
+	if err != nil {
+		t.Fatalf("error finishing login: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		authenticator func(a *softAuthenticator)
+		response      func(r *WebAuthnResponse)
+	}{
+		{name: "wrong origin", authenticator: func(a *softAuthenticator) {
+			a.origin = "https://evil.example"
+		}},
+		{name: "wrong relying party", authenticator: func(a *softAuthenticator) {
+			a.rpID = "evil.example"
+		}},
+		{name: "user not verified", authenticator: func(a *softAuthenticator) {
+			a.flags = authenticatorFlagUserPresent
+		}},
+		{name: "cloned authenticator", authenticator: func(a *softAuthenticator) {
+			a.signCount-- // the counter does not increase
+		}},
+		{name: "wrong key", authenticator: func(a *softAuthenticator) {
+			a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}},
+		{name: "tampered signature", response: func(r *WebAuthnResponse) {
+			r.Response.Signature = webAuthnBase64.EncodeToString([]byte("signature"))
+		}},
+		{name: "unknown credential", response: func(r *WebAuthnResponse) {
+			r.ID = webAuthnBase64.EncodeToString([]byte("unknown"))
+		}},
+		{name: "wrong ceremony", response: func(r *WebAuthnResponse) {
+			r.Response.ClientDataJSON = webAuthnBase64.EncodeToString([]byte(`{"type":"webauthn.create"}`))
+		}},
+	}
+
+	for _, test := range tests {
+		modified := *a
+		if test.authenticator != nil {
+			test.authenticator(&modified)
+		}
+
+		err := login(&modified, test.response)
+		if !errors.Is(err, UnauthorizedError) {
+			t.Errorf("%s: expected unauthorized, got %v", test.name, err)
+		}
+	}
+
+	// the authenticator still works
+	err = login(a, nil)
+	if err != nil {
+		t.Errorf("error finishing login: %v", err)
+	}
+}
+
+func TestRegistry_WebAuthnLoginLimiter(t *testing.T) {
+	users := NewRegistry(newMockStorage(), secret, WithWebAuthn(RP_ID, "Example"), WithLoginLimiter(NewLoginLimiter()))
+	a := newSoftAuthenticator(t)
+
+	registerPasskey(t, users, a)
+
+	// another authenticator of the attacker signs with a wrong key
+	wrong := *a
+	wrong.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var started []*WebAuthnRequestOptions
+	for i := 0; i < 5; i++ {
+		options, err := users.BeginWebAuthnLogin("user1")
+		if err != nil {
+			t.Fatalf("error starting login: %v", err)
+		}
+		started = append(started, options)
+	}
+
+	for _, options := range started[:4] {
+		_, _, err := users.FinishWebAuthnLogin(wrong.get(options), ClientInfo{})
+		if !errors.Is(err, UnauthorizedError) {
+			t.Fatalf("expected unauthorized, got %v", err)
+		}
+	}
+
+	var throttled *LoginThrottledError
+	_, _, err := users.FinishWebAuthnLogin(a.get(started[4]), ClientInfo{})
+	if !errors.As(err, &throttled) {
+		t.Errorf("expected throttled login, got %v", err)
+	}
+
+	_, err = users.BeginWebAuthnLogin("user1")
+	if !errors.As(err, &throttled) {
+		t.Errorf("expected throttled start of login, got %v", err)
+	}
+}
+
+func TestSimpleFileStorage_WebAuthn(t *testing.T) {
+	os.Remove(STORAGE_FILE)
+	storage, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	users := NewRegistry(storage, secret, WithWebAuthn(RP_ID, "Example"))
+	a := newSoftAuthenticator(t)
+
+	registerPasskey(t, users, a)
+
+	storage2, err := NewSimpleFileStorage(STORAGE_FILE, SALT)
+	if err != nil {
+		t.Fatalf("error initializing storage: %v", err)
+	}
+
+	credentials, _ := storage2.LoadWebAuthnCredentials("user1")
+	if len(credentials) != 1 || string(credentials[0].ID) != string(a.id) || string(credentials[0].PublicKey) != string(a.publicKey()) {
+		t.Fatalf("credential not persisted: %+v", credentials)
+	}
+
+	users = NewRegistry(storage2, secret, WithWebAuthn(RP_ID, "Example"))
+
+	options, err := users.BeginWebAuthnLogin("user1")
+	if err != nil {
+		t.Fatalf("error starting login: %v", err)
+	}
+
+	_, _, err = users.FinishWebAuthnLogin(a.get(options), ClientInfo{})
+	if err != nil {
+		t.Fatalf("error finishing login: %v", err)
+	}
+
+	credentials, _ = storage2.LoadWebAuthnCredentials("user1")
+	if len(credentials) != 1 || credentials[0].SignCount != a.signCount {
+		t.Errorf("sign count not updated: %+v", credentials)
+	}
+
+	user, _ := storage2.Load("user1")
+	if len(user.Options) != 0 {
+		t.Errorf("credentials left in options %v", user.Options)
+	}
+
+	err = storage2.Delete("user1")
+	if err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+
+	if credentials, _ := storage2.LoadWebAuthnCredentials("user1"); len(credentials) != 0 {
+		t.Error("credentials of deleted user kept")
+	}
+}